@@ -0,0 +1,21 @@
+// Command calx-kernel runs formulas for calx in a separate process. It
+// speaks JSON-RPC 2.0 on stdin and stdout, one message per line.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/lrdickson/calx/internal/kernel"
+	"github.com/lrdickson/calx/internal/kernel/remote"
+)
+
+func main() {
+	// Keep anything else written to stdout out of the protocol
+	protocol := os.Stdout
+	os.Stdout = os.Stderr
+
+	if err := remote.Serve(kernel.NewLocalKernel(), os.Stdin, protocol); err != nil {
+		log.Fatalln("Kernel failed:", err)
+	}
+}
@@ -1,8 +1,46 @@
 package main
 
-import "github.com/lrdickson/calx/internal/view"
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/lrdickson/calx/internal/kernel"
+	"github.com/lrdickson/calx/internal/kernel/remote"
+	"github.com/lrdickson/calx/internal/view"
+)
 
 func main() {
+	kernelProcess := flag.Bool("kernel-process", false, "run formulas in a calx-kernel child process")
+	flag.Parse()
+
+	// Pick where formulas run
+	var goKernel kernel.Kernel = kernel.NewLocalKernel()
+	if *kernelProcess {
+		remoteKernel, err := remote.NewKernel(kernelPath())
+		if err != nil {
+			log.Fatalln("Failed to start the kernel process:", err)
+		}
+		goKernel = remoteKernel
+	}
+	defer goKernel.Close()
+	compiledKernel := kernel.NewCompiledKernel()
+	defer compiledKernel.Close()
+
 	// Start the GUI
-	view.RunGui()
+	view.RunGui(goKernel, compiledKernel)
+}
+
+// kernelPath finds calx-kernel next to this executable, falling back to
+// the PATH
+func kernelPath() string {
+	executable, err := os.Executable()
+	if err == nil {
+		path := filepath.Join(filepath.Dir(executable), "calx-kernel")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return "calx-kernel"
 }
@@ -1,9 +1,12 @@
 package controller
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"strconv"
 
+	"github.com/lrdickson/calx/internal/kernel"
 	"github.com/lrdickson/calx/internal/variable"
 )
 
@@ -80,11 +83,35 @@ func (c *Controller) AddFormula() {
 	c.AddVariable(c.uniqueName(), &formula)
 }
 
-func (c *Controller) Rename(oldName, newName string) {
+func (c *Controller) Rename(oldName, newName string) error {
 	// Check if the oldName exists
 	if _, exists := c.variables[oldName]; !exists {
-		log.Println("Error: attempt to rename a variable that doesn't exist:", oldName)
-		return
+		return errors.New("attempt to rename a variable that doesn't exist: " + oldName)
+	}
+
+	// Check the new name
+	if _, taken := c.variables[newName]; taken {
+		return errors.New(newName + " is already taken")
+	}
+	if err := kernel.ValidateName(newName); err != nil {
+		return err
+	}
+
+	// Rewrite the formulas that refer to the variable
+	renamedCode := make(map[string]string)
+	for name, v := range c.variables {
+		formula, isFormula := (*v).(variable.Formula)
+		if !isFormula {
+			continue
+		}
+		code, err := kernel.RenameReferences(formula.Code(), oldName, newName)
+		if err != nil {
+			return fmt.Errorf("failed to update %s: %w", name, err)
+		}
+		renamedCode[name] = code
+	}
+	for name, code := range renamedCode {
+		*c.variables[name] = (*c.variables[name]).(variable.Formula).WithCode(code)
 	}
 
 	// Update the variable map
@@ -99,6 +126,7 @@ func (c *Controller) Rename(oldName, newName string) {
 
 	// Trigger the event
 	c.eventTriggered(RenameVarEvent, newName)
+	return nil
 }
 
 func (c *Controller) Delete(name string) {
@@ -1,6 +1,10 @@
 package controller
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/lrdickson/calx/internal/variable"
+)
 
 func TestAddFormula(t *testing.T) {
 	// Setup the add listener
@@ -37,3 +41,63 @@ func TestRename(t *testing.T) {
 		t.Fatal(newName, "not in variables")
 	}
 }
+
+func TestRenameRewritesFormulas(t *testing.T) {
+	// Add a formula that refers to another
+	c := NewController()
+	var first variable.Variable = variable.Formula{}.WithCode("return 1")
+	var second variable.Variable = variable.Formula{}.WithCode("x := \"first\"\nreturn first + 1")
+	c.AddVariable("first", &first)
+	c.AddVariable("second", &second)
+
+	// Rename the variable being referred to
+	if err := c.Rename("first", "renamed"); err != nil {
+		t.Fatal("Rename returned error:", err)
+	}
+
+	// Check the result
+	code := (*c.Variables("second")).(variable.Formula).Code()
+	if code != "x := \"first\"\nreturn renamed + 1" {
+		t.Fatal("Unexpected code after rename:", code)
+	}
+}
+
+func TestRenameWithBrokenFormula(t *testing.T) {
+	// A formula that is being edited doesn't stop unrelated renames
+	c := NewController()
+	var first variable.Variable = variable.Formula{}.WithCode("return 1")
+	var second variable.Variable = variable.Formula{}.WithCode("return first + 1")
+	var broken variable.Variable = variable.Formula{}.WithCode("x := (2 *\nreturn x")
+	c.AddVariable("first", &first)
+	c.AddVariable("second", &second)
+	c.AddVariable("broken", &broken)
+	if err := c.Rename("first", "renamed"); err != nil {
+		t.Fatal("Rename returned error:", err)
+	}
+	if code := (*c.Variables("second")).(variable.Formula).Code(); code != "return renamed + 1" {
+		t.Fatal("Unexpected code after rename:", code)
+	}
+	if code := (*c.Variables("broken")).(variable.Formula).Code(); code != "x := (2 *\nreturn x" {
+		t.Fatal("The broken formula should be left alone but is", code)
+	}
+
+	// It still stops renames of names it uses
+	broken = variable.Formula{}.WithCode("return (renamed +")
+	if err := c.Rename("renamed", "other"); err == nil {
+		t.Fatal("Rename should have failed")
+	}
+}
+
+func TestRenameInvalid(t *testing.T) {
+	c := NewController()
+	c.AddFormula()
+	c.AddFormula()
+	for _, newName := range []string{"var2", "func", "len", "Pi", "1abc", ""} {
+		if err := c.Rename("var1", newName); err == nil {
+			t.Fatal("Rename to", newName, "should have failed")
+		}
+	}
+	if _, exists := c.variables["var1"]; !exists {
+		t.Fatal("var1 should not have been renamed")
+	}
+}
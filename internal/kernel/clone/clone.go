@@ -0,0 +1,152 @@
+// Package clone makes deep copies of values so that a formula can't change
+// the values other formulas are given.
+package clone
+
+import (
+	"math/big"
+	"reflect"
+)
+
+// key identifies something a pointer, map or slice refers to
+type key struct {
+	pointer uintptr
+	length  int
+	t       reflect.Type
+}
+
+// cloner remembers what was already copied so that values that refer to
+// each other still do in the copy and cycles end
+type cloner struct {
+	copies map[key]reflect.Value
+}
+
+// Value returns a deep copy of value. Pointers, slices, maps, arrays,
+// structs and interfaces are copied all the way down. Functions, channels,
+// unsafe pointers and what the unexported fields of structs refer to are
+// shared with the original, since they can't be copied or set from outside
+// their package. The numbers of math/big are the exception, they are
+// copied with their Set methods. Slices and arrays of values that refer to
+// nothing, such as []byte or []float64, are copied in one go.
+func Value(value any) any {
+	if value == nil {
+		return nil
+	}
+	c := cloner{copies: make(map[key]reflect.Value)}
+	return c.clone(reflect.ValueOf(value)).Interface()
+}
+
+// flat reports whether values of a type refer to nothing else, so that a
+// shallow copy is a deep copy
+func flat(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Array:
+		return flat(t.Elem())
+	case reflect.Struct:
+		for index := 0; index < t.NumField(); index++ {
+			if !flat(t.Field(index).Type) {
+				return false
+			}
+		}
+		return true
+	case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return false
+	}
+	return true
+}
+
+// cloneBig copies the numbers of math/big, whose fields are unexported
+func cloneBig(v reflect.Value) (reflect.Value, bool) {
+	switch number := v.Interface().(type) {
+	case *big.Int:
+		return reflect.ValueOf(new(big.Int).Set(number)), true
+	case *big.Float:
+		return reflect.ValueOf(new(big.Float).Copy(number)), true
+	case *big.Rat:
+		return reflect.ValueOf(new(big.Rat).Set(number)), true
+	}
+	return v, false
+}
+
+func (c *cloner) clone(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		k := key{v.Pointer(), 0, v.Type()}
+		if copied, exists := c.copies[k]; exists {
+			return copied
+		}
+		if v.CanInterface() {
+			if copied, isBig := cloneBig(v); isBig {
+				c.copies[k] = copied
+				return copied
+			}
+		}
+		copied := reflect.New(v.Type().Elem())
+		c.copies[k] = copied
+		copied.Elem().Set(c.clone(v.Elem()))
+		return copied
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		k := key{v.Pointer(), v.Len(), v.Type()}
+		if copied, exists := c.copies[k]; exists {
+			return copied
+		}
+		copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		c.copies[k] = copied
+		if flat(v.Type().Elem()) {
+			reflect.Copy(copied, v)
+			return copied
+		}
+		for index := 0; index < v.Len(); index++ {
+			copied.Index(index).Set(c.clone(v.Index(index)))
+		}
+		return copied
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		k := key{v.Pointer(), 0, v.Type()}
+		if copied, exists := c.copies[k]; exists {
+			return copied
+		}
+		copied := reflect.MakeMapWithSize(v.Type(), v.Len())
+		c.copies[k] = copied
+		iterator := v.MapRange()
+		for iterator.Next() {
+			copied.SetMapIndex(c.clone(iterator.Key()), c.clone(iterator.Value()))
+		}
+		return copied
+	case reflect.Array:
+		copied := reflect.New(v.Type()).Elem()
+		if flat(v.Type()) {
+			copied.Set(v)
+			return copied
+		}
+		for index := 0; index < v.Len(); index++ {
+			copied.Index(index).Set(c.clone(v.Index(index)))
+		}
+		return copied
+	case reflect.Struct:
+		// Start from a shallow copy to keep the unexported fields
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(v)
+		for index := 0; index < v.NumField(); index++ {
+			if v.Type().Field(index).IsExported() {
+				copied.Field(index).Set(c.clone(v.Field(index)))
+			}
+		}
+		return copied
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(c.clone(v.Elem()))
+		return copied
+	}
+	return v
+}
@@ -0,0 +1,112 @@
+package clone
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type node struct {
+	Name     string
+	Values   []int
+	Children map[string]*node
+	Parent   *node
+	Any      any
+	hidden   []int
+}
+
+func TestValue(t *testing.T) {
+	tests := []any{
+		nil,
+		1,
+		"text",
+		[]int{1, 2, 3},
+		[]int(nil),
+		[2][]string{{"a"}, {"b", "c"}},
+		map[string][]float64{"a": {1.5}},
+		[]any{1, []int{2}, map[int]bool{3: true}},
+		time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		&node{Name: "root", Values: []int{1}},
+	}
+	for _, value := range tests {
+		if copied := Value(value); !reflect.DeepEqual(copied, value) {
+			t.Errorf("Value(%#v) = %#v", value, copied)
+		}
+	}
+}
+
+func TestIsolation(t *testing.T) {
+	hidden := []int{9}
+	root := &node{Name: "root", Values: []int{1, 2}, Children: map[string]*node{}, hidden: hidden}
+	child := &node{Name: "child", Parent: root, Any: []string{"x"}}
+	root.Children["child"] = child
+	root.Any = root.Children
+	copied := Value(root).(*node)
+
+	// Changing the copy leaves the original alone
+	copied.Values[0] = 100
+	copied.Children["child"].Name = "changed"
+	copied.Children["child"].Any.([]string)[0] = "y"
+	copied.Children["other"] = &node{}
+	if root.Values[0] != 1 || child.Name != "child" || child.Any.([]string)[0] != "x" || len(root.Children) != 1 {
+		t.Fatal("The original was changed through the copy:", root, child)
+	}
+
+	// References within the value are kept, including cycles
+	copiedChild := copied.Children["child"]
+	if copiedChild.Parent != copied || reflect.ValueOf(copied.Any).Pointer() != reflect.ValueOf(copied.Children).Pointer() {
+		t.Fatal("References within the copy should point into the copy")
+	}
+
+	// Unexported fields can't be copied
+	if &copied.hidden[0] != &hidden[0] {
+		t.Fatal("Unexported fields should be shared")
+	}
+}
+
+func TestFlatAndBig(t *testing.T) {
+	type point struct{ X, Y float64 }
+	points := []point{{1, 2}, {3, 4}}
+	bytes := [][4]byte{{1, 2, 3, 4}}
+	number := big.NewInt(7)
+	copied := Value([]any{points, bytes, number}).([]any)
+
+	// Slices of values that refer to nothing are still copies
+	copied[0].([]point)[0].X = 100
+	copied[1].([][4]byte)[0][0] = 100
+	copied[2].(*big.Int).SetInt64(100)
+	if points[0].X != 1 || bytes[0][0] != 1 || number.Int64() != 7 {
+		t.Fatal("The original was changed through the copy:", points, bytes, number)
+	}
+	if !reflect.DeepEqual(Value(points), points) {
+		t.Fatal("The copy should equal the original")
+	}
+}
+
+func BenchmarkFloats(b *testing.B) {
+	values := make([]float64, 1<<20)
+	b.SetBytes(int64(len(values) * 8))
+	for i := 0; i < b.N; i++ {
+		Value(values)
+	}
+}
+
+func BenchmarkStructs(b *testing.B) {
+	type row struct {
+		ID    int
+		Price float64
+		Tags  [4]byte
+	}
+	values := make([]row, 1<<16)
+	for i := 0; i < b.N; i++ {
+		Value(values)
+	}
+}
+
+func BenchmarkStrings(b *testing.B) {
+	values := make([]string, 1<<16)
+	for i := 0; i < b.N; i++ {
+		Value(values)
+	}
+}
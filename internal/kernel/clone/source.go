@@ -0,0 +1,9 @@
+package clone
+
+import "embed"
+
+// Source holds the code of this package other than this file, so that
+// compiled formula programs copy values the same way
+//
+//go:embed clone.go
+var Source embed.FS
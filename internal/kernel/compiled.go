@@ -0,0 +1,454 @@
+package kernel
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/types"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrdickson/calx/internal/kernel/render"
+)
+
+// CompiledKernel runs formulas at full speed by building them into a Go
+// program with the go command and running it. Every update builds and runs
+// all of the formulas again, so nothing is cached between updates and
+// RenameFormula does nothing. Results are passed back as JSON, so their
+// values are what encoding/json decodes into any.
+//
+// Compiled formulas can't be watched while they run. Only the packages that
+// can't get around the project policy may be imported, and only the timeout
+// of Limits is enforced. Formulas share the program's stdout, so what they
+// print goes to the kernel's stderr instead of Result.Output. Formulas that
+// handle upstream errors get the dependencies that failed to build as any.
+// Continuous formulas can't be compiled since the program exits once every
+// formula has returned.
+type CompiledKernel struct {
+	// GoCommand is the go command used to build the program
+	GoCommand string
+
+	closeOnce sync.Once
+	dir       string
+	done      chan struct{}
+	importer  types.Importer
+	running   chan struct{}
+
+	cancel      context.CancelFunc
+	mutex       sync.Mutex
+	parallelism int
+	project     project
+	limits      Limits
+
+	eventSource
+}
+
+var _ Kernel = (*CompiledKernel)(nil)
+
+func NewCompiledKernel() *CompiledKernel {
+	return &CompiledKernel{
+		GoCommand:   "go",
+		done:        make(chan struct{}),
+		importer:    defaultImporter(),
+		parallelism: runtime.NumCPU(),
+		running:     make(chan struct{}, 1),
+	}
+}
+
+// SetPrelude sets code that is built into the program along with the
+// formulas
+func (k *CompiledKernel) SetPrelude(prelude string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.project.prelude = prelude
+}
+
+// SetDotImportMath sets whether the math package is dot imported for every
+// formula
+func (k *CompiledKernel) SetDotImportMath(enabled bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.project.dotImportMath = enabled
+}
+
+// SetPolicy sets what formulas are allowed to import
+func (k *CompiledKernel) SetPolicy(policy Policy) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.project.policy = policy
+}
+
+// SetLimits sets the limits of formulas. Only the timeout is enforced.
+func (k *CompiledKernel) SetLimits(limits Limits) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.limits = limits
+}
+
+// SetParallelism sets how many formulas the program runs at the same time.
+// A value below 1 uses the number of CPUs.
+func (k *CompiledKernel) SetParallelism(parallelism int) {
+	if parallelism < 1 {
+		parallelism = runtime.NumCPU()
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.parallelism = parallelism
+}
+
+// RenameFormula does nothing since there are no cached results to keep
+func (k *CompiledKernel) RenameFormula(oldName, newName string) {}
+
+// StopFormula does nothing since continuous formulas can't be compiled
+func (k *CompiledKernel) StopFormula(name string) {}
+
+// Stop stops building or running the program. The formulas that didn't
+// finish are reported as cancelled.
+func (k *CompiledKernel) Stop() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.cancel != nil {
+		k.cancel()
+	}
+}
+
+// Close stops the running update and removes the built program. Updates
+// after Close return ErrClosed.
+func (k *CompiledKernel) Close() error {
+	var err error
+	k.closeOnce.Do(func() {
+		close(k.done)
+		k.Stop()
+		k.running <- struct{}{}
+		if k.dir != "" {
+			err = os.RemoveAll(k.dir)
+		}
+	})
+	return err
+}
+
+func (k *CompiledKernel) Update(ctx context.Context, formulas map[string]*Formula) (map[string]*Result, error) {
+	return k.update(ctx, formulas, "")
+}
+
+// Evaluate builds and runs a program with only the formula and the formulas
+// it depends on
+func (k *CompiledKernel) Evaluate(ctx context.Context, formulas map[string]*Formula, name string) (map[string]*Result, error) {
+	return k.update(ctx, formulas, name)
+}
+
+// update runs the formulas, or only the target formula and its ancestors
+// when a target is given
+func (k *CompiledKernel) update(ctx context.Context, formulas map[string]*Formula, target string) (map[string]*Result, error) {
+	k.mutex.Lock()
+	p := k.project
+	limits := k.limits
+	parallelism := k.parallelism
+	k.mutex.Unlock()
+	formulas = resolveDependencies(formulas, p)
+	if target != "" {
+		var err error
+		if formulas, err = ancestors(formulas, target); err != nil {
+			return nil, err
+		}
+	}
+	order, err := sortFormulas(formulas)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for any other update to finish
+	select {
+	case k.running <- struct{}{}:
+	case <-k.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-k.running }()
+
+	// Let the update be stopped
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	k.mutex.Lock()
+	select {
+	case <-k.done:
+		k.mutex.Unlock()
+		return nil, ErrClosed
+	default:
+	}
+	k.cancel = cancel
+	k.mutex.Unlock()
+	defer func() {
+		k.mutex.Lock()
+		k.cancel = nil
+		k.mutex.Unlock()
+	}()
+
+	// Check the formulas, leaving out the ones that can't be built
+	if err := checkPreludeImports(p.prelude, p.policy.checkCompiledImports); err != nil {
+		return nil, err
+	}
+	builder, err := newProgramBuilder(k.importer, p)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]*Result)
+	resolve := func(name string, result Result) {
+		result.Warnings = append(result.Warnings, formulas[name].warnings...)
+		results[name] = &result
+		k.emitResult(name, result, false)
+	}
+	for _, name := range order {
+		formula := formulas[name]
+		failures := make(map[string]error)
+		for _, dependency := range formula.Dependencies {
+			if result, failed := results[dependency]; failed {
+				failures[dependency] = upstreamError(dependency, *result)
+			}
+		}
+		if failed := failedDependency(formula, results); failed != "" && !formula.CatchErrors {
+			resolve(name, Result{Status: StatusSkipped, Error: "upstream failed: " + failed})
+			continue
+		}
+		formulaLimits := formula.Limits.withDefaults(limits)
+		timeout := strconv.FormatInt(int64(formulaLimits.Timeout), 10)
+		if formula.Language == LanguageExpression {
+			if result := builder.addExpression(name, formula, timeout, failures); result != nil {
+				resolve(name, *result)
+			}
+			continue
+		}
+		if err := p.policy.checkCompiledImports(formula.Imports); err != nil {
+			resolve(name, Result{Status: StatusDenied, Error: err.Error()})
+			continue
+		}
+		if formula.isContinuous() {
+			resolve(name, Result{Status: StatusCompileError, Error: "continuous formulas can't be compiled"})
+			continue
+		}
+		if formulaLimits.watched() {
+			formula.warnings = append(formula.warnings, "only the timeout limit applies to compiled formulas")
+		}
+		if result := builder.add(name, formula, timeout, failures); result != nil {
+			resolve(name, *result)
+		}
+	}
+	if len(builder.formulas) == 0 {
+		return results, nil
+	}
+
+	// Build and run the program
+	executable, err := k.build(ctx, builder, p.prelude, parallelism)
+	if err != nil {
+		failure := Result{Status: StatusCompileError, Error: err.Error()}
+		if ctx.Err() != nil {
+			failure = Result{Status: StatusCancelled, Error: ctx.Err().Error()}
+		}
+		for _, formula := range builder.formulas {
+			resolve(formula.name, failure)
+		}
+		return results, nil
+	}
+	k.run(ctx, executable, formulas, resolve)
+
+	// Report the formulas the program didn't finish
+	for _, formula := range builder.formulas {
+		if _, finished := results[formula.name]; finished {
+			continue
+		}
+		if ctx.Err() != nil {
+			resolve(formula.name, Result{Status: StatusCancelled, Error: ctx.Err().Error()})
+		} else {
+			resolve(formula.name, Result{Status: StatusPanic, Error: "the formula program exited before the formula finished"})
+		}
+	}
+	return results, nil
+}
+
+// failedDependency returns the first dependency of a formula that already
+// has a result, which means it won't be in the program
+func failedDependency(formula *Formula, results map[string]*Result) string {
+	for _, dependency := range formula.Dependencies {
+		if _, failed := results[dependency]; failed {
+			return dependency
+		}
+	}
+	return ""
+}
+
+// build writes out the program and builds it, returning the path of the
+// executable. The same directory is used for every update so that the go
+// command can reuse what it built before.
+func (k *CompiledKernel) build(ctx context.Context, builder *programBuilder, prelude string, parallelism int) (string, error) {
+	if k.dir == "" {
+		dir, err := os.MkdirTemp("", "calx-formulas-")
+		if err != nil {
+			return "", err
+		}
+		k.dir = dir
+	}
+
+	// Replace the files of the last update
+	entries, err := os.ReadDir(k.dir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(k.dir, entry.Name())); err != nil {
+			return "", err
+		}
+	}
+	for name, source := range builder.files(prelude, parallelism) {
+		path := filepath.Join(k.dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(path, []byte(source), 0o644); err != nil {
+			return "", err
+		}
+	}
+
+	executable := filepath.Join(k.dir, "formulas")
+	if runtime.GOOS == "windows" {
+		executable += ".exe"
+	}
+	build := exec.CommandContext(ctx, k.GoCommand, "build", "-o", executable, ".")
+	build.Dir = k.dir
+	build.Env = append(os.Environ(), "CGO_ENABLED=0", "GOFLAGS=-mod=mod", "GOWORK=off")
+	if output, err := build.CombinedOutput(); err != nil {
+		if len(output) > 0 {
+			return "", errors.New(strings.TrimSpace(string(output)))
+		}
+		return "", fmt.Errorf("building the formulas: %w", err)
+	}
+	return executable, nil
+}
+
+// programMessage is a line written by the program when a formula starts or
+// finishes
+type programMessage struct {
+	Name      string                 `json:"name"`
+	Status    string                 `json:"status"`
+	Value     json.RawMessage        `json:"value"`
+	Rendering render.Rendering       `json:"rendering"`
+	Error     string                 `json:"error"`
+	Duration  time.Duration          `json:"duration"`
+	Outputs   []programOutputMessage `json:"outputs"`
+}
+
+// programOutputMessage is an output of a formula that returned Outputs
+type programOutputMessage struct {
+	Name      string           `json:"name"`
+	Value     json.RawMessage  `json:"value"`
+	Rendering render.Rendering `json:"rendering"`
+}
+
+// programStatuses maps the statuses written by the program to the kernel
+// statuses
+var programStatuses = map[string]Status{
+	"ok":      StatusOK,
+	"error":   StatusError,
+	"panic":   StatusPanic,
+	"skipped": StatusSkipped,
+	"timeout": StatusTimeout,
+}
+
+// result turns a finished formula written by the program into a Result.
+// Only formulas that succeeded have a value. A status the kernel doesn't
+// know or a value that can't be decoded means the program and the kernel
+// don't match, which fails the formula instead of passing it off as OK.
+func (m *programMessage) result() Result {
+	status, known := programStatuses[m.Status]
+	if !known {
+		return Result{
+			Status:   StatusPanic,
+			Error:    "the formula program wrote an unknown status " + strconv.Quote(m.Status),
+			Duration: m.Duration,
+		}
+	}
+	result := Result{
+		Text:      m.Rendering.Text,
+		Rendering: m.Rendering,
+		Status:    status,
+		Error:     m.Error,
+		Duration:  m.Duration,
+	}
+	if status != StatusOK {
+		return result
+	}
+	mismatch := func(err error) Result {
+		return Result{
+			Status:   StatusPanic,
+			Error:    "the formula program wrote a value that can't be decoded: " + err.Error(),
+			Duration: m.Duration,
+		}
+	}
+	if len(m.Value) > 0 {
+		if err := json.Unmarshal(m.Value, &result.Value); err != nil {
+			return mismatch(err)
+		}
+	}
+	if m.Outputs != nil {
+		// Keep the value as Outputs so that it renders its outputs again
+		// when the display options change
+		values := make(Outputs, len(m.Outputs))
+		for _, output := range m.Outputs {
+			var outputValue any
+			if len(output.Value) > 0 {
+				if err := json.Unmarshal(output.Value, &outputValue); err != nil {
+					return mismatch(err)
+				}
+			}
+			values[output.Name] = outputValue
+			result.Outputs = append(result.Outputs, Output{output.Name, outputValue, output.Rendering.Text, output.Rendering})
+		}
+		result.Value = values
+	}
+	return result
+}
+
+// run runs the program and resolves each formula as it finishes
+func (k *CompiledKernel) run(ctx context.Context, executable string, formulas map[string]*Formula, resolve func(string, Result)) {
+	program := exec.CommandContext(ctx, executable)
+	program.Stderr = os.Stderr
+	stdout, err := program.StdoutPipe()
+	if err != nil {
+		log.Println("Failed to run the formulas:", err)
+		return
+	}
+	if err := program.Start(); err != nil {
+		log.Println("Failed to run the formulas:", err)
+		return
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 64<<20)
+	for scanner.Scan() {
+		var message programMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			log.Println("Formula program wrote:", scanner.Text())
+			continue
+		}
+		if _, exists := formulas[message.Name]; !exists {
+			continue
+		}
+		if message.Status == "started" {
+			k.emit(Event{Type: StartedEvent, Name: message.Name})
+			continue
+		}
+		resolve(message.Name, message.result())
+	}
+	if err := program.Wait(); err != nil && ctx.Err() == nil {
+		log.Println("Formula program failed:", err)
+	}
+}
@@ -0,0 +1,225 @@
+package kernel
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// emitName and everyName are the functions continuous formulas publish
+// values and wait for ticks with
+const (
+	emitName  = "emit"
+	everyName = "every"
+)
+
+// tickerFunc starts the ticker behind every, returning its ticks and a
+// function that stops it. Tests replace it with one they tick by hand.
+type tickerFunc func(interval time.Duration) (ticks <-chan time.Time, stop func())
+
+func newTimeTicker(interval time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// isContinuous reports whether a formula keeps running in the background
+func (f *Formula) isContinuous() bool {
+	return f.Continuous && f.Language == LanguageGo
+}
+
+// continuousRun is a continuous formula running in the background. The
+// latest result it published waits here until an update picks it up.
+type continuousRun struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// first is closed once the formula publishes its first result
+	first chan struct{}
+
+	mutex    sync.Mutex
+	result   Result
+	started  bool
+	fresh    bool
+	finished bool
+}
+
+// publish keeps a result of the formula, ending the run when it is the
+// value the formula returned. It reports whether the result is waiting for
+// an update. Results of stopped formulas are dropped.
+func (r *continuousRun) publish(result Result, final bool) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.ctx.Err() != nil || r.finished {
+		return false
+	}
+	r.result = result
+	r.finished = final
+	if !r.started {
+		r.started = true
+		close(r.first)
+		return false
+	}
+	r.fresh = true
+	return true
+}
+
+// take returns the latest result and whether no update had picked it up
+func (r *continuousRun) take() (Result, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	fresh := r.fresh
+	r.fresh = false
+	return r.result, fresh
+}
+
+func (r *continuousRun) hasFresh() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.fresh
+}
+
+// startContinuous starts a continuous formula in the background and waits
+// for its first result. The timeout of the formula limits that wait, after
+// which the formula is stopped, and no longer applies once it has a value.
+// The values it emits after that are picked up by updateOnEmit.
+func (k *LocalKernel) startContinuous(ctx context.Context, j job) Result {
+	runCtx, cancel := context.WithCancel(context.Background())
+	run := &continuousRun{ctx: runCtx, cancel: cancel, first: make(chan struct{})}
+	k.mutex.Lock()
+	k.continuous[j.name] = run
+	k.mutex.Unlock()
+
+	j.emit = func(result Result) {
+		if run.publish(result, false) {
+			k.notifyEmitted()
+		}
+	}
+	j.every = func(interval time.Duration) <-chan time.Time {
+		return k.every(runCtx, interval)
+	}
+	timeout := j.limits.Timeout
+	j.limits.Timeout = 0
+	go func() {
+		// The returned value is the last one, which also stops the tickers
+		if run.publish(k.pool.run(runCtx, j), true) {
+			k.notifyEmitted()
+		}
+		cancel()
+	}()
+
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+	select {
+	case <-run.first:
+		result, _ := run.take()
+		return result
+	case <-timedOut:
+		k.stopContinuous(func(name string) bool { return name == j.name })
+		return Result{Status: StatusTimeout, Error: "timed out after " + timeout.String() + " waiting for the first value"}
+	case <-ctx.Done():
+		k.stopContinuous(func(name string) bool { return name == j.name })
+		return Result{Status: StatusCancelled, Error: ctx.Err().Error()}
+	}
+}
+
+// every ticks at an interval until the continuous formula is stopped, then
+// closes the channel so that loops over it end
+func (k *LocalKernel) every(ctx context.Context, interval time.Duration) <-chan time.Time {
+	ticks, stop := k.newTicker(interval)
+	forwarded := make(chan time.Time)
+	go func() {
+		defer close(forwarded)
+		defer stop()
+		for {
+			select {
+			case tick := <-ticks:
+				select {
+				case forwarded <- tick:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return forwarded
+}
+
+// notifyEmitted wakes up updateOnEmit. Values emitted while it is busy are
+// picked up together.
+func (k *LocalKernel) notifyEmitted() {
+	select {
+	case k.emitted <- struct{}{}:
+	default:
+	}
+}
+
+// updateOnEmit runs the dependents of continuous formulas again after they
+// emit values, until the kernel is closed. The formulas are the ones given
+// to the last update.
+func (k *LocalKernel) updateOnEmit() {
+	for {
+		select {
+		case <-k.done:
+			return
+		case <-k.emitted:
+		}
+
+		k.mutex.Lock()
+		formulas := k.formulas
+		emitting := make([]string, 0)
+		for name, run := range k.continuous {
+			if run.hasFresh() {
+				emitting = append(emitting, name)
+			}
+		}
+		k.mutex.Unlock()
+		targets := descendants(formulas, emitting)
+		if len(targets) == 0 {
+			continue
+		}
+		if _, err := k.update(context.Background(), formulas, targets...); err != nil && !errors.Is(err, ErrClosed) {
+			log.Println("Failed to update the dependents of continuous formulas:", err)
+		}
+	}
+}
+
+// StopFormula stops a continuous formula, keeping its last value. The next
+// update that includes the formula starts it again.
+func (k *LocalKernel) StopFormula(name string) {
+	k.stopContinuous(func(running string) bool { return running == name })
+}
+
+// stopContinuous stops the continuous formulas whose names match
+func (k *LocalKernel) stopContinuous(match func(name string) bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	names := make([]string, 0)
+	for name := range k.continuous {
+		if match(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Println("Stopping continuous formula", name)
+		k.continuous[name].cancel()
+		delete(k.continuous, name)
+	}
+}
+
+// runningFormula returns the run of a continuous formula that was started
+// and not stopped since, nil if there is none
+func (k *LocalKernel) runningFormula(name string) *continuousRun {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.continuous[name]
+}
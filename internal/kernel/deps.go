@@ -0,0 +1,128 @@
+package kernel
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
+
+	"github.com/traefik/yaegi/stdlib"
+)
+
+// mathSymbols are the names brought in by the math dot import
+var mathSymbols = func() map[string]bool {
+	symbols := make(map[string]bool)
+	for name := range stdlib.Symbols["math/math"] {
+		symbols[name] = true
+	}
+	return symbols
+}()
+
+// formulaHeader wraps formula code so that it can be parsed as the body of
+// a function
+const formulaHeader = "package run\nfunc Run() any {\n"
+
+// parseFormula parses formula code. Line numbers in the returned file set
+// are shifted by the lines in formulaHeader.
+func parseFormula(code string) (*token.FileSet, *ast.File, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", formulaHeader+code+"\n}", 0)
+	return fset, file, err
+}
+
+// freeIdentifiers returns every identifier in the code that isn't declared
+// by the code itself, in the order they appear
+func freeIdentifiers(code string) ([]*ast.Ident, error) {
+	_, file, err := parseFormula(code)
+	if err != nil {
+		return nil, err
+	}
+	return file.Unresolved, nil
+}
+
+// isKnownSymbol reports whether a formula can use a name without it being
+// a variable
+func isKnownSymbol(name string, known map[string]bool) bool {
+	return types.Universe.Lookup(name) != nil || known[name]
+}
+
+// undefinedWarning describes a name that can't be found, suggesting the
+// packages to import when it is used like a package
+func undefinedWarning(name string, usedAsPackage bool) string {
+	warning := "undefined name " + strconv.Quote(name)
+	if paths := stdlibPackages[name]; usedAsPackage && len(paths) > 0 {
+		quoted := make([]string, 0, len(paths))
+		for _, importPath := range paths {
+			quoted = append(quoted, strconv.Quote(importPath))
+		}
+		warning += " (add import " + strings.Join(quoted, " or ") + ")"
+	}
+	return warning
+}
+
+// findDependencies returns the variables that the code of a formula refers
+// to, along with warnings for names that can't be found. Code that doesn't
+// parse has no dependencies, the error is reported when it is compiled.
+// Imports hide variables of the same name and variables hide names known
+// from the project.
+func findDependencies(formula *Formula, formulas map[string]*Formula, known map[string]bool) ([]string, []string) {
+	if formula.Language == LanguageExpression {
+		return expressionDependencies(formula, formulas)
+	}
+	_, file, err := parseFormula(formula.Code)
+	if err != nil {
+		return nil, nil
+	}
+	imported := make(map[string]bool)
+	for _, importPath := range formula.Imports {
+		imported[importName(importPath)] = true
+	}
+	selectors := packageSelectors(file)
+	dependencies := make([]string, 0)
+	warnings := make([]string, 0)
+	seen := make(map[string]bool)
+
+	// Formulas that handle upstream errors are given the errors
+	seen[upstreamErrorsName] = formula.CatchErrors
+
+	// Continuous formulas are given emit and every
+	seen[emitName] = formula.isContinuous()
+	seen[everyName] = formula.isContinuous()
+
+	// Named results are variables of the formula
+	for _, name := range formula.resultNames() {
+		seen[name] = true
+	}
+	for _, identifier := range file.Unresolved {
+		name := identifier.Name
+		if seen[name] || imported[name] {
+			continue
+		}
+		seen[name] = true
+		if _, exists := formulas[name]; exists {
+			dependencies = append(dependencies, name)
+		} else if !isKnownSymbol(name, known) {
+			warnings = append(warnings, undefinedWarning(name, selectors[name]))
+		}
+	}
+	return dependencies, warnings
+}
+
+// resolveDependencies returns a copy of the formulas where formulas without
+// a dependency list have one found from their code
+func resolveDependencies(formulas map[string]*Formula, p project) map[string]*Formula {
+	known := p.knownSymbols()
+	resolved := make(map[string]*Formula)
+	for name, formula := range formulas {
+		formulaCopy := *formula
+		dependencies, warnings := findDependencies(formula, formulas, known)
+		if formulaCopy.Dependencies == nil {
+			formulaCopy.Dependencies = dependencies
+		}
+		formulaCopy.warnings = warnings
+		resolved[name] = &formulaCopy
+	}
+	return resolved
+}
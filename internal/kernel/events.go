@@ -0,0 +1,71 @@
+package kernel
+
+import (
+	"strconv"
+	"sync"
+)
+
+type EventType int
+
+const (
+	StartedEvent EventType = iota
+	FinishedEvent
+	FailedEvent
+)
+
+func (e EventType) String() string {
+	switch e {
+	case StartedEvent:
+		return "started"
+	case FinishedEvent:
+		return "finished"
+	case FailedEvent:
+		return "failed"
+	}
+	return "unknown event " + strconv.Itoa(int(e))
+}
+
+// Event reports progress on a single formula during an update. Result is
+// nil for StartedEvent. Cached is true when the result was reused from an
+// earlier update instead of being run again.
+type Event struct {
+	Type   EventType
+	Name   string
+	Result *Result
+	Cached bool
+}
+
+// eventSource keeps the listeners of a kernel
+type eventSource struct {
+	listenerMutex sync.Mutex
+	listeners     []func(Event)
+}
+
+// AddListener registers a function that is called for every event. The
+// events of a formula are delivered in the order they happen. Formulas run
+// at the same time, so listeners can be called from several goroutines at
+// once. Listeners are called without holding a lock so they can add
+// listeners or call the kernel.
+func (s *eventSource) AddListener(listener func(Event)) {
+	s.listenerMutex.Lock()
+	defer s.listenerMutex.Unlock()
+	s.listeners = append(s.listeners, listener)
+}
+
+func (s *eventSource) emit(event Event) {
+	s.listenerMutex.Lock()
+	listeners := s.listeners
+	s.listenerMutex.Unlock()
+	for _, listener := range listeners {
+		listener(event)
+	}
+}
+
+// emitResult reports a formula that is done
+func (s *eventSource) emitResult(name string, result Result, cached bool) {
+	eventType := FinishedEvent
+	if result.Status != StatusOK {
+		eventType = FailedEvent
+	}
+	s.emit(Event{eventType, name, &result, cached})
+}
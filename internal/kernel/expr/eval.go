@@ -0,0 +1,454 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Error codes, named after the error values of spreadsheets
+const (
+	DivisionByZero = "#DIV/0!"
+	WrongType      = "#VALUE!"
+	BadNumber      = "#NUM!"
+	UnknownName    = "#NAME?"
+	NotAvailable   = "#N/A"
+)
+
+// Error is a problem found while evaluating an expression
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Code + " " + e.Message
+}
+
+func errorf(code, format string, args ...any) *Error {
+	return &Error{code, fmt.Sprintf(format, args...)}
+}
+
+// Values in an expression are float64, string, bool or []any for arrays.
+// Variables of other numeric types are turned into float64 and slices and
+// arrays are turned into []any.
+// lookup finds the value of a variable. A name such as stats.mean that
+// isn't a variable itself is the mean key of the stats variable when stats
+// is a map with string keys. Errors in stats are errors in its fields too.
+func lookup(name string, variables map[string]any) (any, bool) {
+	if value, exists := variables[name]; exists {
+		return value, true
+	}
+	dot := strings.LastIndexByte(name, '.')
+	if dot < 0 {
+		return nil, false
+	}
+	value, exists := lookup(name[:dot], variables)
+	if _, failed := value.(*Error); failed || !exists {
+		return value, exists
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	element := v.MapIndex(reflect.ValueOf(name[dot+1:]).Convert(v.Type().Key()))
+	if !element.IsValid() {
+		return nil, false
+	}
+	return element.Interface(), true
+}
+
+func convert(name string, value any) (any, error) {
+	switch value := value.(type) {
+	case float64, string, bool:
+		return value, nil
+	case []any:
+		converted := make([]any, len(value))
+		for index, element := range value {
+			var err error
+			if converted[index], err = convert(name, element); err != nil {
+				return nil, err
+			}
+		}
+		return converted, nil
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Slice, reflect.Array:
+		converted := make([]any, v.Len())
+		for index := range converted {
+			var err error
+			if converted[index], err = convert(name, v.Index(index).Interface()); err != nil {
+				return nil, err
+			}
+		}
+		return converted, nil
+	}
+	return nil, errorf(WrongType, "%s is a %T, which expressions can't use", name, value)
+}
+
+// Evaluate computes the expression with the values of the variables it
+// references. The result is a float64, string, bool or []any. The error is
+// an *Error. A variable can be set to an *Error to have references to it
+// fail, which IFERROR can catch.
+func (e *Expression) Evaluate(variables map[string]any) (any, error) {
+	return evaluate(e.root, variables)
+}
+
+func evaluate(n node, variables map[string]any) (any, error) {
+	switch n := n.(type) {
+	case *numberNode:
+		return n.value, nil
+	case *textNode:
+		return n.value, nil
+	case *boolNode:
+		return n.value, nil
+	case *referenceNode:
+		value, exists := lookup(n.name, variables)
+		if !exists {
+			return nil, errorf(UnknownName, "%s is not defined", n.name)
+		}
+		if err, failed := value.(*Error); failed {
+			return nil, err
+		}
+		return convert(n.name, value)
+	case *arrayNode:
+		elements := make([]any, 0, len(n.elements))
+		for _, element := range n.elements {
+			value, err := evaluate(element, variables)
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, value)
+		}
+		return elements, nil
+	case *unaryNode:
+		operand, err := evaluate(n.operand, variables)
+		if err != nil {
+			return nil, err
+		}
+		return elementwise(operand, func(value any) (any, error) {
+			number, err := toNumber(value)
+			switch {
+			case err != nil:
+				return nil, err
+			case n.operator == "-":
+				return -number, nil
+			case n.operator == "%":
+				return number / 100, nil
+			}
+			return number, nil
+		})
+	case *binaryNode:
+		left, err := evaluate(n.left, variables)
+		if err != nil {
+			return nil, err
+		}
+		right, err := evaluate(n.right, variables)
+		if err != nil {
+			return nil, err
+		}
+		return pairwise(left, right, func(left, right any) (any, error) {
+			return operate(n.operator, left, right)
+		})
+	case *callNode:
+		f := functions[n.name]
+		if f.lazy != nil {
+			return f.lazy(n.args, variables)
+		}
+		args := make([]any, 0, len(n.args))
+		for _, arg := range n.args {
+			value, err := evaluate(arg, variables)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, value)
+		}
+		return f.call(args)
+	}
+	panic(fmt.Sprintf("unknown node %T", n))
+}
+
+// elementwise applies an operation to a value or to each element of an
+// array
+func elementwise(value any, operation func(any) (any, error)) (any, error) {
+	array, ok := value.([]any)
+	if !ok {
+		return operation(value)
+	}
+	results := make([]any, len(array))
+	for index, element := range array {
+		var err error
+		if results[index], err = elementwise(element, operation); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// pairwise applies an operation to two values. Arrays are matched up
+// element by element and a single value is used with every element.
+func pairwise(left, right any, operation func(any, any) (any, error)) (any, error) {
+	leftArray, leftIsArray := left.([]any)
+	rightArray, rightIsArray := right.([]any)
+	switch {
+	case leftIsArray && rightIsArray:
+		if len(leftArray) != len(rightArray) {
+			return nil, errorf(WrongType, "arrays of length %d and %d can't be combined", len(leftArray), len(rightArray))
+		}
+		results := make([]any, len(leftArray))
+		for index := range leftArray {
+			var err error
+			if results[index], err = pairwise(leftArray[index], rightArray[index], operation); err != nil {
+				return nil, err
+			}
+		}
+		return results, nil
+	case leftIsArray:
+		return elementwise(left, func(element any) (any, error) { return pairwise(element, right, operation) })
+	case rightIsArray:
+		return elementwise(right, func(element any) (any, error) { return pairwise(left, element, operation) })
+	}
+	return operation(left, right)
+}
+
+// operate applies a binary operator to two single values
+func operate(operator string, left, right any) (any, error) {
+	switch operator {
+	case "&":
+		return toText(left) + toText(right), nil
+	case "=", "<>", "<", ">", "<=", ">=":
+		return compare(operator, left, right)
+	}
+
+	a, err := toNumber(left)
+	if err != nil {
+		return nil, err
+	}
+	b, err := toNumber(right)
+	if err != nil {
+		return nil, err
+	}
+	var result float64
+	switch operator {
+	case "+":
+		result = a + b
+	case "-":
+		result = a - b
+	case "*":
+		result = a * b
+	case "/":
+		if b == 0 {
+			return nil, errorf(DivisionByZero, "division by zero")
+		}
+		result = a / b
+	case "^":
+		result = math.Pow(a, b)
+	}
+	return checkNumber(result)
+}
+
+// checkNumber turns results that aren't real numbers into errors
+func checkNumber(number float64) (any, error) {
+	if math.IsNaN(number) || math.IsInf(number, 0) {
+		return nil, errorf(BadNumber, "the result is not a real number")
+	}
+	return number, nil
+}
+
+// compare compares numbers by value, text without regard to case and TRUE
+// after FALSE. Values of different types are never equal.
+func compare(operator string, left, right any) (any, error) {
+	var order int
+	switch a := left.(type) {
+	case float64:
+		b, ok := right.(float64)
+		if !ok {
+			return compareMismatched(operator, left, right)
+		}
+		order = compareOrdered(a, b)
+	case string:
+		b, ok := right.(string)
+		if !ok {
+			return compareMismatched(operator, left, right)
+		}
+		order = strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	case bool:
+		b, ok := right.(bool)
+		if !ok {
+			return compareMismatched(operator, left, right)
+		}
+		order = compareOrdered(boolNumber(a), boolNumber(b))
+	}
+	switch operator {
+	case "=":
+		return order == 0, nil
+	case "<>":
+		return order != 0, nil
+	case "<":
+		return order < 0, nil
+	case ">":
+		return order > 0, nil
+	case "<=":
+		return order <= 0, nil
+	}
+	return order >= 0, nil
+}
+
+func compareMismatched(operator string, left, right any) (any, error) {
+	switch operator {
+	case "=":
+		return false, nil
+	case "<>":
+		return true, nil
+	}
+	return nil, errorf(WrongType, "%s and %s can't be ordered", typeName(left), typeName(right))
+}
+
+func compareOrdered(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func boolNumber(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func typeName(value any) string {
+	switch value.(type) {
+	case float64:
+		return "a number"
+	case string:
+		return "text"
+	case bool:
+		return "TRUE or FALSE"
+	case []any:
+		return "an array"
+	}
+	return fmt.Sprintf("a %T", value)
+}
+
+// toNumber converts a single value for arithmetic. Text is used if it holds
+// a number.
+func toNumber(value any) (float64, error) {
+	switch value := value.(type) {
+	case float64:
+		return value, nil
+	case bool:
+		return boolNumber(value), nil
+	case string:
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return 0, errorf(WrongType, "%q is not a number", value)
+		}
+		return number, nil
+	}
+	return 0, errorf(WrongType, "expected a number but got %s", typeName(value))
+}
+
+// toText converts a single value for joining text
+func toText(value any) string {
+	switch value := value.(type) {
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		if value {
+			return "TRUE"
+		}
+		return "FALSE"
+	case string:
+		return value
+	}
+	return fmt.Sprint(value)
+}
+
+// toBool converts a condition. Numbers are true unless they are 0.
+func toBool(value any) (bool, error) {
+	switch value := value.(type) {
+	case bool:
+		return value, nil
+	case float64:
+		return value != 0, nil
+	case string:
+		switch strings.ToUpper(value) {
+		case "TRUE":
+			return true, nil
+		case "FALSE":
+			return false, nil
+		}
+	}
+	return false, errorf(WrongType, "expected TRUE or FALSE but got %s", typeName(value))
+}
+
+// Kind is what an expression is known to produce before it is evaluated
+type Kind int
+
+const (
+	KindUnknown Kind = iota
+	KindNumber
+	KindText
+	KindBool
+)
+
+// Kind works out what the expression produces. variable gives the kind of
+// each variable, which may be KindUnknown.
+func (e *Expression) Kind(variable func(name string) Kind) Kind {
+	return kindOf(e.root, variable)
+}
+
+func kindOf(n node, variable func(name string) Kind) Kind {
+	switch n := n.(type) {
+	case *numberNode:
+		return KindNumber
+	case *textNode:
+		return KindText
+	case *boolNode:
+		return KindBool
+	case *referenceNode:
+		return variable(n.name)
+	case *unaryNode:
+		// Arrays stay arrays
+		if kindOf(n.operand, variable) == KindUnknown {
+			return KindUnknown
+		}
+		return KindNumber
+	case *binaryNode:
+		if kindOf(n.left, variable) == KindUnknown || kindOf(n.right, variable) == KindUnknown {
+			return KindUnknown
+		}
+		switch n.operator {
+		case "&":
+			return KindText
+		case "=", "<>", "<", ">", "<=", ">=":
+			return KindBool
+		}
+		return KindNumber
+	case *callNode:
+		f := functions[n.name]
+		if f.kind != nil {
+			return f.kind(n.args, variable)
+		}
+	}
+	return KindUnknown
+}
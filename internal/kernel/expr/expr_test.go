@@ -0,0 +1,200 @@
+package expr
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	variables := map[string]any{
+		"sales":  []int{10, 20, 30},
+		"prices": []float64{1.5, 2, 2.5},
+		"rate":   0.5,
+		"failed": &Error{NotAvailable, "failed: boom"},
+		"name":   "calx",
+		"count":  uint8(3),
+		"mixed":  []any{1, "text", true, 2.0},
+		"stats":  map[string]any{"mean": 2, "range": []int{1, 3}},
+	}
+	tests := map[string]any{
+		"=1 + 2 * 3":                        7.0,
+		"(1 + 2) * 3":                       9.0,
+		"2 ^ 3 ^ 2":                         64.0,
+		"-2 ^ 2":                            4.0,
+		"50%":                               0.5,
+		"=SUM(sales) * 1.2":                 72.0,
+		"sum(sales, 4)":                     64.0,
+		"AVERAGE(sales)":                    20.0,
+		"MIN(sales, 5)":                     5.0,
+		"MAX({1, 7, 3})":                    7.0,
+		"COUNT(mixed)":                      2.0,
+		"SUM(mixed)":                        3.0,
+		"SUM(sales * prices)":               130.0,
+		"sales * rate":                      []any{5.0, 10.0, 15.0},
+		"sales > 15":                        []any{false, true, true},
+		"ROUND(2.345, 2)":                   2.35,
+		"ROUND(-2.5)":                       -3.0,
+		"ROUNDUP(1.21, 1)":                  1.3,
+		"ROUNDDOWN(-1.29, 1)":               -1.2,
+		"ROUND(1234, -2)":                   1200.0,
+		"MOD(-3, 2)":                        1.0,
+		"INT(-1.5)":                         -2.0,
+		`IF(count > 2, "many", "few")`:      "many",
+		"IF(FALSE, 1)":                      false,
+		"IF(rate = 0, 0, 1 / rate)":         2.0,
+		"AND(TRUE, count = 3, rate < 1)":    true,
+		"OR(sales > 25)":                    true,
+		"NOT(1)":                            false,
+		`name & "-" & count`:                "calx-3",
+		`CONCAT("a", {1, 2}, TRUE)`:         "a12TRUE",
+		`"Say ""hi"""`:                      `Say "hi"`,
+		`UPPER(name) = "CALX"`:              true,
+		`LEN("héllo")`:                      5.0,
+		`"10" + 1`:                          11.0,
+		`"abc" < "ABD"`:                     true,
+		"1 <> TRUE":                         true,
+		"1.5e2":                             150.0,
+		"=\n  SQRT(16)\n  + ABS(-1)":        5.0,
+		"POWER(2, {1, 2, 3})":               []any{2.0, 4.0, 8.0},
+		"LOWER({\"A\", \"B\"})":             []any{"a", "b"},
+		"IFERROR(1 / (rate - 0.5), -1)":     -1.0,
+		"IFERROR(failed, 0) + 1":            1.0,
+		"IFERROR(rate, missing)":            0.5,
+		"stats.mean * 2 + SUM(stats.range)": 8.0,
+	}
+	for source, expected := range tests {
+		expression, err := Parse(source)
+		if err != nil {
+			t.Fatalf("Parse(%q) returned error: %v", source, err)
+		}
+		value, err := expression.Evaluate(variables)
+		if err != nil {
+			t.Fatalf("Evaluate(%q) returned error: %v", source, err)
+		}
+		if !reflect.DeepEqual(value, expected) {
+			t.Fatalf("Evaluate(%q) = %#v, expected %#v", source, value, expected)
+		}
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	variables := map[string]any{"zero": 0, "point": struct{ X int }{1}, "short": []int{1}, "failed": &Error{NotAvailable, "boom"}}
+	tests := map[string]string{
+		"1 / zero":                  DivisionByZero,
+		"AVERAGE({})":               DivisionByZero,
+		"SQRT(-1)":                  BadNumber,
+		`1 + "one"`:                 WrongType,
+		"point + 1":                 WrongType,
+		"short + {1, 2}":            WrongType,
+		`IF("maybe", 1, 2)`:         WrongType,
+		`1 < "a"`:                   WrongType,
+		"missing * 2":               UnknownName,
+		"IF(TRUE, 1, missing)":      "",
+		"IF(zero = 0, 0, 1 / zero)": "",
+		"SUM(failed, 1)":            NotAvailable,
+		"IFERROR(failed, 1 / zero)": DivisionByZero,
+		"failed.mean":               NotAvailable,
+		"point.X":                   UnknownName,
+		"zero.x":                    UnknownName,
+	}
+	for source, code := range tests {
+		_, err := MustParse(source).Evaluate(variables)
+		var evaluationError *Error
+		switch {
+		case code == "" && err != nil:
+			t.Fatalf("Evaluate(%q) returned error: %v", source, err)
+		case code != "" && (!errors.As(err, &evaluationError) || evaluationError.Code != code):
+			t.Fatalf("Evaluate(%q) should fail with %s but returned %v", source, code, err)
+		}
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	tests := map[string]SyntaxError{
+		"":                 {1, 1, "expression is empty"},
+		"1 +":              {1, 4, "unexpected end of expression"},
+		"SUM(1, 2":         {1, 9, `expected "," or ")" but found end of expression`},
+		"1 2":              {1, 3, `unexpected "2"`},
+		"= FOO(1)":         {1, 3, "unknown function FOO"},
+		"ROUND()":          {1, 1, "ROUND needs at least 1 argument"},
+		"IF(1, 2, 3, 4)":   {1, 1, "IF takes at most 3 arguments"},
+		`"open`:            {1, 1, "text is missing its closing quote"},
+		"1 +\n  2 $":       {2, 5, "unexpected character '$'"},
+		"1..2":             {1, 1, `invalid number "1..2"`},
+		"SUM(1,, 2)":       {1, 7, `unexpected ","`},
+		"(1 + 2":           {1, 7, `expected ")" but found end of expression`},
+		"{1, 2} }":         {1, 8, `unexpected "}"`},
+		"é + ":             {1, 5, "unexpected end of expression"},
+		"a <> b >= c <= ]": {1, 16, "unexpected character ']'"},
+		"1+٣":              {1, 3, "unexpected character '٣'"},
+	}
+	for source, expected := range tests {
+		_, err := Parse(source)
+		var syntaxError *SyntaxError
+		if !errors.As(err, &syntaxError) || *syntaxError != expected {
+			t.Fatalf("Parse(%q) should fail with %v but returned %v", source, &expected, err)
+		}
+	}
+}
+
+func TestReferences(t *testing.T) {
+	expression := MustParse(`=IF(a > b, SUM(c, a), "d") & e`)
+	if references := expression.References(); !reflect.DeepEqual(references, []string{"a", "b", "c", "e"}) {
+		t.Fatal("Unexpected references:", references)
+	}
+
+	renamed, err := Rename(`a + SUM(a, ab) & "a" & A(1)`, map[string]string{"a": "total"})
+	if err == nil {
+		t.Fatal("Renaming an expression with an unknown function should fail but returned", renamed)
+	}
+	renamed, err = Rename(`a + SUM(a, ab) & "a"`, map[string]string{"a": "total"})
+	if err != nil {
+		t.Fatal("Rename returned error:", err)
+	}
+	if renamed != `total + SUM(total, ab) & "a"` {
+		t.Fatal("Unexpected rename:", renamed)
+	}
+
+	expression = MustParse("stats.mean / stats.count + a.b")
+	if references := expression.References(); !reflect.DeepEqual(references, []string{"stats.mean", "stats.count", "a.b"}) {
+		t.Fatal("Unexpected references:", references)
+	}
+	renamed, err = Rename("stats.mean / stats.count + a.b", map[string]string{"stats": "summary", "a.b": "c"})
+	if err != nil {
+		t.Fatal("Rename returned error:", err)
+	}
+	if renamed != "summary.mean / summary.count + c" {
+		t.Fatal("Unexpected rename:", renamed)
+	}
+}
+
+func TestKind(t *testing.T) {
+	variables := func(name string) Kind {
+		if name == "number" {
+			return KindNumber
+		}
+		return KindUnknown
+	}
+	tests := map[string]Kind{
+		"1 + number":           KindNumber,
+		"1 + range":            KindUnknown,
+		"SUM(range) * 2":       KindNumber,
+		`"a" & number`:         KindText,
+		"number > 1":           KindBool,
+		"IF(range, 1, number)": KindNumber,
+		`IF(number, 1, "a")`:   KindUnknown,
+		"ROUND(range, 2)":      KindUnknown,
+		"ROUND(number / 3, 2)": KindNumber,
+		"AND(range)":           KindBool,
+		"UPPER(CONCAT(range))": KindText,
+		"{1, 2}":               KindUnknown,
+		"IFERROR(number, 0)":   KindNumber,
+		`IFERROR(number, "")`:  KindUnknown,
+	}
+	for source, expected := range tests {
+		if kind := MustParse(source).Kind(variables); kind != expected {
+			t.Fatalf("Kind of %q is %v, expected %v", source, kind, expected)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package expr
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// function is a function that expressions can call. Most functions get
+// their arguments evaluated, lazy ones evaluate only the arguments they
+// need.
+type function struct {
+	minArgs int
+	maxArgs int // -1 for any number of arguments
+	call    func(args []any) (any, error)
+	lazy    func(args []node, variables map[string]any) (any, error)
+	kind    func(args []node, variable func(string) Kind) Kind
+}
+
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		"SUM": {1, -1, aggregate(func(values []float64) (any, error) {
+			total := 0.0
+			for _, value := range values {
+				total += value
+			}
+			return checkNumber(total)
+		}), nil, returns(KindNumber)},
+		"AVERAGE": {1, -1, aggregate(func(values []float64) (any, error) {
+			if len(values) == 0 {
+				return nil, errorf(DivisionByZero, "AVERAGE of no numbers")
+			}
+			total := 0.0
+			for _, value := range values {
+				total += value
+			}
+			return checkNumber(total / float64(len(values)))
+		}), nil, returns(KindNumber)},
+		"MIN": {1, -1, aggregate(func(values []float64) (any, error) {
+			if len(values) == 0 {
+				return 0.0, nil
+			}
+			sort.Float64s(values)
+			return values[0], nil
+		}), nil, returns(KindNumber)},
+		"MAX": {1, -1, aggregate(func(values []float64) (any, error) {
+			if len(values) == 0 {
+				return 0.0, nil
+			}
+			sort.Float64s(values)
+			return values[len(values)-1], nil
+		}), nil, returns(KindNumber)},
+		"COUNT": {1, -1, func(args []any) (any, error) {
+			count := 0
+			for _, arg := range args {
+				if array, ok := arg.([]any); ok {
+					var values []float64
+					collectRange(array, &values)
+					count += len(values)
+				} else if _, err := toNumber(arg); err == nil {
+					count++
+				}
+			}
+			return float64(count), nil
+		}, nil, returns(KindNumber)},
+
+		"ROUND":     {1, 2, rounding(math.Round), nil, likeFirst(KindNumber)},
+		"ROUNDUP":   {1, 2, rounding(awayFromZero), nil, likeFirst(KindNumber)},
+		"ROUNDDOWN": {1, 2, rounding(math.Trunc), nil, likeFirst(KindNumber)},
+		"INT":       {1, 1, numeric(math.Floor), nil, likeFirst(KindNumber)},
+		"ABS":       {1, 1, numeric(math.Abs), nil, likeFirst(KindNumber)},
+		"SQRT": {1, 1, numeric(func(value float64) float64 {
+			return math.Sqrt(value)
+		}), nil, likeFirst(KindNumber)},
+		"POWER": {2, 2, func(args []any) (any, error) {
+			return pairwise(args[0], args[1], func(a, b any) (any, error) { return operate("^", a, b) })
+		}, nil, likeFirst(KindNumber)},
+		"MOD": {2, 2, func(args []any) (any, error) {
+			return pairwise(args[0], args[1], func(a, b any) (any, error) {
+				number, err := toNumber(a)
+				if err != nil {
+					return nil, err
+				}
+				divisor, err := toNumber(b)
+				if err != nil {
+					return nil, err
+				}
+				if divisor == 0 {
+					return nil, errorf(DivisionByZero, "MOD by zero")
+				}
+				return checkNumber(number - divisor*math.Floor(number/divisor))
+			})
+		}, nil, likeFirst(KindNumber)},
+
+		"IF": {2, 3, nil, func(args []node, variables map[string]any) (any, error) {
+			value, err := evaluate(args[0], variables)
+			if err != nil {
+				return nil, err
+			}
+			condition, err := toBool(value)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case condition:
+				return evaluate(args[1], variables)
+			case len(args) == 3:
+				return evaluate(args[2], variables)
+			}
+			return false, nil
+		}, func(args []node, variable func(string) Kind) Kind {
+			otherwise := KindBool
+			if len(args) == 3 {
+				otherwise = kindOf(args[2], variable)
+			}
+			if then := kindOf(args[1], variable); then == otherwise {
+				return then
+			}
+			return KindUnknown
+		}},
+		"IFERROR": {2, 2, nil, func(args []node, variables map[string]any) (any, error) {
+			value, err := evaluate(args[0], variables)
+			if err != nil {
+				return evaluate(args[1], variables)
+			}
+			return value, nil
+		}, func(args []node, variable func(string) Kind) Kind {
+			if value := kindOf(args[0], variable); value == kindOf(args[1], variable) {
+				return value
+			}
+			return KindUnknown
+		}},
+		"AND": {1, -1, logical(func(values []bool) bool {
+			for _, value := range values {
+				if !value {
+					return false
+				}
+			}
+			return true
+		}), nil, returns(KindBool)},
+		"OR": {1, -1, logical(func(values []bool) bool {
+			for _, value := range values {
+				if value {
+					return true
+				}
+			}
+			return false
+		}), nil, returns(KindBool)},
+		"NOT": {1, 1, func(args []any) (any, error) {
+			return elementwise(args[0], func(value any) (any, error) {
+				condition, err := toBool(value)
+				return !condition, err
+			})
+		}, nil, likeFirst(KindBool)},
+
+		"CONCAT": {1, -1, func(args []any) (any, error) {
+			var text strings.Builder
+			var join func(values []any)
+			join = func(values []any) {
+				for _, value := range values {
+					if array, ok := value.([]any); ok {
+						join(array)
+					} else {
+						text.WriteString(toText(value))
+					}
+				}
+			}
+			join(args)
+			return text.String(), nil
+		}, nil, returns(KindText)},
+		"LEN": {1, 1, textual(func(text string) any {
+			return float64(utf8.RuneCountInString(text))
+		}), nil, likeFirst(KindNumber)},
+		"UPPER": {1, 1, textual(func(text string) any {
+			return strings.ToUpper(text)
+		}), nil, likeFirst(KindText)},
+		"LOWER": {1, 1, textual(func(text string) any {
+			return strings.ToLower(text)
+		}), nil, likeFirst(KindText)},
+	}
+}
+
+// returns is the kind of a function that always returns the same kind
+func returns(kind Kind) func([]node, func(string) Kind) Kind {
+	return func([]node, func(string) Kind) Kind { return kind }
+}
+
+// likeFirst is the kind of a function applied to each element of its first
+// argument, which returns an array for an array
+func likeFirst(kind Kind) func([]node, func(string) Kind) Kind {
+	return func(args []node, variable func(string) Kind) Kind {
+		if kindOf(args[0], variable) == KindUnknown {
+			return KindUnknown
+		}
+		return kind
+	}
+}
+
+// collectRange adds the numbers in an array to values, skipping everything
+// else as a spreadsheet does for ranges
+func collectRange(array []any, values *[]float64) {
+	for _, element := range array {
+		switch element := element.(type) {
+		case float64:
+			*values = append(*values, element)
+		case []any:
+			collectRange(element, values)
+		}
+	}
+}
+
+// aggregate makes a function of all the numbers in its arguments. Arrays
+// count as ranges, other arguments have to be numbers.
+func aggregate(f func(values []float64) (any, error)) func(args []any) (any, error) {
+	return func(args []any) (any, error) {
+		var values []float64
+		for _, arg := range args {
+			if array, ok := arg.([]any); ok {
+				collectRange(array, &values)
+				continue
+			}
+			value, err := toNumber(arg)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return f(values)
+	}
+}
+
+// numeric makes a function of one number, applied to each element of an
+// array
+func numeric(f func(float64) float64) func(args []any) (any, error) {
+	return func(args []any) (any, error) {
+		return elementwise(args[0], func(value any) (any, error) {
+			number, err := toNumber(value)
+			if err != nil {
+				return nil, err
+			}
+			return checkNumber(f(number))
+		})
+	}
+}
+
+// rounding makes a function that rounds to a number of digits, 0 by default
+func rounding(round func(float64) float64) func(args []any) (any, error) {
+	return func(args []any) (any, error) {
+		var digits any = 0.0
+		if len(args) == 2 {
+			digits = args[1]
+		}
+		return pairwise(args[0], digits, func(value, digits any) (any, error) {
+			number, err := toNumber(value)
+			if err != nil {
+				return nil, err
+			}
+			places, err := toNumber(digits)
+			if err != nil {
+				return nil, err
+			}
+			scale := math.Pow(10, math.Trunc(places))
+			return checkNumber(round(number*scale) / scale)
+		})
+	}
+}
+
+func awayFromZero(value float64) float64 {
+	if value < 0 {
+		return math.Floor(value)
+	}
+	return math.Ceil(value)
+}
+
+// logical makes a function of all the conditions in its arguments
+func logical(f func(values []bool) bool) func(args []any) (any, error) {
+	return func(args []any) (any, error) {
+		var values []bool
+		var collect func(args []any) error
+		collect = func(args []any) error {
+			for _, arg := range args {
+				if array, ok := arg.([]any); ok {
+					if err := collect(array); err != nil {
+						return err
+					}
+					continue
+				}
+				value, err := toBool(arg)
+				if err != nil {
+					return err
+				}
+				values = append(values, value)
+			}
+			return nil
+		}
+		if err := collect(args); err != nil {
+			return nil, err
+		}
+		return f(values), nil
+	}
+}
+
+// textual makes a function of one text, applied to each element of an
+// array
+func textual(f func(string) any) func(args []any) (any, error) {
+	return func(args []any) (any, error) {
+		return elementwise(args[0], func(value any) (any, error) {
+			return f(toText(value)), nil
+		})
+	}
+}
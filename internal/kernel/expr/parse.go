@@ -0,0 +1,524 @@
+// Package expr parses and evaluates spreadsheet style expressions such as
+// =SUM(sales) * 1.2, so that formulas can be written without knowing Go.
+//
+// Expressions are made of numbers, "text", TRUE and FALSE, {1, 2, 3}
+// arrays, variable names, fields such as stats.mean, function calls and the
+// operators + - * / ^ % &
+// = <> < > <= >=. Function names are not case sensitive, variable names
+// are. Arithmetic and comparisons on arrays work element by element.
+package expr
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// SyntaxError is an expression that doesn't parse or calls a function the
+// wrong way. Line and Column count from 1.
+type SyntaxError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return strconv.Itoa(e.Line) + ":" + strconv.Itoa(e.Column) + ": " + e.Message
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenNumber
+	tokenText
+	tokenName
+	tokenOperator
+	tokenPunctuation
+)
+
+type token struct {
+	kind   tokenKind
+	text   string
+	offset int
+}
+
+// node is a part of a parsed expression. offset is where it starts in the
+// source.
+type node interface {
+	start() int
+}
+
+type (
+	numberNode struct {
+		offset int
+		value  float64
+	}
+	textNode struct {
+		offset int
+		value  string
+	}
+	boolNode struct {
+		offset int
+		value  bool
+	}
+	referenceNode struct {
+		offset int
+		name   string
+	}
+	callNode struct {
+		offset int
+		name   string
+		args   []node
+	}
+	arrayNode struct {
+		offset   int
+		elements []node
+	}
+	unaryNode struct {
+		offset   int
+		operator string
+		operand  node
+	}
+	binaryNode struct {
+		offset   int
+		operator string
+		left     node
+		right    node
+	}
+)
+
+func (n *numberNode) start() int    { return n.offset }
+func (n *textNode) start() int      { return n.offset }
+func (n *boolNode) start() int      { return n.offset }
+func (n *referenceNode) start() int { return n.offset }
+func (n *callNode) start() int      { return n.offset }
+func (n *arrayNode) start() int     { return n.offset }
+func (n *unaryNode) start() int     { return n.offset }
+func (n *binaryNode) start() int    { return n.offset }
+
+// Expression is a parsed expression
+type Expression struct {
+	source string
+	root   node
+}
+
+// Parse parses an expression. A leading = is allowed, as in a spreadsheet
+// cell. The error is a *SyntaxError.
+func Parse(source string) (*Expression, error) {
+	p := &parser{source: source}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	if p.peek().text == "=" {
+		p.next()
+	}
+	if p.peek().kind == tokenEnd {
+		return nil, p.errorAt(p.peek().offset, "expression is empty")
+	}
+	root, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	if end := p.peek(); end.kind != tokenEnd {
+		return nil, p.errorAt(end.offset, "unexpected "+describe(end))
+	}
+	return &Expression{source, root}, nil
+}
+
+// MustParse is Parse for expressions that are known to be valid
+func MustParse(source string) *Expression {
+	expression, err := Parse(source)
+	if err != nil {
+		panic(err)
+	}
+	return expression
+}
+
+type parser struct {
+	source   string
+	tokens   []token
+	position int
+}
+
+func (p *parser) errorAt(offset int, message string) *SyntaxError {
+	before := p.source[:offset]
+	line := strings.Count(before, "\n") + 1
+	column := utf8.RuneCountInString(before[strings.LastIndex(before, "\n")+1:]) + 1
+	return &SyntaxError{line, column, message}
+}
+
+func describe(t token) string {
+	if t.kind == tokenEnd {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// tokenize splits the source into tokens
+func (p *parser) tokenize() error {
+	source := p.source
+	offset := 0
+	for offset < len(source) {
+		r, size := utf8.DecodeRuneInString(source[offset:])
+		start := offset
+		switch {
+		case unicode.IsSpace(r):
+			offset += size
+			continue
+		case (r < utf8.RuneSelf && isDigit(byte(r))) || r == '.':
+			// Numbers may have a fraction and an exponent
+			for offset < len(source) && (isDigit(source[offset]) || source[offset] == '.') {
+				offset++
+			}
+			if offset < len(source) && (source[offset] == 'e' || source[offset] == 'E') {
+				exponent := offset + 1
+				if exponent < len(source) && (source[exponent] == '+' || source[exponent] == '-') {
+					exponent++
+				}
+				if exponent < len(source) && isDigit(source[exponent]) {
+					offset = exponent
+					for offset < len(source) && isDigit(source[offset]) {
+						offset++
+					}
+				}
+			}
+			p.tokens = append(p.tokens, token{tokenNumber, source[start:offset], start})
+		case r == '_' || unicode.IsLetter(r):
+			// Names may pick out a field of a variable, as in stats.mean
+			for offset < len(source) {
+				r, size := utf8.DecodeRuneInString(source[offset:])
+				if r == '.' && offset+size < len(source) {
+					next, _ := utf8.DecodeRuneInString(source[offset+size:])
+					if next == '_' || unicode.IsLetter(next) {
+						offset += size
+						continue
+					}
+				}
+				if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				offset += size
+			}
+			p.tokens = append(p.tokens, token{tokenName, source[start:offset], start})
+		case r == '"':
+			// Quotes inside text are doubled
+			var text strings.Builder
+			offset++
+			for {
+				end := strings.IndexByte(source[offset:], '"')
+				if end < 0 {
+					return p.errorAt(start, "text is missing its closing quote")
+				}
+				text.WriteString(source[offset : offset+end])
+				offset += end + 1
+				if offset < len(source) && source[offset] == '"' {
+					text.WriteByte('"')
+					offset++
+					continue
+				}
+				break
+			}
+			p.tokens = append(p.tokens, token{tokenText, text.String(), start})
+		case strings.ContainsRune("+-*/^%&=", r):
+			offset++
+			p.tokens = append(p.tokens, token{tokenOperator, source[start:offset], start})
+		case r == '<' || r == '>':
+			offset++
+			if offset < len(source) && (source[offset] == '=' || (r == '<' && source[offset] == '>')) {
+				offset++
+			}
+			p.tokens = append(p.tokens, token{tokenOperator, source[start:offset], start})
+		case strings.ContainsRune("(),{}", r):
+			offset++
+			p.tokens = append(p.tokens, token{tokenPunctuation, source[start:offset], start})
+		default:
+			return p.errorAt(start, "unexpected character "+strconv.QuoteRune(r))
+		}
+	}
+	p.tokens = append(p.tokens, token{tokenEnd, "", len(source)})
+	return nil
+}
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.position]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.position]
+	if t.kind != tokenEnd {
+		p.position++
+	}
+	return t
+}
+
+// expect consumes a punctuation token
+func (p *parser) expect(text string) error {
+	if t := p.peek(); t.text != text || t.kind != tokenPunctuation {
+		return p.errorAt(t.offset, "expected "+strconv.Quote(text)+" but found "+describe(t))
+	}
+	p.next()
+	return nil
+}
+
+// parseBinary parses operators of one precedence level, left to right
+func (p *parser) parseBinary(operators []string, operand func() (node, error)) (node, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		if t.kind != tokenOperator || !contains(operators, t.text) {
+			return left, nil
+		}
+		p.next()
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{t.offset, t.text, left, right}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) parseComparison() (node, error) {
+	return p.parseBinary([]string{"=", "<>", "<", ">", "<=", ">="}, p.parseConcat)
+}
+
+func (p *parser) parseConcat() (node, error) {
+	return p.parseBinary([]string{"&"}, p.parseAdditive)
+}
+
+func (p *parser) parseAdditive() (node, error) {
+	return p.parseBinary([]string{"+", "-"}, p.parseMultiplicative)
+}
+
+func (p *parser) parseMultiplicative() (node, error) {
+	return p.parseBinary([]string{"*", "/"}, p.parsePower)
+}
+
+func (p *parser) parsePower() (node, error) {
+	return p.parseBinary([]string{"^"}, p.parseUnary)
+}
+
+// parseUnary parses signs, which bind tighter than ^ as in a spreadsheet
+func (p *parser) parseUnary() (node, error) {
+	if t := p.peek(); t.kind == tokenOperator && (t.text == "-" || t.text == "+") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{t.offset, t.text, operand}, nil
+	}
+	return p.parsePercent()
+}
+
+func (p *parser) parsePercent() (node, error) {
+	operand, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == tokenOperator && t.text == "%"; t = p.peek() {
+		p.next()
+		operand = &unaryNode{t.offset, "%", operand}
+	}
+	return operand, nil
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		value, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorAt(t.offset, "invalid number "+strconv.Quote(t.text))
+		}
+		return &numberNode{t.offset, value}, nil
+	case tokenText:
+		return &textNode{t.offset, t.text}, nil
+	case tokenName:
+		if p.peek().text == "(" && p.peek().kind == tokenPunctuation {
+			return p.parseCall(t)
+		}
+		switch strings.ToUpper(t.text) {
+		case "TRUE":
+			return &boolNode{t.offset, true}, nil
+		case "FALSE":
+			return &boolNode{t.offset, false}, nil
+		}
+		return &referenceNode{t.offset, t.text}, nil
+	case tokenPunctuation:
+		switch t.text {
+		case "(":
+			inner, err := p.parseComparison()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		case "{":
+			elements, err := p.parseList("}")
+			if err != nil {
+				return nil, err
+			}
+			return &arrayNode{t.offset, elements}, nil
+		}
+	}
+	return nil, p.errorAt(t.offset, "unexpected "+describe(t))
+}
+
+// parseList parses comma separated expressions up to the closing token
+func (p *parser) parseList(closing string) ([]node, error) {
+	var elements []node
+	if t := p.peek(); t.text == closing && t.kind == tokenPunctuation {
+		p.next()
+		return elements, nil
+	}
+	for {
+		element, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+		t := p.next()
+		if t.kind == tokenPunctuation && t.text == closing {
+			return elements, nil
+		}
+		if t.kind != tokenPunctuation || t.text != "," {
+			return nil, p.errorAt(t.offset, "expected \",\" or "+strconv.Quote(closing)+" but found "+describe(t))
+		}
+	}
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	p.next()
+	args, err := p.parseList(")")
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the function and its arguments up front so that mistakes show
+	// up as soon as the formula is written
+	upper := strings.ToUpper(name.text)
+	f, exists := functions[upper]
+	if !exists {
+		return nil, p.errorAt(name.offset, "unknown function "+name.text)
+	}
+	switch {
+	case len(args) < f.minArgs:
+		return nil, p.errorAt(name.offset, upper+" needs at least "+plural(f.minArgs, "argument"))
+	case f.maxArgs >= 0 && len(args) > f.maxArgs:
+		return nil, p.errorAt(name.offset, upper+" takes at most "+plural(f.maxArgs, "argument"))
+	}
+	return &callNode{name.offset, upper, args}, nil
+}
+
+func plural(count int, noun string) string {
+	if count == 1 {
+		return "1 " + noun
+	}
+	return strconv.Itoa(count) + " " + noun + "s"
+}
+
+// walk calls visit for every node of the expression, parents first
+func walk(n node, visit func(node)) {
+	visit(n)
+	switch n := n.(type) {
+	case *callNode:
+		for _, arg := range n.args {
+			walk(arg, visit)
+		}
+	case *arrayNode:
+		for _, element := range n.elements {
+			walk(element, visit)
+		}
+	case *unaryNode:
+		walk(n.operand, visit)
+	case *binaryNode:
+		walk(n.left, visit)
+		walk(n.right, visit)
+	}
+}
+
+// References returns the variable names the expression uses, in the order
+// they first appear
+func (e *Expression) References() []string {
+	var names []string
+	seen := make(map[string]bool)
+	walk(e.root, func(n node) {
+		if reference, ok := n.(*referenceNode); ok && !seen[reference.name] {
+			seen[reference.name] = true
+			names = append(names, reference.name)
+		}
+	})
+	return names
+}
+
+// mentions reports whether an expression that may not parse has a name
+// that is one of the variables or picks out one of their fields. Text that
+// can't be split into tokens is only searched for the names.
+func mentions(source string, names map[string]string) bool {
+	p := &parser{source: source}
+	if err := p.tokenize(); err != nil {
+		for name := range names {
+			if strings.Contains(source, name) {
+				return true
+			}
+		}
+	}
+	for _, t := range p.tokens {
+		name, _, _ := strings.Cut(t.text, ".")
+		if _, exists := names[name]; t.kind == tokenName && exists {
+			return true
+		}
+	}
+	return false
+}
+
+// Rename replaces the references to variables in an expression, leaving
+// text and function names alone. Replacing a variable also replaces it
+// where one of its fields is picked out. An expression that doesn't parse
+// is left alone when it doesn't mention the variables.
+func Rename(source string, replacements map[string]string) (string, error) {
+	expression, err := Parse(source)
+	if err != nil && !mentions(source, replacements) {
+		return source, nil
+	}
+	if err != nil {
+		return source, err
+	}
+	var references []*referenceNode
+	walk(expression.root, func(n node) {
+		if reference, ok := n.(*referenceNode); ok {
+			references = append(references, reference)
+		}
+	})
+
+	// Replace from the end so the offsets stay valid
+	renamed := source
+	for index := len(references) - 1; index >= 0; index-- {
+		reference := references[index]
+		name := reference.name
+		if _, exists := replacements[name]; !exists {
+			name, _, _ = strings.Cut(name, ".")
+		}
+		if replacement, exists := replacements[name]; exists {
+			renamed = renamed[:reference.offset] + replacement + renamed[reference.offset+len(name):]
+		}
+	}
+	return renamed, nil
+}
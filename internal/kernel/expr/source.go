@@ -0,0 +1,10 @@
+package expr
+
+import "embed"
+
+// Source holds the code of this package other than this file, so that the
+// package can be built into programs that evaluate expressions on their
+// own
+//
+//go:embed parse.go eval.go functions.go
+var Source embed.FS
@@ -0,0 +1,101 @@
+package kernel
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/lrdickson/calx/internal/kernel/expr"
+)
+
+// Language is what the code of a formula is written in
+type Language int
+
+const (
+	// LanguageGo formulas are the body of a Go function
+	LanguageGo Language = iota
+
+	// LanguageExpression formulas are spreadsheet style expressions such as
+	// =SUM(sales) * 1.2. Imports and Type are ignored for them.
+	LanguageExpression
+)
+
+func (l Language) String() string {
+	switch l {
+	case LanguageGo:
+		return "Go"
+	case LanguageExpression:
+		return "Expression"
+	}
+	return "unknown language " + strconv.Itoa(int(l))
+}
+
+// expressionDependencies returns the variables that an expression refers to
+// along with warnings for names that aren't variables
+func expressionDependencies(formula *Formula, formulas map[string]*Formula) ([]string, []string) {
+	expression, err := expr.Parse(formula.Code)
+	if err != nil {
+		return nil, nil
+	}
+	dependencies := make([]string, 0)
+	warnings := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, reference := range expression.References() {
+		// A field such as stats.mean depends on stats
+		name := reference
+		if _, exists := formulas[name]; !exists {
+			name, _, _ = strings.Cut(reference, ".")
+		}
+		switch _, exists := formulas[name]; {
+		case !exists:
+			warnings = append(warnings, undefinedWarning(reference, false))
+		case !seen[name]:
+			seen[name] = true
+			dependencies = append(dependencies, name)
+		}
+	}
+	return dependencies, warnings
+}
+
+// expressionCompileError turns an expression syntax error into a result
+func expressionCompileError(err error) Result {
+	var syntaxError *expr.SyntaxError
+	if !errors.As(err, &syntaxError) {
+		return Result{Status: StatusCompileError, Error: err.Error()}
+	}
+	return Result{
+		Status:        StatusCompileError,
+		Error:         err.Error(),
+		CompileErrors: []CompileError{{syntaxError.Line, syntaxError.Column, syntaxError.Message}},
+	}
+}
+
+// evaluateExpression runs an expression formula with the values of its
+// dependencies. Dependencies that failed are #N/A errors in the expression.
+func evaluateExpression(formula Formula, params []any, upstreamErrors map[string]error) Result {
+	expression, err := expr.Parse(formula.Code)
+	if err != nil {
+		return expressionCompileError(err)
+	}
+	variables := make(map[string]any, len(params))
+	for index, dependency := range formula.Dependencies {
+		variables[dependency] = params[index]
+		if err, failed := upstreamErrors[dependency]; failed {
+			variables[dependency] = &expr.Error{Code: expr.NotAvailable, Message: err.Error()}
+		}
+	}
+	value, err := expression.Evaluate(variables)
+	if err != nil {
+		return Result{Status: StatusError, Error: err.Error()}
+	}
+	return renderedResult(value, formula.Display)
+}
+
+// RenameReferences returns the code of the formula with references to the
+// variable oldName changed to newName, in whichever language it is written
+func (f Formula) RenameReferences(oldName, newName string) (string, error) {
+	if f.Language == LanguageExpression {
+		return expr.Rename(f.Code, map[string]string{oldName: newName})
+	}
+	return RenameReferences(f.Code, oldName, newName)
+}
@@ -0,0 +1,23 @@
+package kernel
+
+import (
+	"errors"
+	"strings"
+)
+
+// upstreamErrorsName is the variable that formulas handling upstream errors
+// find the errors of their failed dependencies in
+const upstreamErrorsName = "upstreamErrors"
+
+// upstreamError is the error a formula handling upstream errors gets for a
+// dependency that failed
+func upstreamError(dependency string, result Result) error {
+	message := result.Error
+	if message == "" {
+		message = result.Status.String()
+	}
+	if !strings.HasPrefix(message, "upstream failed: ") {
+		message = dependency + " failed: " + message
+	}
+	return errors.New(message)
+}
@@ -0,0 +1,205 @@
+package kernel
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CycleError is returned when formulas depend on each other in a loop
+type CycleError struct {
+	Chain []string
+}
+
+func (e *CycleError) Error() string {
+	return "dependency cycle: " + strings.Join(e.Chain, " -> ")
+}
+
+// MissingDependencyError is returned when a formula depends on a variable
+// that was not provided
+type MissingDependencyError struct {
+	Name       string
+	Dependency string
+}
+
+func (e *MissingDependencyError) Error() string {
+	return fmt.Sprintf("%s depends on %s which does not exist", e.Name, e.Dependency)
+}
+
+// UnknownFormulaError is returned when evaluating a formula that was not
+// provided
+type UnknownFormulaError struct {
+	Name string
+}
+
+func (e *UnknownFormulaError) Error() string {
+	return e.Name + " does not exist"
+}
+
+// ancestors returns the formula with the given name along with every
+// formula it depends on, directly or not. Dependencies that don't exist are
+// left for sortFormulas to report.
+func ancestors(formulas map[string]*Formula, name string) (map[string]*Formula, error) {
+	if _, exists := formulas[name]; !exists {
+		return nil, &UnknownFormulaError{name}
+	}
+	needed := make(map[string]*Formula)
+	var visit func(name string)
+	visit = func(name string) {
+		formula, exists := formulas[name]
+		if _, seen := needed[name]; seen || !exists {
+			return
+		}
+		needed[name] = formula
+		for _, dependency := range formula.Dependencies {
+			visit(dependency)
+		}
+	}
+	visit(name)
+	return needed, nil
+}
+
+// descendants returns the formulas with the given names along with every
+// formula that depends on them, directly or not, in a stable order
+func descendants(formulas map[string]*Formula, names []string) []string {
+	dependents := make(map[string][]string)
+	for name, formula := range formulas {
+		for _, dependency := range formula.Dependencies {
+			dependents[dependency] = append(dependents[dependency], name)
+		}
+	}
+	found := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if _, exists := formulas[name]; found[name] || !exists {
+			return
+		}
+		found[name] = true
+		for _, dependent := range dependents[name] {
+			visit(dependent)
+		}
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	sorted := make([]string, 0, len(found))
+	for name := range found {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// sortedNames returns the formula names in a stable order
+func sortedNames(formulas map[string]*Formula) []string {
+	names := make([]string, 0, len(formulas))
+	for name := range formulas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// findCycle walks the dependency graph depth first and returns the first
+// chain of names that leads back to itself
+func findCycle(formulas map[string]*Formula) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	stack := make([]string, 0)
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, dependency := range formulas[name].Dependencies {
+			switch state[dependency] {
+			case visiting:
+				// Cut the stack down to the start of the loop
+				for index, stackName := range stack {
+					if stackName == dependency {
+						chain := append([]string{}, stack[index:]...)
+						return append(chain, dependency)
+					}
+				}
+			case unvisited:
+				if chain := visit(dependency); chain != nil {
+					return chain
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		return nil
+	}
+
+	for _, name := range sortedNames(formulas) {
+		if state[name] == unvisited {
+			if chain := visit(name); chain != nil {
+				return chain
+			}
+		}
+	}
+	return nil
+}
+
+// sortFormulas orders the formulas so that every formula comes after the
+// formulas it depends on
+func sortFormulas(formulas map[string]*Formula) ([]string, error) {
+	// Check that every dependency exists
+	names := sortedNames(formulas)
+	for _, name := range names {
+		for _, dependency := range formulas[name].Dependencies {
+			if _, exists := formulas[dependency]; !exists {
+				return nil, &MissingDependencyError{name, dependency}
+			}
+		}
+	}
+
+	// Count the dependencies left to resolve for each formula
+	remaining := make(map[string]int)
+	dependents := make(map[string][]string)
+	for _, name := range names {
+		seen := make(map[string]bool)
+		for _, dependency := range formulas[name].Dependencies {
+			if seen[dependency] {
+				continue
+			}
+			seen[dependency] = true
+			remaining[name]++
+			dependents[dependency] = append(dependents[dependency], name)
+		}
+	}
+
+	// Peel off the formulas with no dependencies left one level at a time
+	order := make([]string, 0, len(formulas))
+	level := make([]string, 0)
+	for _, name := range names {
+		if remaining[name] == 0 {
+			level = append(level, name)
+		}
+	}
+	for len(level) > 0 {
+		order = append(order, level...)
+		nextLevel := make([]string, 0)
+		for _, name := range level {
+			for _, dependent := range dependents[name] {
+				remaining[dependent]--
+				if remaining[dependent] == 0 {
+					nextLevel = append(nextLevel, dependent)
+				}
+			}
+		}
+		sort.Strings(nextLevel)
+		level = nextLevel
+	}
+
+	// Anything left over is part of a cycle
+	if len(order) != len(formulas) {
+		return nil, &CycleError{findCycle(formulas)}
+	}
+	return order, nil
+}
@@ -0,0 +1,100 @@
+package kernel
+
+import (
+	"go/ast"
+	"go/types"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/traefik/yaegi/stdlib"
+)
+
+// stdlibPackages maps package names to the standard library packages that
+// have that name
+var stdlibPackages = func() map[string][]string {
+	packages := make(map[string][]string)
+	for key := range stdlib.Symbols {
+		// Symbols are keyed by the import path followed by the package name
+		index := strings.LastIndex(key, "/")
+		if index < 0 {
+			continue
+		}
+		name := key[index+1:]
+		packages[name] = append(packages[name], key[:index])
+	}
+	for _, paths := range packages {
+		sort.Strings(paths)
+	}
+	return packages
+}()
+
+// importName is the name formula code uses to refer to an imported package
+func importName(importPath string) string {
+	return path.Base(importPath)
+}
+
+// qualifyImports rewrites the references to the packages a formula imports
+// so they use the package aliases. Formulas share one package, so this
+// keeps the imports of one formula from being seen by the others.
+func qualifyImports(code string, imports []string) string {
+	if len(imports) == 0 {
+		return code
+	}
+	replacements := make(map[string]string)
+	for _, importPath := range imports {
+		replacements[importName(importPath)] = importAlias(importPath)
+	}
+	qualified, _, err := replaceFree(code, replacements)
+	if err != nil {
+		return code
+	}
+	return qualified
+}
+
+// packageSelectors returns the names in the code that aren't declared and
+// are used like a package, such as strings in strings.Split
+func packageSelectors(file *ast.File) map[string]bool {
+	unresolved := make(map[*ast.Ident]bool)
+	for _, identifier := range file.Unresolved {
+		unresolved[identifier] = true
+	}
+	selectors := make(map[string]bool)
+	ast.Inspect(file, func(node ast.Node) bool {
+		if selector, ok := node.(*ast.SelectorExpr); ok {
+			if identifier, ok := selector.X.(*ast.Ident); ok && unresolved[identifier] {
+				selectors[identifier.Name] = true
+			}
+		}
+		return true
+	})
+	return selectors
+}
+
+// SuggestImports returns the standard library packages that could be
+// imported to provide the undefined package names used in a formula.
+// Names of variables are never suggested, nor is anything for expressions.
+func SuggestImports(formula Formula, variables []string) []string {
+	if formula.Language == LanguageExpression {
+		return nil
+	}
+	_, file, err := parseFormula(formula.Code)
+	if err != nil {
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, name := range variables {
+		known[name] = true
+	}
+	for _, importPath := range formula.Imports {
+		known[importName(importPath)] = true
+	}
+	suggestions := make([]string, 0)
+	for name := range packageSelectors(file) {
+		if !known[name] && types.Universe.Lookup(name) == nil {
+			suggestions = append(suggestions, stdlibPackages[name]...)
+		}
+	}
+	sort.Strings(suggestions)
+	return suggestions
+}
@@ -1,304 +1,403 @@
 package kernel
 
 import (
-	"fmt"
-	"go/build"
-	"log"
-	"os"
-	"reflect"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
-	"sync/atomic"
-	"time"
 
-	"github.com/traefik/yaegi/interp"
-	"github.com/traefik/yaegi/stdlib"
+	"github.com/lrdickson/calx/internal/kernel/render"
 )
 
-const (
-	ok int = iota
-	failed
-)
-
-type workerStatus struct {
-	name  string
-	value int
+type Formula struct {
+	// Dependencies are found from the code when left nil
+	Dependencies []string
+	Code         string
+	Language     Language
+
+	// Imports are the packages the formula code uses
+	Imports []string
+
+	// Type is the Go type the formula returns. The result is left as any
+	// when it is empty. Formulas that can fail return (T, error), and a
+	// non-nil error fails the formula like a panic does. Formulas with
+	// named results, such as (mean, stdev float64), return them as Outputs.
+	Type string
+
+	// CatchErrors runs the formula even when some of its dependencies
+	// failed, the way IFERROR does in a spreadsheet. Failed dependencies
+	// are nil or their zero value. Go formulas find their errors in the
+	// upstreamErrors map, expressions see them as #N/A errors.
+	CatchErrors bool
+
+	// Continuous formulas keep running in the background once they are
+	// started, such as to poll a server or read a sensor. They publish
+	// values with emit(v), and each value becomes their result and runs
+	// their dependents again. every(interval) ticks until they are stopped.
+	// What they return is their last value. The timeout limit doesn't
+	// apply to them and expressions can't be continuous.
+	Continuous bool
+
+	// Limits override the kernel limits for the fields that are set
+	Limits Limits
+
+	// Display is how the result is shown. Changing it renders the result
+	// again without running the formula.
+	Display render.Options
+
+	warnings []string
 }
 
-type worker struct {
-	active    atomic.Bool
-	formula   Formula
-	name      string
-	quit      chan int
-	result    any
-	runSignal chan int
-	wait      sync.WaitGroup
+// cacheEntry holds the last result of a formula along with what it was
+// computed from
+type cacheEntry struct {
+	hash          [sha256.Size]byte
+	inputVersions map[string]int
+	result        Result
+	version       int
+	display       render.Options
 }
 
-type Formula struct {
-	Dependencies []string
-	Code         string
+// ErrClosed is returned when updating a kernel after Close was called
+var ErrClosed = errors.New("kernel is closed")
+
+// Kernel runs formulas. LocalKernel interprets them in this process,
+// CompiledKernel builds them into a program with the go command for heavy
+// formulas, and the remote package runs a kernel in a child process so that
+// a bad formula can't take the app down with it. kerneltest has a fake for
+// testing code that uses a kernel.
+//
+// Formulas are given deep copies of the values of their dependencies, so a
+// formula that changes an input doesn't change it for any other formula.
+// What the unexported fields of a struct refer to can't be copied and is
+// shared, so values such as a *bytes.Buffer or *strings.Builder aren't
+// isolated. The numbers of math/big are copied.
+type Kernel interface {
+	// Update runs the formulas that changed since the last update along
+	// with everything that depends on them
+	Update(ctx context.Context, formulas map[string]*Formula) (map[string]*Result, error)
+
+	// Evaluate brings a single formula up to date, running only it and the
+	// formulas it depends on, directly or not, that changed. It returns the
+	// results of those formulas and leaves the others alone.
+	Evaluate(ctx context.Context, formulas map[string]*Formula, name string) (map[string]*Result, error)
+	Stop()
+
+	// StopFormula stops a continuous formula, keeping its last value. The
+	// next update that includes the formula starts it again.
+	StopFormula(name string)
+	RenameFormula(oldName, newName string)
+	SetPrelude(prelude string)
+	SetDotImportMath(enabled bool)
+	SetPolicy(policy Policy)
+	SetLimits(limits Limits)
+	SetParallelism(parallelism int)
+	AddListener(listener func(Event))
+	Close() error
 }
 
-type Kernel struct {
-	workers map[string]*worker
-	status  chan workerStatus
+// LocalKernel runs formulas in this process. Only one update runs at a
+// time, other calls to Update wait for it to finish. The cache and version
+// are only touched by the update that is running, everything else is
+// guarded by mutex. Values emitted by continuous formulas are picked up by
+// an update of their dependents that the kernel runs itself.
+type LocalKernel struct {
+	cache     map[string]*cacheEntry
+	closeOnce sync.Once
+	done      chan struct{}
+	emitted   chan struct{}
+	newTicker tickerFunc
+	pool      interpreterPool
+	running   chan struct{}
+	version   int
+
+	cancel      context.CancelFunc
+	continuous  map[string]*continuousRun
+	formulas    map[string]*Formula
+	mutex       sync.Mutex
+	parallelism int
+	project     project
+	renames     [][2]string
+	limits      Limits
+
+	eventSource
 }
 
-func (k *Kernel) stop(name string) {
-	if _, exists := k.workers[name]; exists {
-		if k.workers[name].active.Load() {
-			k.workers[name].quit <- 0
-		}
+var _ Kernel = (*LocalKernel)(nil)
+
+func NewLocalKernel() *LocalKernel {
+	k := &LocalKernel{
+		cache:       make(map[string]*cacheEntry),
+		continuous:  make(map[string]*continuousRun),
+		done:        make(chan struct{}),
+		emitted:     make(chan struct{}, 1),
+		newTicker:   newTimeTicker,
+		parallelism: runtime.NumCPU(),
+		running:     make(chan struct{}, 1),
 	}
+	go k.updateOnEmit()
+	return k
 }
 
-func (k *Kernel) getActiveCount() int {
-	activeCount := 0
-	for name := range k.workers {
-		if k.workers[name].active.Load() {
-			activeCount++
-		}
-	}
-	return activeCount
+// formulaLimits returns the limits that a formula runs with
+func (k *LocalKernel) formulaLimits(formula Formula) Limits {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return formula.Limits.withDefaults(k.limits)
 }
 
-func (k *Kernel) runWorkers() {
-	for _, w := range k.workers {
-		w.wait.Add(1)
-	}
+// RenameFormula keeps the cached result of a formula under its new name.
+// The rename takes effect on the next update.
+func (k *LocalKernel) RenameFormula(oldName, newName string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.renames = append(k.renames, [2]string{oldName, newName})
+}
 
-	for _, w := range k.workers {
-		log.Println("Starting:", w.name)
-		inputSent := false
-		for {
-			if w.active.Load() {
-				select {
-				case w.runSignal <- 0:
-					log.Println("Input sent to:", w.name)
-					inputSent = true
-				default:
-					//log.Println(w.name, "not ready")
-					time.Sleep(time.Millisecond)
-				}
-			} else {
-				break
-			}
+// applyRenames moves cached results and continuous formulas to the names
+// they were renamed to
+func (k *LocalKernel) applyRenames() {
+	k.mutex.Lock()
+	renames := k.renames
+	k.renames = nil
+	for _, rename := range renames {
+		if run, exists := k.continuous[rename[0]]; exists {
+			k.continuous[rename[1]] = run
+			delete(k.continuous, rename[0])
+		}
+	}
+	k.mutex.Unlock()
 
-			// escape if input sent
-			if inputSent {
-				break
-			}
+	for _, rename := range renames {
+		oldName, newName := rename[0], rename[1]
+		if entry, exists := k.cache[oldName]; exists {
+			k.cache[newName] = entry
+			delete(k.cache, oldName)
 		}
 	}
+}
 
+// renderedResult is the result of a formula that returned value, rendered
+// for display
+func renderedResult(value any, options render.Options) Result {
+	rendering := render.Render(value, options)
+	return Result{Value: value, Text: rendering.Text, Rendering: rendering, Status: StatusOK, Outputs: renderOutputs(value, options)}
 }
 
-func NewKernel() *Kernel {
-	// Make the kernel
-	status := make(chan workerStatus)
-	k := &Kernel{
-		workers: make(map[string]*worker),
-		status:  status,
+// withRenderings replaces the renderings of a result with the texts its
+// value and outputs rendered themselves as in the interpreter, keyed by
+// output name with "" for the whole value
+func withRenderings(result Result, renderings map[string]string) Result {
+	if text, exists := renderings[""]; exists {
+		result.Rendering = render.Rendering{Text: text, Custom: true}
+		result.Text = text
 	}
+	for index, output := range result.Outputs {
+		if text, exists := renderings[output.Name]; exists {
+			result.Outputs[index].Rendering = render.Rendering{Text: text, Custom: true}
+			result.Outputs[index].Text = text
+		}
+	}
+	return result
+}
 
-	// Watch for errors
-	go func() {
-		for {
-			ws := <-status
-			log.Println(ws.name, "quit with status", ws.value)
-			k.workers[ws.name].active.Store(false)
-			if ws.value != ok {
-				k.workers[ws.name].wait.Done()
-			}
+// rerender renders a result again with new display options. Results and
+// outputs that rendered themselves are left alone since they don't use the
+// options.
+func rerender(result Result, options render.Options) Result {
+	if result.Status != StatusOK || result.Rendering.Custom {
+		return result
+	}
+	result.Rendering = render.Render(result.Value, options)
+	result.Text = result.Rendering.Text
+	custom := make(map[string]string)
+	for _, output := range result.Outputs {
+		if output.Rendering.Custom {
+			custom[output.Name] = output.Text
 		}
-	}()
+	}
+	result.Outputs = renderOutputs(result.Value, options)
+	return withRenderings(result, custom)
+}
 
-	return k
+// hash identifies the code that a formula will run
+func (f *Formula) hash() [sha256.Size]byte {
+	return sha256.Sum256([]byte(f.Language.String() + "\n" + strings.Join(f.Dependencies, ",") + "\n" + strings.Join(f.Imports, ",") + "\n" + f.Type + "\n" + strconv.FormatBool(f.CatchErrors) + "\n" + strconv.FormatBool(f.Continuous) + "\n" + f.Code))
 }
 
-func (k *Kernel) addWorker(name string, formula Formula, done chan string) {
-	// Stop the worker if it already existed
-	k.stop(name)
-
-	// Create a new worker
-	log.Println("Creating new worker:", name)
-	quit := make(chan int)
-	run := make(chan int)
-	newWorker := worker{
-		quit:      quit,
-		runSignal: run,
-		name:      name,
-		formula:   formula,
+// inputVersions returns the current version of each dependency
+func (k *LocalKernel) inputVersions(formula *Formula) map[string]int {
+	versions := make(map[string]int)
+	for _, dependency := range formula.Dependencies {
+		versions[dependency] = k.cache[dependency].version
 	}
-	newWorker.active.Store(true)
-	k.workers[name] = &newWorker
-
-	// Start the new worker
-	go func() {
-		// Start the interpreter
-		gointerp := interp.New(interp.Options{
-			GoPath: build.Default.GOPATH,
-			Env:    os.Environ(),
-			//Unrestricted: true,
-		})
-		if err := gointerp.Use(stdlib.Symbols); err != nil {
-			log.Fatal("Stdlib load error:", err)
-		}
-		if err := gointerp.Use(interp.Symbols); err != nil {
-			log.Fatal("Interp symbol load error:", err)
-		}
+	return versions
+}
 
-		for {
-			log.Println(newWorker.name, "ready to receive commands")
-			select {
-			case <-quit:
-				log.Println("Quiting:", newWorker.name)
-				k.status <- workerStatus{newWorker.name, ok}
-				return
-			//case params := <-in:
-			case <-run:
-				// Build the function code
-				functionCode := "package run\n"
-				functionCode += `import . "math"` + "\n"
-				functionCode += "func Run(params []any) any {\n"
-
-				// Get the function parameters
-				params := make([]any, 0, len(formula.Dependencies))
-				for index, dependency := range formula.Dependencies {
-					// Get the result
-					dependentWorker, exists := k.workers[dependency]
-					if !exists {
-						log.Println(newWorker.name, "dependent worker", dependentWorker, "doesn't exist")
-						k.status <- workerStatus{newWorker.name, failed}
-						return
-					}
-					dependentWorker.wait.Wait()
-					params = append(params, dependentWorker.result)
-
-					// Determine the type
-					functionCode += dependency + " := params[" + strconv.Itoa(index) + "]"
-					if dependentWorker.result != nil {
-						paramType := reflect.TypeOf(dependentWorker.result)
-						functionCode += ".(" + paramType.String() + ")"
-					}
-					functionCode += "\n"
-				}
-
-				// Add in the function code
-				functionCode += formula.Code
-				functionCode += "}"
-
-				// Create the function
-				log.Println("Function code:\n", functionCode)
-				_, err := gointerp.Eval(functionCode)
-				if err != nil {
-					// TODO: Display this error to the user
-					log.Println("Failed to evaluate", name, "code:", err)
-					k.status <- workerStatus{newWorker.name, failed}
-					return
-				}
-				v, err := gointerp.Eval("run.Run")
-				if err != nil {
-					log.Println("Failed to get", newWorker.name, "function:", err)
-					k.status <- workerStatus{newWorker.name, failed}
-					return
-				}
-				function := v.Interface().(func([]any) any)
-
-				// Get the function output
-				log.Println(newWorker.name, "running function")
-				newWorker.result = func() (result any) {
-					defer func() {
-						if r := recover(); r != nil {
-							// TODO: Display this error to the user
-							log.Println("Recoverd from yaegi panic:", r)
-							result = r
-							return
-						}
-					}()
-					return function(params)
-				}()
-				log.Println(newWorker.name, "function returned result", newWorker.result)
-				newWorker.wait.Done()
-				done <- newWorker.name
-			}
+// isDirty reports whether a formula has to be run again because its code
+// or one of its inputs changed since the cached result was computed
+func (k *LocalKernel) isDirty(name string, formula *Formula) bool {
+	entry, exists := k.cache[name]
+	if !exists || entry.hash != formula.hash() || entry.result.Status.interrupted() {
+		return true
+	}
+	for dependency, version := range k.inputVersions(formula) {
+		if entry.inputVersions[dependency] != version {
+			return true
 		}
-	}()
+	}
+	return false
 }
 
-func (k *Kernel) getWorker(name string) (*worker, bool) {
-	if formulaWorker, exists := k.workers[name]; exists {
-		return formulaWorker, formulaWorker.active.Load()
+// store caches a new result for a formula
+func (k *LocalKernel) store(name string, formula *Formula, result Result) {
+	result.Warnings = formula.warnings
+	k.version++
+	k.cache[name] = &cacheEntry{
+		hash:          formula.hash(),
+		inputVersions: k.inputVersions(formula),
+		result:        result,
+		version:       k.version,
+		display:       formula.Display,
 	}
-	return nil, false
 }
 
-func (k *Kernel) RenameFormula(oldName, newName string) {
-	if formulaWorker, exists := k.workers[oldName]; exists {
-		if formulaWorker.active.Load() {
-			formulaWorker.name = newName
-		}
-		k.workers[newName] = formulaWorker
-		delete(k.workers, oldName)
+// SetLimits sets the resources each formula may use before it is stopped.
+// Formulas without limits run until they finish or Stop is called.
+func (k *LocalKernel) SetLimits(limits Limits) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.limits = limits
+}
+
+// SetParallelism sets how many formulas may run at the same time. A value
+// below 1 uses the number of CPUs.
+func (k *LocalKernel) SetParallelism(parallelism int) {
+	if parallelism < 1 {
+		parallelism = runtime.NumCPU()
 	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.parallelism = parallelism
 }
 
-func (k *Kernel) Update(workerFormulas map[string]*Formula) map[string]string {
-	// Make a worker for each formula provided
-	done := make(chan string)
-	for name, formula := range workerFormulas {
-		k.addWorker(name, *formula, done)
+// Stop cancels the formulas that are currently running. They are reported
+// as cancelled and will be run again on the next update.
+func (k *LocalKernel) Stop() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.cancel != nil {
+		k.cancel()
 	}
+}
 
-	// Run all of the workers
-	k.runWorkers()
+// Close stops the running update and the continuous formulas and waits
+// for the update to return. Updates after Close return ErrClosed.
+func (k *LocalKernel) Close() error {
+	k.closeOnce.Do(func() {
+		close(k.done)
+		k.Stop()
+		k.stopContinuous(func(string) bool { return true })
+
+		// Wait for the running update and keep any others from starting
+		k.running <- struct{}{}
+		k.pool.close()
+	})
+	return nil
+}
 
-	// Get the output
-	outputData := make(map[string]string)
-	responseReceived := make(map[string]bool)
-	for {
-		select {
-		case name := <-done:
-			// Get the worker
-			log.Println("Sending quit signal to:", name)
-			activeWorker, workerExists := k.workers[name]
-			if !workerExists {
-				break
-			}
+func (k *LocalKernel) Update(ctx context.Context, workerFormulas map[string]*Formula) (map[string]*Result, error) {
+	return k.update(ctx, workerFormulas)
+}
 
-			// Stop the worker
-			// TODO: rename workers and leave them running
-			k.stop(name)
-			log.Println("quit signal sent to:", name)
-
-			// Interpet the data
-			result := activeWorker.result
-			switch result.(type) {
-			case bool:
-				outputData[name] = strconv.FormatBool(result.(bool))
-			case int:
-				outputData[name] = strconv.Itoa(result.(int))
-			case uint:
-				outputData[name] = strconv.FormatUint(uint64(result.(uint)), 10)
-			case float32:
-				outputData[name] = strconv.FormatFloat(float64(result.(float32)), 'f', -1, 32)
-			case float64:
-				outputData[name] = strconv.FormatFloat(result.(float64), 'f', -1, 64)
-			case string:
-				outputData[name] = result.(string)
-			default:
-				outputReflect := reflect.ValueOf(result)
-				outputData[name] = fmt.Sprintf("%v", outputReflect)
+// Evaluate runs a formula and what it needs, reusing the cached results of
+// the formulas that didn't change
+func (k *LocalKernel) Evaluate(ctx context.Context, workerFormulas map[string]*Formula, name string) (map[string]*Result, error) {
+	return k.update(ctx, workerFormulas, name)
+}
+
+// update runs the formulas, or only the target formulas and their
+// ancestors when targets are given
+func (k *LocalKernel) update(ctx context.Context, allFormulas map[string]*Formula, targets ...string) (map[string]*Result, error) {
+	// Order the formulas so that dependencies run first
+	k.mutex.Lock()
+	project := k.project
+	k.mutex.Unlock()
+	allFormulas = resolveDependencies(allFormulas, project)
+	workerFormulas := allFormulas
+	if len(targets) > 0 {
+		workerFormulas = make(map[string]*Formula)
+		for _, target := range targets {
+			needed, err := ancestors(allFormulas, target)
+			if err != nil {
+				return nil, err
+			}
+			for name, formula := range needed {
+				workerFormulas[name] = formula
 			}
-			responseReceived[name] = true
-		case <-time.After(time.Millisecond):
-			//log.Println("timeout")
 		}
-		if k.getActiveCount() == 0 {
-			break
+	}
+	order, err := sortFormulas(workerFormulas)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for any other update to finish
+	select {
+	case k.running <- struct{}{}:
+	case <-k.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-k.running }()
+
+	// Let the run be stopped
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	k.mutex.Lock()
+	select {
+	case <-k.done:
+		k.mutex.Unlock()
+		return nil, ErrClosed
+	default:
+	}
+	k.cancel = cancel
+	k.formulas = allFormulas
+	parallelism := k.parallelism
+	k.mutex.Unlock()
+	defer func() {
+		k.mutex.Lock()
+		k.cancel = nil
+		k.mutex.Unlock()
+	}()
+	k.applyRenames()
+	if err := k.loadProject(project); err != nil {
+		return nil, err
+	}
+
+	// Forget formulas that no longer exist
+	for name := range k.cache {
+		if _, exists := allFormulas[name]; !exists {
+			delete(k.cache, name)
 		}
-		//log.Println("Workers are still active")
 	}
-	return outputData
+	k.stopContinuous(func(name string) bool {
+		formula, exists := allFormulas[name]
+		return !exists || !formula.isContinuous()
+	})
+
+	// Run the formulas
+	k.schedule(ctx, workerFormulas, order, parallelism)
+
+	// Get the output
+	results := make(map[string]*Result)
+	for name := range workerFormulas {
+		result := k.cache[name].result
+		results[name] = &result
+	}
+	return results, nil
 }
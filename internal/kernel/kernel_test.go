@@ -1,38 +1,60 @@
 package kernel
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/lrdickson/calx/internal/kernel/render"
+	"golang.org/x/exp/slices"
 )
 
-func TestAddWorker(t *testing.T) {
-	// Add a worker to the kernel
-	goKernel := NewKernel()
-	done := make(chan string)
-	goKernel.addWorker("test", Formula{Code: "return 1"}, done)
-	activeWorkerCount := goKernel.getActiveCount()
-	if activeWorkerCount != 1 {
-		t.Fatal("Go Kernel should have 1 active worker but instead has", activeWorkerCount)
+func TestParallelism(t *testing.T) {
+	input := make(map[string]*Formula)
+	for i := 0; i < 8; i++ {
+		input["v"+strconv.Itoa(i)] = &Formula{Code: "return " + strconv.Itoa(i)}
 	}
 
-	// Stop the worker
-	goKernel.stop("test")
-	time.Sleep(time.Millisecond)
-	activeWorkerCount = goKernel.getActiveCount()
-	if activeWorkerCount != 0 {
-		t.Fatal("Go Kernel should have 0 active workers but instead has", activeWorkerCount)
+	// Running one formula at a time should only ever need one interpreter
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	goKernel.SetParallelism(1)
+	if _, err := goKernel.Update(context.Background(), input); err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if len(goKernel.pool.idle) != 1 {
+		t.Fatal("Parallelism 1 should use 1 interpreter but used", len(goKernel.pool.idle))
 	}
 }
 
 func checkUpdate(t *testing.T, input map[string]*Formula, expected map[string]string) {
 	// Start the kernel
-	goKernel := NewKernel()
-	output := goKernel.Update(input)
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatalf("Update(%v) returned error: %v", input, err)
+	}
 
 	// Check the output
 	for key, expectedValue := range expected {
-		if returnedValue, exists := output[key]; exists {
-			if returnedValue != expectedValue {
+		if result, exists := output[key]; exists {
+			if result.Status != StatusOK {
+				t.Fatalf("Update(%v) ouput[\"%s\"] failed with %s: %s",
+					input, key, result.Status, result.Error)
+			}
+			if returnedValue := result.Text; returnedValue != expectedValue {
 				t.Fatalf("Update(%v) did not return ouput[\"%s\"] = \"%s\", returned %v instead",
 					input, key, expectedValue, returnedValue)
 			}
@@ -42,6 +64,33 @@ func checkUpdate(t *testing.T, input map[string]*Formula, expected map[string]st
 	}
 }
 
+// updateEachKernel runs an update on every Kernel implementation, after
+// setup if it isn't nil, and returns the results by kernel name. The
+// compiled kernel is left out when the go command is missing.
+func updateEachKernel(t *testing.T, input map[string]*Formula, setup func(Kernel)) map[string]map[string]*Result {
+	t.Helper()
+	kernels := map[string]Kernel{"local": NewLocalKernel()}
+	if _, err := exec.LookPath("go"); err == nil {
+		kernels["compiled"] = NewCompiledKernel()
+	} else {
+		t.Log("Leaving out the compiled kernel, which needs the go command:", err)
+	}
+	outputs := make(map[string]map[string]*Result)
+	for kernelName, goKernel := range kernels {
+		goKernel := goKernel
+		t.Cleanup(func() { goKernel.Close() })
+		if setup != nil {
+			setup(goKernel)
+		}
+		output, err := goKernel.Update(context.Background(), input)
+		if err != nil {
+			t.Fatal(kernelName, "Update returned error:", err)
+		}
+		outputs[kernelName] = output
+	}
+	return outputs
+}
+
 func TestBasic(t *testing.T) {
 	input := make(map[string]*Formula)
 	input["a"] = &Formula{Code: "return 1"}
@@ -73,8 +122,1699 @@ func TestDependents(t *testing.T) {
 
 func TestImport(t *testing.T) {
 	input := make(map[string]*Formula)
-	input["math"] = &Formula{Code: "return Pow(2,3)"}
+	input["power"] = &Formula{Code: "return math.Pow(2,3)", Imports: []string{"math"}}
+	input["words"] = &Formula{Code: `return len(strings.Fields("a b c"))`, Imports: []string{"strings"}}
+	input["random"] = &Formula{Code: "return rand.New(rand.NewSource(1)).Intn(1)", Imports: []string{"math/rand"}}
+	input["bytes"] = &Formula{Code: "b := make([]byte, 4)\nn, _ := rand.Read(b)\nreturn n", Imports: []string{"crypto/rand"}}
+	expected := make(map[string]string)
+	expected["power"] = "8"
+	expected["words"] = "3"
+	expected["random"] = "0"
+	expected["bytes"] = "4"
+	checkUpdate(t, input, expected)
+
+	// Imports of one formula can't be used by another
+	input["unimported"] = &Formula{Code: `return strings.ToUpper("a")`}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	goKernel.SetParallelism(1)
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["unimported"].Status != StatusCompileError {
+		t.Fatal("unimported should not compile but has", output["unimported"])
+	}
+	expectedWarnings := []string{`undefined name "strings" (add import "strings")`}
+	if !slices.Equal(output["unimported"].Warnings, expectedWarnings) {
+		t.Fatal("unimported should suggest an import but has", output["unimported"].Warnings)
+	}
+}
+
+func TestDotImportMath(t *testing.T) {
+	input := map[string]*Formula{"power": {Code: "return Pow(2, 3)"}}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["power"].Status != StatusCompileError {
+		t.Fatal("Pow should be undefined without the dot import but got", output["power"])
+	}
+
+	goKernel.SetDotImportMath(true)
+	output, err = goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["power"].Text != "8" || len(output["power"].Warnings) != 0 {
+		t.Fatal("power should be 8 but is", output["power"])
+	}
+}
+
+func TestSuggestImports(t *testing.T) {
+	formula := Formula{
+		Code:    "x := strings.Split(s, \",\")\nreturn rand.Intn(len(x)) + point.X + fmt.Sprint(len)",
+		Imports: []string{"fmt"},
+	}
+	suggestions := SuggestImports(formula, []string{"point"})
+	if !slices.Equal(suggestions, []string{"crypto/rand", "math/rand", "strings"}) {
+		t.Fatal("Unexpected suggestions:", suggestions)
+	}
+}
+
+func TestChain(t *testing.T) {
+	// Build a long chain so that map order can't line up by accident
+	input := make(map[string]*Formula)
 	expected := make(map[string]string)
-	expected["math"] = "8"
+	input["v0"] = &Formula{Code: "return 0"}
+	expected["v0"] = "0"
+	for i := 1; i < 50; i++ {
+		name := "v" + strconv.Itoa(i)
+		previous := "v" + strconv.Itoa(i-1)
+		input[name] = &Formula{
+			Code:         "return " + previous + " + 1",
+			Dependencies: []string{previous}}
+		expected[name] = strconv.Itoa(i)
+	}
+	checkUpdate(t, input, expected)
+}
+
+func TestCycle(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return b", Dependencies: []string{"b"}}
+	input["b"] = &Formula{Code: "return c", Dependencies: []string{"c"}}
+	input["c"] = &Formula{Code: "return a", Dependencies: []string{"a"}}
+	input["d"] = &Formula{Code: "return 1"}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	_, err := goKernel.Update(context.Background(), input)
+	var cycleErr *CycleError
+	if !errors.As(err, &cycleErr) {
+		t.Fatal("Update should have returned a CycleError but returned", err)
+	}
+	if err.Error() != "dependency cycle: a -> b -> c -> a" {
+		t.Fatal("Unexpected cycle error:", err)
+	}
+}
+
+func TestSelfCycle(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return a", Dependencies: []string{"a"}}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	_, err := goKernel.Update(context.Background(), input)
+	if err == nil || err.Error() != "dependency cycle: a -> a" {
+		t.Fatal("Unexpected cycle error:", err)
+	}
+}
+
+func TestMissingDependency(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return b", Dependencies: []string{"b"}}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	_, err := goKernel.Update(context.Background(), input)
+	var missingErr *MissingDependencyError
+	if !errors.As(err, &missingErr) || missingErr.Dependency != "b" {
+		t.Fatal("Update should have returned a MissingDependencyError but returned", err)
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return 1"}
+	input["b"] = &Formula{
+		Code:         "x := a\nreturn y",
+		Dependencies: []string{"a"}}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	result := output["b"]
+	if result.Status != StatusCompileError {
+		t.Fatal("b should have a compile error but has status", result.Status)
+	}
+	if len(result.CompileErrors) != 1 {
+		t.Fatal("b should have 1 compile error but has", result.CompileErrors)
+	}
+	compileErr := result.CompileErrors[0]
+	if compileErr.Line != 2 || compileErr.Column != 8 || compileErr.Message != "undefined: y" {
+		t.Fatal("Unexpected compile error:", compileErr)
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return 1 +"}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	result := output["a"]
+	if result.Status != StatusCompileError || len(result.CompileErrors) == 0 {
+		t.Fatal("a should have a compile error but has", result)
+	}
+	if result.CompileErrors[0].Line != 2 {
+		t.Fatal("Unexpected compile error:", result.CompileErrors[0])
+	}
+}
+
+func TestPanicSkipsDependents(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: `panic("boom")`}
+	input["b"] = &Formula{Code: "return a", Dependencies: []string{"a"}}
+	input["c"] = &Formula{Code: "return 3"}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["a"].Status != StatusPanic || output["a"].Error != "boom" {
+		t.Fatal("a should have panicked but has", output["a"])
+	}
+	if output["b"].Status != StatusSkipped || output["b"].Error != "upstream failed: a" {
+		t.Fatal("b should have been skipped but has", output["b"])
+	}
+	if output["c"].Status != StatusOK || output["c"].Value != 3 {
+		t.Fatal("c should have returned 3 but has", output["c"])
+	}
+}
+
+func TestIncremental(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return 1"}
+	input["b"] = &Formula{Code: "return a + 1", Dependencies: []string{"a"}}
+	input["c"] = &Formula{Code: "return 10"}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	if _, err := goKernel.Update(context.Background(), input); err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	versions := make(map[string]int)
+	for name, entry := range goKernel.cache {
+		versions[name] = entry.version
+	}
+
+	// Nothing changed so nothing should run
+	if _, err := goKernel.Update(context.Background(), input); err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	for name, entry := range goKernel.cache {
+		if entry.version != versions[name] {
+			t.Fatal(name, "was run again even though nothing changed")
+		}
+	}
+
+	// Changing a should rerun a and b but not c
+	input["a"] = &Formula{Code: "return 5"}
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["b"].Text != "6" {
+		t.Fatal("b should be 6 but is", output["b"].Text)
+	}
+	for name, rerun := range map[string]bool{"a": true, "b": true, "c": false} {
+		if (goKernel.cache[name].version != versions[name]) != rerun {
+			t.Fatalf("%s rerun should be %v", name, rerun)
+		}
+	}
+}
+
+func TestIsolation(t *testing.T) {
+	// Formulas that change their inputs run next to formulas that read the
+	// same inputs
+	input := make(map[string]*Formula)
+	input["list"] = &Formula{Code: "return []int{1, 2, 3}"}
+	input["table"] = &Formula{Code: `return map[string]int{"a": 1}`}
+	input["box"] = &Formula{Code: "return &Box{Items: []int{1}}"}
+	for _, suffix := range []string{"1", "2", "3"} {
+		input["mutate"+suffix] = &Formula{Code: `list[0] = 100
+table["a"] = 100
+table["b"] = 2
+box.Items[0] = 100
+box.Items = nil
+return len(list)`}
+		input["read"+suffix] = &Formula{Code: `return fmt.Sprint(list, table, box.Items)`, Imports: []string{"fmt"}}
+	}
+	setup := func(goKernel Kernel) {
+		goKernel.SetPrelude("type Box struct{ Items []int }")
+		goKernel.SetParallelism(6)
+	}
+	for kernelName, output := range updateEachKernel(t, input, setup) {
+		for _, name := range []string{"read1", "read2", "read3"} {
+			if output[name].Status != StatusOK || output[name].Text != "[1 2 3] map[a:1] [1]" {
+				t.Fatal(kernelName, name, "saw an input changed by another formula:", output[name])
+			}
+		}
+		if list := fmt.Sprint(output["list"].Value); list != "[1 2 3]" {
+			t.Fatal(kernelName, "changed the cached value of list:", list)
+		}
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	// Formulas with several outputs, returned as Outputs or as named results,
+	// along with formulas that read them
+	input := make(map[string]*Formula)
+	input["stats"] = &Formula{Code: `values := []float64{1, 2, 3, 6}
+return Outputs{"mean": 3.0, "count": len(values)}`}
+	input["bounds"] = &Formula{Code: "return 1, 5, nil", Type: "(low, high int, err error)"}
+	input["timing"] = &Formula{Code: "return time.Second", Type: "(wait time.Duration)", Imports: []string{"time"}}
+	input["checked"] = &Formula{Code: `if stats.count == 0 {
+	return nil, errors.New("no values")
+}
+return Outputs{"first": 1.5}, nil`, Imports: []string{"errors"}}
+	input["failing"] = &Formula{Code: `return 0, errors.New("no x")`, Type: "(x int, err error)", Imports: []string{"errors"}}
+	input["total"] = &Formula{Code: "return stats.mean * float64(stats.count)"}
+	input["width"] = &Formula{Code: "return bounds.high - bounds.low + 1"}
+	input["next"] = &Formula{Code: "return checked.first + 1"}
+	input["longer"] = &Formula{Code: "return timing.wait * 2"}
+	input["sum"] = &Formula{Code: "=stats.mean + bounds.high", Language: LanguageExpression}
+	for kernelName, output := range updateEachKernel(t, input, nil) {
+		for name, expected := range map[string]string{"total": "12", "width": "5", "next": "2.5", "longer": "2s", "sum": "8"} {
+			if output[name].Status != StatusOK || output[name].Text != expected {
+				t.Fatal(kernelName, name, "should be", expected, "but is", output[name])
+			}
+		}
+		stats := output["stats"].Outputs
+		if len(stats) != 2 || stats[0].Name != "count" || stats[0].Text != "4" || stats[1].Name != "mean" || stats[1].Text != "3" {
+			t.Fatal(kernelName, "stats should have the outputs count and mean but has", stats)
+		}
+		if bounds := output["bounds"].Outputs; len(bounds) != 2 || bounds[0].Name != "high" || bounds[1].Text != "1" {
+			t.Fatal(kernelName, "bounds should have the outputs high and low but has", bounds)
+		}
+		if outputs, ok := output["bounds"].Value.(Outputs); !ok || fmt.Sprint(outputs["high"]) != "5" {
+			t.Fatal(kernelName, "bounds should have the value Outputs{high: 5, low: 1} but has", output["bounds"].Value)
+		}
+		if output["failing"].Status != StatusError || output["failing"].Error != "no x" {
+			t.Fatal(kernelName, "failing should have failed but has", output["failing"])
+		}
+	}
+}
+
+func TestNamedResultDependencies(t *testing.T) {
+	// Named results are variables of the formula, even when a formula has
+	// the same name
+	input := make(map[string]*Formula)
+	input["high"] = &Formula{Code: "return 10"}
+	input["bounds"] = &Formula{Code: "high = 5\nreturn 1, high", Type: "(low, high int)"}
+	dependencies, warnings := findDependencies(input["bounds"], input, nil)
+	if len(dependencies) != 0 || len(warnings) != 0 {
+		t.Fatal("bounds should have no dependencies or warnings but has", dependencies, warnings)
+	}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if bounds := output["bounds"]; bounds.Status != StatusOK || len(bounds.Warnings) != 0 || bounds.Outputs[0].Text != "5" {
+		t.Fatal("bounds should have the output high 5 but has", bounds)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return 1"}
+	input["b"] = &Formula{Code: "return a + 1"}
+	input["c"] = &Formula{Code: "return b * 10"}
+	input["other"] = &Formula{Code: "return 5"}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	output, err := goKernel.Evaluate(context.Background(), input, "b")
+	if err != nil {
+		t.Fatal("Evaluate returned error:", err)
+	}
+	if len(output) != 2 || output["b"].Value != 2 {
+		t.Fatal("Only a and b should have been run but got", output)
+	}
+	if _, cached := goKernel.cache["other"]; cached {
+		t.Fatal("other shouldn't have been run")
+	}
+
+	// Evaluating a formula reuses what is already up to date, even when
+	// formulas it doesn't need changed
+	aVersion := goKernel.cache["a"].version
+	input["other"] = &Formula{Code: "for {}"}
+	output, err = goKernel.Evaluate(context.Background(), input, "c")
+	if err != nil {
+		t.Fatal("Evaluate returned error:", err)
+	}
+	if output["c"].Value != 20 || goKernel.cache["a"].version != aVersion {
+		t.Fatal("c should be 20 without running a again but got", output["c"])
+	}
+
+	if _, err := goKernel.Evaluate(context.Background(), input, "missing"); err == nil {
+		t.Fatal("Evaluating a missing formula should fail")
+	}
+	input["d"] = &Formula{Code: "return e", Dependencies: []string{"e"}}
+	var missingDependency *MissingDependencyError
+	if _, err := goKernel.Evaluate(context.Background(), input, "d"); !errors.As(err, &missingDependency) {
+		t.Fatal("Expected a missing dependency error but got", err)
+	}
+}
+
+func TestIncrementalRemoved(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return 1"}
+	input["b"] = &Formula{Code: "return 2"}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	if _, err := goKernel.Update(context.Background(), input); err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	delete(input, "b")
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if _, exists := output["b"]; exists {
+		t.Fatal("b should not be in the output after being removed")
+	}
+	if _, exists := goKernel.cache["b"]; exists {
+		t.Fatal("b should not be cached after being removed")
+	}
+}
+
+func TestStop(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["loop"] = &Formula{Code: "for {}"}
+	input["after"] = &Formula{Code: "return loop", Dependencies: []string{"loop"}}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		goKernel.Stop()
+	}()
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	for _, name := range []string{"loop", "after"} {
+		if output[name].Status != StatusCancelled {
+			t.Fatal(name, "should have been cancelled but has", output[name])
+		}
+	}
+
+	// The kernel should still work after being stopped
+	input["loop"] = &Formula{Code: "return 1"}
+	expected := map[string]string{"loop": "1", "after": "1"}
+	output, err = goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	for name, text := range expected {
+		if output[name].Text != text {
+			t.Fatal(name, "should be", text, "but has", output[name])
+		}
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["loop"] = &Formula{Code: "for {}"}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	output, err := goKernel.Update(ctx, input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["loop"].Status != StatusCancelled {
+		t.Fatal("loop should have been cancelled but has", output["loop"])
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["loop"] = &Formula{Code: "for {}", Limits: Limits{Timeout: 50 * time.Millisecond}}
+	input["after"] = &Formula{Code: "return loop", Dependencies: []string{"loop"}}
+	input["fast"] = &Formula{Code: "return 1"}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	goKernel.SetLimits(Limits{Timeout: time.Hour})
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["loop"].Status != StatusTimeout {
+		t.Fatal("loop should have timed out but has", output["loop"])
+	}
+	if output["after"].Status != StatusSkipped {
+		t.Fatal("after should have been skipped but has", output["after"])
+	}
+	if output["fast"].Text != "1" {
+		t.Fatal("fast should be 1 but has", output["fast"])
+	}
+}
+
+func TestReuseCompiled(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return 1"}
+	input["b"] = &Formula{Code: "return a * 2", Dependencies: []string{"a"}}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	checkResult := func(expected string) {
+		output, err := goKernel.Update(context.Background(), input)
+		if err != nil {
+			t.Fatal("Update returned error:", err)
+		}
+		if output["b"].Text != expected {
+			t.Fatal("b should be", expected, "but is", output["b"])
+		}
+	}
+	checkResult("2")
+
+	// b should be called again with the new value of a without being
+	// compiled a second time
+	input["a"] = &Formula{Code: "return 4"}
+	checkResult("8")
+	compiledCount := 0
+	for _, i := range goKernel.pool.idle {
+		compiledCount += len(i.compiled)
+	}
+	if compiledCount != 3 {
+		t.Fatal("3 formulas should have been compiled but", compiledCount, "were")
+	}
+}
+
+// projectFormulas builds a project with a root formula and 100 formulas
+// that depend on it
+func projectFormulas(root int) map[string]*Formula {
+	input := make(map[string]*Formula)
+	input["root"] = &Formula{Code: "return " + strconv.Itoa(root)}
+	for i := 0; i < 100; i++ {
+		input["v"+strconv.Itoa(i)] = &Formula{
+			Code:         "return root * " + strconv.Itoa(i),
+			Dependencies: []string{"root"}}
+	}
+	return input
+}
+
+func BenchmarkUpdateNewKernel(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for n := 0; n < b.N; n++ {
+		goKernel := NewLocalKernel()
+		if _, err := goKernel.Update(context.Background(), projectFormulas(n)); err != nil {
+			b.Fatal("Update returned error:", err)
+		}
+		goKernel.Close()
+	}
+}
+
+func BenchmarkUpdatePooled(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	goKernel := NewLocalKernel()
+	b.Cleanup(func() { goKernel.Close() })
+	for n := 0; n < b.N; n++ {
+		if _, err := goKernel.Update(context.Background(), projectFormulas(n)); err != nil {
+			b.Fatal("Update returned error:", err)
+		}
+	}
+}
+
+func TestRenameFormula(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return 1"}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	if _, err := goKernel.Update(context.Background(), input); err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	version := goKernel.cache["a"].version
+
+	// The renamed formula should keep its cached result
+	goKernel.RenameFormula("a", "b")
+	input = map[string]*Formula{"b": input["a"]}
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["b"].Text != "1" {
+		t.Fatal("b should be 1 but is", output["b"])
+	}
+	if goKernel.cache["b"].version != version {
+		t.Fatal("b was run again after being renamed")
+	}
+}
+
+func TestClose(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["loop"] = &Formula{Code: "for {}"}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	updateDone := make(chan error)
+	go func() {
+		_, err := goKernel.Update(context.Background(), input)
+		updateDone <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Close should stop the running update and wait for it
+	if err := goKernel.Close(); err != nil {
+		t.Fatal("Close returned error:", err)
+	}
+	select {
+	case err := <-updateDone:
+		if err != nil && !errors.Is(err, ErrClosed) {
+			t.Fatal("Update returned unexpected error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The running update did not return after Close")
+	}
+	if _, err := goKernel.Update(context.Background(), input); !errors.Is(err, ErrClosed) {
+		t.Fatal("Update after Close should return ErrClosed but returned", err)
+	}
+	if err := goKernel.Close(); err != nil {
+		t.Fatal("Second Close returned error:", err)
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	goKernel := NewLocalKernel()
+	defer goKernel.Close()
+
+	// Run overlapping updates, renames and stops
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(1)
+		go func(i int) {
+			defer wait.Done()
+			for n := 0; n < 5; n++ {
+				input := projectFormulas(i*10 + n)
+				output, err := goKernel.Update(context.Background(), input)
+				if err != nil {
+					t.Error("Update returned error:", err)
+					return
+				}
+				for name, result := range output {
+					if result.Status != StatusOK && result.Status != StatusCancelled && result.Status != StatusSkipped {
+						t.Error(name, "failed with", result.Status, result.Error)
+						return
+					}
+				}
+				goKernel.RenameFormula("v"+strconv.Itoa(n), "renamed")
+				goKernel.RenameFormula("renamed", "v"+strconv.Itoa(n))
+				if n%3 == 0 {
+					goKernel.Stop()
+				}
+			}
+		}(i)
+	}
+	wait.Wait()
+
+	// The kernel should still give correct results afterwards
+	output, err := goKernel.Update(context.Background(), projectFormulas(3))
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["v5"].Text != "15" {
+		t.Fatal("v5 should be 15 but is", output["v5"])
+	}
+}
+
+func TestEvents(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return 1"}
+	input["b"] = &Formula{Code: "return a + 1", Dependencies: []string{"a"}}
+	input["c"] = &Formula{Code: `panic("boom")`}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	var mutex sync.Mutex
+	events := make([]Event, 0)
+	goKernel.AddListener(func(event Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, event)
+	})
+	if _, err := goKernel.Update(context.Background(), input); err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+
+	// Every formula should start and then finish or fail
+	expected := map[string]EventType{"a": FinishedEvent, "b": FinishedEvent, "c": FailedEvent}
+	started := make(map[string]bool)
+	finishOrder := make([]string, 0)
+	for _, event := range events {
+		switch event.Type {
+		case StartedEvent:
+			started[event.Name] = true
+		default:
+			if !started[event.Name] {
+				t.Fatal(event.Name, event.Type, "before it started")
+			}
+			if event.Type != expected[event.Name] {
+				t.Fatal(event.Name, "should have", expected[event.Name], "but", event.Type)
+			}
+			if event.Cached {
+				t.Fatal(event.Name, "should not be cached on the first run")
+			}
+			finishOrder = append(finishOrder, event.Name)
+		}
+	}
+	if len(finishOrder) != 3 {
+		t.Fatal("Expected 3 results but got", finishOrder)
+	}
+	aIndex := slices.Index(finishOrder, "a")
+	bIndex := slices.Index(finishOrder, "b")
+	if aIndex > bIndex {
+		t.Fatal("b finished before a:", finishOrder)
+	}
+
+	// Nothing changed so every result should come from the cache
+	events = events[:0]
+	if _, err := goKernel.Update(context.Background(), input); err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if len(events) != 3 {
+		t.Fatal("Expected 3 events but got", events)
+	}
+	for _, event := range events {
+		if !event.Cached || event.Type == StartedEvent {
+			t.Fatal("Expected a cached result but got", event)
+		}
+	}
+}
+
+func TestListenerAddsListener(t *testing.T) {
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	var once sync.Once
+	added := make(chan Event, 10)
+	goKernel.AddListener(func(event Event) {
+		once.Do(func() {
+			goKernel.AddListener(func(event Event) {
+				added <- event
+			})
+		})
+	})
+
+	// The listener added from a callback gets the events after it
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := goKernel.Update(ctx, map[string]*Formula{"a": {Code: "return 1"}}); err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	select {
+	case event := <-added:
+		if event.Name != "a" {
+			t.Fatal("Unexpected event:", event)
+		}
+	default:
+		t.Fatal("The added listener got no events")
+	}
+}
+
+// fakeTicker stands in for the ticker behind every so that tests decide
+// when it ticks
+type fakeTicker struct {
+	ticks   chan time.Time
+	stopped chan struct{}
+}
+
+func newFakeTicker() *fakeTicker {
+	return &fakeTicker{ticks: make(chan time.Time), stopped: make(chan struct{})}
+}
+
+func (f *fakeTicker) start(interval time.Duration) (<-chan time.Time, func()) {
+	return f.ticks, func() { close(f.stopped) }
+}
+
+func TestContinuous(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["counter"] = &Formula{
+		Code:       "n := 0\nemit(n)\nfor range every(time.Second) {\n\tn++\n\temit(n)\n}\nreturn -1",
+		Imports:    []string{"time"},
+		Continuous: true,
+	}
+	input["doubled"] = &Formula{Code: "return counter * 2"}
+	ticker := newFakeTicker()
+	goKernel := NewLocalKernel()
+	defer goKernel.Close()
+	goKernel.newTicker = ticker.start
+	events := make(chan Event, 100)
+	goKernel.AddListener(func(event Event) {
+		events <- event
+	})
+
+	// The first value is the result of the update
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["counter"].Value != 0 || output["doubled"].Value != 0 {
+		t.Fatal("counter and doubled should start at 0 but got", output["counter"], output["doubled"])
+	}
+
+	// Each tick emits a value that runs doubled again
+	waitFor := func(name string, value any) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case event := <-events:
+				if event.Name == name && event.Type == FinishedEvent && event.Result.Value == value {
+					return
+				}
+			case <-timeout:
+				t.Fatal(name, "never finished with", value)
+			}
+		}
+	}
+	for n := 1; n <= 2; n++ {
+		ticker.ticks <- time.Now()
+		waitFor("doubled", n*2)
+	}
+
+	// An update keeps the formula running with its latest value
+	output, err = goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["counter"].Value != 2 || output["doubled"].Value != 4 {
+		t.Fatal("counter should still be 2 but got", output["counter"], output["doubled"])
+	}
+	ticker.ticks <- time.Now()
+	waitFor("doubled", 6)
+
+	// Stopping the formula stops the ticker and keeps the last value
+	goKernel.StopFormula("counter")
+	select {
+	case <-ticker.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The ticker wasn't stopped")
+	}
+	if result := goKernel.cache["counter"].result; result.Value != 3 {
+		t.Fatal("counter should keep the value 3 but has", result)
+	}
+}
+
+func TestContinuousTimeout(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["silent"] = &Formula{
+		Code:       "for range every(time.Second) {\n}\nreturn 1",
+		Imports:    []string{"time"},
+		Continuous: true,
+		Limits:     Limits{Timeout: 100 * time.Millisecond},
+	}
+	input["after"] = &Formula{Code: "return silent"}
+	ticker := newFakeTicker()
+	goKernel := NewLocalKernel()
+	defer goKernel.Close()
+	goKernel.newTicker = ticker.start
+
+	// A formula that never emits times out instead of holding up the update
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	output, err := goKernel.Update(ctx, input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["silent"].Status != StatusTimeout || output["after"].Status != StatusSkipped {
+		t.Fatal("silent should time out but got", output["silent"], output["after"])
+	}
+	select {
+	case <-ticker.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The formula wasn't stopped")
+	}
+}
+
+func TestRendering(t *testing.T) {
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	goKernel.SetPrelude(`type Row struct {
+	Name  string
+	Count int
+}`)
+	input := make(map[string]*Formula)
+	input["rate"] = &Formula{Code: "return 0.1234", Display: render.Options{Percent: true, Rounded: true, Precision: 1}}
+	input["rows"] = &Formula{Code: `return []Row{{"a", 1200}, {"b", 3}}`, Display: render.Options{Thousands: true}}
+	input["when"] = &Formula{Code: "return time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)", Imports: []string{"time"}}
+	input["wait"] = &Formula{Code: "return 90 * time.Second", Imports: []string{"time"}}
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	expected := map[string]string{
+		"rate": "12.3%",
+		"rows": "Name  Count\n----  -----\na     1,200\nb     3",
+		"when": "2024-01-02",
+		"wait": "1m30s",
+	}
+	for name, text := range expected {
+		if output[name].Status != StatusOK || output[name].Text != text {
+			t.Fatalf("%s should be shown as %q but is %v", name, text, output[name])
+		}
+	}
+	if table := output["rows"].Rendering.Table; table == nil || len(table.Rows) != 2 {
+		t.Fatal("rows should be rendered as a table but has", output["rows"].Rendering)
+	}
+
+	// Changing the display options renders the cached results again
+	var mutex sync.Mutex
+	events := make([]Event, 0)
+	goKernel.AddListener(func(event Event) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		events = append(events, event)
+	})
+	input["rate"].Display = render.Options{}
+	input["rows"].Display = render.Options{}
+	output, err = goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["rate"].Text != "0.1234" || output["rows"].Rendering.Table.Rows[0][1] != "1200" {
+		t.Fatal("Unexpected results after changing the display:", output["rate"], output["rows"])
+	}
+	for _, event := range events {
+		if !event.Cached {
+			t.Fatal("Nothing should run again but got", event)
+		}
+	}
+}
+
+func TestRenderMethod(t *testing.T) {
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	goKernel.SetPrelude(`import "strconv"
+
+type Money int
+
+func (m Money) Render() string {
+	return "$" + strconv.Itoa(int(m))
+}
+
+type Box struct{ N int }
+
+func (b *Box) Render() string {
+	return "box of " + strconv.Itoa(b.N)
+}`)
+	input := make(map[string]*Formula)
+	input["box"] = &Formula{Code: "if true {\n\treturn &Box{3}\n}\nreturn &Box{4}"}
+	input["price"] = &Formula{Code: "return Money(5)", Display: render.Options{Thousands: true}}
+	input["prices"] = &Formula{Code: "return Money(2), 3", Type: "(low Money, count int)"}
+	input["label"] = &Formula{Code: "type Label string\nreturn Label(\"x\")"}
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["price"].Text != "$5" || !output["price"].Rendering.Custom {
+		t.Fatal("price should render itself as $5 but has", output["price"])
+	}
+	if output["box"].Text != "box of 3" {
+		t.Fatal("box should render itself as box of 3 but has", output["box"])
+	}
+	if outputs := output["prices"].Outputs; len(outputs) != 2 || outputs[1].Name != "low" || outputs[1].Text != "$2" || outputs[0].Text != "3" {
+		t.Fatal("low should render itself as $2 but got", outputs)
+	}
+	if output["label"].Text != "x" || output["label"].Rendering.Custom {
+		t.Fatal("label has no Render method but has", output["label"])
+	}
+
+	// Changing the display options keeps what the values rendered
+	input["prices"].Display = render.Options{Thousands: true}
+	output, err = goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["price"].Text != "$5" || output["prices"].Outputs[1].Text != "$2" {
+		t.Fatal("Custom renderings were lost:", output["price"], output["prices"].Outputs)
+	}
+}
+
+func TestFindDependencies(t *testing.T) {
+	formulas := map[string]*Formula{"a": {}, "b": {}, "c": {}, "d": {}}
+	code := `x := a + Pi
+s := "b"
+// c
+f := func(d int) int { return d * 2 }
+return f(x) + len(s) + missing`
+	known := project{dotImportMath: true}.knownSymbols()
+	dependencies, warnings := findDependencies(&Formula{Code: code}, formulas, known)
+	if !slices.Equal(dependencies, []string{"a"}) {
+		t.Fatal("Expected dependencies [a] but got", dependencies)
+	}
+	if !slices.Equal(warnings, []string{`undefined name "missing"`}) {
+		t.Fatal("Unexpected warnings:", warnings)
+	}
+}
+
+func TestAutoDependencies(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return 2"}
+	input["b"] = &Formula{Code: "return a * 3"}
+	input["c"] = &Formula{Code: "a := 5\nreturn a"}
+	input["d"] = &Formula{Code: "return b + missing"}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	for name, expected := range map[string]string{"b": "6", "c": "5"} {
+		if output[name].Text != expected {
+			t.Fatal(name, "should be", expected, "but is", output[name])
+		}
+	}
+	if !slices.Equal(output["d"].Warnings, []string{`undefined name "missing"`}) {
+		t.Fatal("d should warn about missing but has", output["d"].Warnings)
+	}
+
+	// A manual list overrides the dependencies found in the code
+	input["b"] = &Formula{Code: "return a * 3", Dependencies: []string{}}
+	output, err = goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["b"].Status != StatusCompileError {
+		t.Fatal("b should fail without a but has", output["b"])
+	}
+}
+
+func TestRenameReferences(t *testing.T) {
+	cases := []struct {
+		code     string
+		expected string
+	}{
+		{"return a + 1", "return b + 1"},
+		{"return a + a", "return b + b"},
+		{`s := "a" // a` + "\nreturn a", `s := "a" // a` + "\nreturn b"},
+		{"f := func(a int) int { return a }\nreturn f(a)", "f := func(a int) int { return a }\nreturn f(b)"},
+		{"x := c.a\nreturn x", "x := c.a\nreturn x"},
+	}
+	for _, c := range cases {
+		renamed, err := RenameReferences(c.code, "a", "b")
+		if err != nil {
+			t.Fatalf("RenameReferences(%q) returned error: %v", c.code, err)
+		}
+		if renamed != c.expected {
+			t.Fatalf("RenameReferences(%q) returned %q instead of %q", c.code, renamed, c.expected)
+		}
+	}
+
+	// A local b would capture the renamed reference
+	code := "b := 1\nreturn a + b"
+	if renamed, err := RenameReferences(code, "a", "b"); err == nil {
+		t.Fatal("RenameReferences should have failed but returned", renamed)
+	}
+
+	// Code that doesn't parse is only a problem when it uses the name
+	code = "x := (1 +\nreturn x"
+	if renamed, err := RenameReferences(code, "a", "b"); err != nil || renamed != code {
+		t.Fatal("Unrelated broken code should be left alone but got", renamed, err)
+	}
+	if renamed, err := RenameReferences("return (a +", "a", "b"); err == nil {
+		t.Fatal("RenameReferences should have failed but returned", renamed)
+	}
+}
+
+func TestOutput(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: `fmt.Println("hello")
+fmt.Print("a is ", 1)
+return 1`, Imports: []string{"fmt"}}
+	input["b"] = &Formula{Code: `log.SetFlags(0)
+log.Println("b ran")
+panic("boom")`, Imports: []string{"log"}}
+	input["c"] = &Formula{Code: `for i := 0; i < 10000; i++ {
+	fmt.Println("0123456789")
+}
+return 3`, Imports: []string{"fmt"}}
+	input["quiet"] = &Formula{Code: "return a"}
+	input["files"] = &Formula{Code: `os.Stdout.WriteString("to stdout\n")
+fmt.Fprint(os.Stderr, "to stderr")
+return 4`, Imports: []string{"fmt", "os"}}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	goKernel.SetParallelism(1)
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	expected := map[string]string{"a": "hello\na is 1", "b": "b ran\n", "quiet": "", "files": "to stdout\nto stderr"}
+	for name, printed := range expected {
+		if output[name].Output != printed {
+			t.Fatalf("%s should have printed %q but printed %q", name, printed, output[name].Output)
+		}
+	}
+	if c := output["c"].Output; len(c) != maxOutput+len(truncatedNote) || !strings.HasSuffix(c, truncatedNote) {
+		t.Fatal("c should have its output truncated but printed", len(c), "bytes")
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["sales"] = &Formula{Code: "return []int{10, 20, 30}"}
+	input["total"] = &Formula{Code: "=SUM(sales) * 1.2", Language: LanguageExpression}
+	input["half"] = &Formula{Code: "return total / 2"}
+	input["label"] = &Formula{Code: `=IF(half > 30, "big", "small") & " " & total`, Language: LanguageExpression}
+	input["zero"] = &Formula{Code: "return 0"}
+	input["ratio"] = &Formula{Code: "total / zero", Language: LanguageExpression}
+	input["afterRatio"] = &Formula{Code: "ratio + 1", Language: LanguageExpression}
+	input["spaced"] = &Formula{Code: "=1 +\n  2 $", Language: LanguageExpression}
+	for kernelName, output := range updateEachKernel(t, input, nil) {
+		for name, expected := range map[string]any{"total": 72.0, "half": 36.0, "label": "big 72"} {
+			if output[name].Status != StatusOK || output[name].Value != expected {
+				t.Fatal(kernelName, name, "should be", expected, "but is", output[name])
+			}
+		}
+		if output["ratio"].Status != StatusError || output["ratio"].Error != "#DIV/0! division by zero" {
+			t.Fatal(kernelName, "ratio should fail with #DIV/0! but has", output["ratio"])
+		}
+		if output["afterRatio"].Status != StatusSkipped {
+			t.Fatal(kernelName, "afterRatio should have been skipped but has", output["afterRatio"])
+		}
+		spaced := output["spaced"]
+		if spaced.Status != StatusCompileError || len(spaced.CompileErrors) != 1 ||
+			spaced.CompileErrors[0] != (CompileError{2, 5, "unexpected character '$'"}) {
+			t.Fatal(kernelName, "spaced should have a compile error on line 2 but has", spaced)
+		}
+	}
+}
+
+func TestRenameExpressionReferences(t *testing.T) {
+	formula := Formula{Code: `=SUM(sales) & " sales"`, Language: LanguageExpression}
+	renamed, err := formula.RenameReferences("sales", "orders")
+	if err != nil {
+		t.Fatal("RenameReferences returned error:", err)
+	}
+	if renamed != `=SUM(orders) & " sales"` {
+		t.Fatal("Unexpected rename:", renamed)
+	}
+
+	// Expressions that don't parse are only a problem when they use the name
+	broken := Formula{Code: "=SUM(total", Language: LanguageExpression}
+	if renamed, err := broken.RenameReferences("sales", "orders"); err != nil || renamed != broken.Code {
+		t.Fatal("Unrelated broken expression should be left alone but got", renamed, err)
+	}
+	broken.Code = "=SUM(sales.mean"
+	if renamed, err := broken.RenameReferences("sales", "orders"); err == nil {
+		t.Fatal("RenameReferences should have failed but returned", renamed)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["parsed"] = &Formula{Code: `return strconv.Atoi("12")`, Imports: []string{"strconv"}, Type: "(int, error)"}
+	input["doubled"] = &Formula{Code: "return parsed * 2"}
+	input["bad"] = &Formula{Code: "n, err := strconv.Atoi(\"x\")\nif err != nil {\n\treturn nil, err\n}\nreturn n, nil", Imports: []string{"strconv"}}
+	input["afterBad"] = &Formula{Code: "return bad"}
+	input["fallback"] = &Formula{
+		Code:        "if err := upstreamErrors[\"bad\"]; err != nil {\n\treturn \"fallback: \" + err.Error()\n}\nreturn bad",
+		CatchErrors: true,
+	}
+	input["reason"] = &Formula{Code: `return upstreamErrors["afterBad"].Error()`, CatchErrors: true, Dependencies: []string{"afterBad"}}
+	input["safe"] = &Formula{Code: "IFERROR(bad * 2, -1)", Language: LanguageExpression, CatchErrors: true}
+	input["unsafe"] = &Formula{Code: "bad * 2", Language: LanguageExpression, CatchErrors: true}
+	input["broken"] = &Formula{Code: "return missing"}
+	input["afterBroken"] = &Formula{Code: "if upstreamErrors[\"broken\"] != nil {\n\treturn 0\n}\nreturn broken", CatchErrors: true}
+	badError := `strconv.Atoi: parsing "x": invalid syntax`
+	expected := map[string]*Result{
+		"doubled":     {Status: StatusOK, Text: "24"},
+		"bad":         {Status: StatusError, Error: badError},
+		"afterBad":    {Status: StatusSkipped, Error: "upstream failed: bad"},
+		"fallback":    {Status: StatusOK, Text: "fallback: bad failed: " + badError},
+		"reason":      {Status: StatusOK, Text: "upstream failed: bad"},
+		"safe":        {Status: StatusOK, Text: "-1"},
+		"unsafe":      {Status: StatusError, Error: "#N/A bad failed: " + badError},
+		"afterBroken": {Status: StatusOK, Text: "0"},
+	}
+	for kernelName, output := range updateEachKernel(t, input, nil) {
+		for name, result := range expected {
+			if output[name].Status != result.Status || output[name].Text != result.Text || output[name].Error != result.Error {
+				t.Errorf("%s %s should be %v but is %v", kernelName, name, result, output[name])
+			}
+		}
+		if len(output["fallback"].Warnings) > 0 {
+			t.Error(kernelName, "upstreamErrors shouldn't be an undefined name:", output["fallback"].Warnings)
+		}
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"x", "total_2", "Sales"} {
+		if err := ValidateName(name); err != nil {
+			t.Fatal(name, "should be valid but got", err)
+		}
+	}
+	for _, name := range []string{"", "_", "2x", "a-b", "func", "range", "int", "nil", "len", "Pi", "Pow", "params", "Outputs", "upstreamErrors", "emit", "every"} {
+		if err := ValidateName(name); err == nil {
+			t.Fatal(name, "should not be valid")
+		}
+	}
+}
+
+func TestStructDependencies(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["points"] = &Formula{Code: `type Point struct { X, Y float64 }
+return []Point{{1, 2}, {3, 4}}`}
+	input["total"] = &Formula{Code: `total := 0.0
+for _, p := range points {
+	total += p.X + p.Y
+}
+return total`}
+	input["items"] = &Formula{Code: `type Item struct { Name string; Count int }
+return map[string]Item{"x": {"x", 2}}`}
+	input["count"] = &Formula{Code: `return items["x"].Count * 2`}
+	expected := map[string]string{"total": "10", "count": "4"}
+	checkUpdate(t, input, expected)
+}
+
+func TestDeclaredType(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return 2", Type: "float64"}
+	input["b"] = &Formula{Code: "return a / 4"}
+	input["empty"] = &Formula{Code: "return nil", Type: "[]int"}
+	input["length"] = &Formula{Code: "return len(empty)"}
+	expected := map[string]string{"a": "2", "b": "0.5", "length": "0"}
 	checkUpdate(t, input, expected)
+
+	// The result has to match the declared type
+	input["wrong"] = &Formula{Code: `return "text"`, Type: "int"}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["wrong"].Status != StatusCompileError {
+		t.Fatal("wrong should not compile but has", output["wrong"])
+	}
+}
+
+func TestTypeWriter(t *testing.T) {
+	cases := []struct {
+		value    any
+		expected string
+	}{
+		{1, "int"},
+		{[]string{}, "[]string"},
+		{map[string][]float64{}, "map[string][]float64"},
+		{struct{ X, Y int }{}, "struct{X int; Y int}"},
+		{time.Time{}, "_time.Time"},
+		{errors.New("failed"), "error"},
+		{struct{ x int }{}, ""},
+		{nil, ""},
+	}
+	for _, c := range cases {
+		writer := typeWriter{imports: make(map[string]bool)}
+		if written := writer.valueType(c.value).expr; written != c.expected {
+			t.Fatalf("Type of %#v written as %q instead of %q", c.value, written, c.expected)
+		}
+	}
+	writer := typeWriter{imports: make(map[string]bool)}
+	writer.valueType([]time.Duration{})
+	if imports := writer.sortedImports(); !slices.Equal(imports, []string{"time"}) {
+		t.Fatal("Expected time to be imported but imports are", imports)
+	}
+}
+
+func TestPrelude(t *testing.T) {
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	goKernel.SetPrelude(`import (
+	"strings"
+	"time"
+)
+
+type Point struct{ X, Y float64 }
+
+const scale = 2
+
+func mean(values ...float64) float64 {
+	total := 0.0
+	for _, value := range values {
+		total += value
+	}
+	return total / float64(len(values))
+}`)
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return mean(1, 2, 3) * scale"}
+	input["b"] = &Formula{Code: `return strings.ToUpper("b")`}
+	input["points"] = &Formula{Code: "return []Point{{1, 2}, {3, 4}}"}
+	input["total"] = &Formula{Code: "return points[1].X + points[1].Y"}
+	input["start"] = &Formula{Code: "return time.Unix(0, 0).UTC()"}
+	input["year"] = &Formula{Code: "return start.Year()"}
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	for name, expected := range map[string]string{"a": "4", "b": "B", "total": "7", "year": "1970"} {
+		if output[name].Text != expected {
+			t.Fatal(name, "should be", expected, "but is", output[name])
+		}
+		if len(output[name].Warnings) != 0 {
+			t.Fatal(name, "should not have warnings but has", output[name].Warnings)
+		}
+	}
+
+	// Changing the prelude runs the formulas again
+	goKernel.SetPrelude("const scale = 3\nfunc mean(values ...float64) float64 { return values[0] }")
+	delete(input, "b")
+	delete(input, "points")
+	delete(input, "total")
+	delete(input, "start")
+	delete(input, "year")
+	output, err = goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["a"].Text != "3" {
+		t.Fatal("a should be 3 but is", output["a"])
+	}
+}
+
+func TestPreludeError(t *testing.T) {
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	goKernel.SetPrelude("const scale = 2\nfunc broken() int { return missing }")
+	input := map[string]*Formula{"a": {Code: "return 1"}}
+	_, err := goKernel.Update(context.Background(), input)
+	var preludeError *PreludeError
+	if !errors.As(err, &preludeError) {
+		t.Fatal("Expected a prelude error but got", err)
+	}
+	if len(preludeError.CompileErrors) != 1 || preludeError.CompileErrors[0].Line != 2 {
+		t.Fatal("Expected an error on line 2 but got", preludeError.CompileErrors)
+	}
+
+	// Fixing the prelude lets the formulas run
+	goKernel.SetPrelude("const scale = 2")
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["a"].Text != "1" {
+		t.Fatal("a should be 1 but is", output["a"])
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/data.txt", []byte("42"), 0o644); err != nil {
+		t.Fatal("Failed to write test data:", err)
+	}
+	input := make(map[string]*Formula)
+	input["read"] = &Formula{Code: `data, _ := os.ReadFile("data.txt")
+return string(data)`, Imports: []string{"os"}}
+	input["outside"] = &Formula{Code: `data, _ := os.ReadFile("../secret")
+return string(data)`, Imports: []string{"os"}}
+	input["write"] = &Formula{Code: `return os.WriteFile("data.txt", nil, 0644)`, Imports: []string{"os"}}
+	input["network"] = &Formula{Code: `return http.StatusText(200)`, Imports: []string{"net/http"}}
+	input["url"] = &Formula{Code: `u, _ := url.Parse("https://example.com/a")
+return u.Path`, Imports: []string{"net/url"}}
+
+	// Only computing is allowed by default
+	checkStatus := func(output map[string]*Result, expected map[string]Status) {
+		t.Helper()
+		for name, status := range expected {
+			if output[name].Status != status {
+				t.Fatal(name, "should have status", status, "but has", output[name])
+			}
+		}
+	}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	checkStatus(output, map[string]Status{
+		"read": StatusDenied, "outside": StatusDenied, "write": StatusDenied,
+		"network": StatusDenied, "url": StatusOK,
+	})
+	if output["write"].Error != "os.WriteFile is not allowed: "+reasonNever {
+		t.Fatal("Unexpected error for write:", output["write"].Error)
+	}
+	if output["network"].Error != `import "net/http" is not allowed: `+reasonNetwork {
+		t.Fatal("Unexpected error for network:", output["network"].Error)
+	}
+
+	// Files can be read under the project directory
+	goKernel.SetPolicy(Policy{ReadFiles: true, Dir: dir, Network: true})
+	output, err = goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	checkStatus(output, map[string]Status{
+		"read": StatusOK, "outside": StatusDenied, "write": StatusDenied,
+		"network": StatusOK, "url": StatusOK,
+	})
+	if output["read"].Text != "42" {
+		t.Fatal("read should be 42 but is", output["read"])
+	}
+
+	// The template packages are held to the project directory
+	if err := os.WriteFile(dir+"/hello.tmpl", []byte("hello {{.}}"), 0o644); err != nil {
+		t.Fatal("Failed to write test template:", err)
+	}
+	templates := map[string]*Formula{
+		"inside": {Code: `t, err := template.ParseFiles("hello.tmpl")
+if err != nil {
+	return err.Error()
+}
+var text strings.Builder
+t.Execute(&text, "there")
+return text.String()`, Imports: []string{"strings", "text/template"}},
+		"outside": {Code: `_, err := template.ParseFiles("../secret.tmpl")
+return err`, Imports: []string{"text/template"}},
+		"glob": {Code: `_, err := template.ParseGlob("/etc/*")
+return err`, Imports: []string{"html/template"}},
+	}
+	output, err = goKernel.Update(context.Background(), templates)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	checkStatus(output, map[string]Status{"inside": StatusOK, "outside": StatusDenied, "glob": StatusDenied})
+	if output["inside"].Text != "hello there" {
+		t.Fatal("inside should be hello there but is", output["inside"])
+	}
+
+	// Opened files can only be read
+	files := map[string]*Formula{
+		"open": {Code: `f, _ := os.Open("data.txt")
+defer f.Close()
+data, _ := io.ReadAll(f)
+return string(data)`, Imports: []string{"io", "os"}},
+		"chmod": {Code: `f, _ := os.Open("data.txt")
+return f.Chmod(0o777)`, Imports: []string{"os"}},
+		"chdir": {Code: `f, _ := os.Open(".")
+return f.Chdir()`, Imports: []string{"os"}},
+		"dirFS": {Code: `f, _ := os.DirFS(".").Open("data.txt")
+_, isOSFile := f.(*os.File)
+return isOSFile`, Imports: []string{"os"}},
+	}
+	output, err = goKernel.Update(context.Background(), files)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	checkStatus(output, map[string]Status{"open": StatusOK, "chmod": StatusCompileError, "chdir": StatusCompileError, "dirFS": StatusOK})
+	if output["open"].Text != "42" || output["dirFS"].Text != "false" {
+		t.Fatal("Unexpected results:", output["open"], output["dirFS"])
+	}
+	if info, err := os.Stat(dir + "/data.txt"); err != nil || info.Mode().Perm() != 0o644 {
+		t.Fatal("data.txt should not have been changed:", info.Mode(), err)
+	}
+
+	// The standard files and package variables of formulas are their own
+	goKernel.SetPolicy(Policy{})
+	args := strings.Join(os.Args, " ")
+	stdFiles := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	modes := make([]os.FileMode, len(stdFiles))
+	for index, file := range stdFiles {
+		info, err := file.Stat()
+		if err != nil {
+			t.Fatal("Failed to stat", file.Name(), err)
+		}
+		modes[index] = info.Mode()
+	}
+	variables := map[string]*Formula{
+		"assign": {Code: "os.Stdin = nil\nos.Stdout = nil\nos.Stderr = nil\nos.Args = nil\nreturn 1", Imports: []string{"os"}},
+		"close": {Code: `os.Stdin.Close()
+os.Stdout.Chmod(0o600)
+return os.Stdout.Close()`, Imports: []string{"os"}},
+	}
+	output, err = goKernel.Update(context.Background(), variables)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	checkStatus(output, map[string]Status{"assign": StatusOK, "close": StatusOK})
+	if os.Stdin != stdFiles[0] || os.Stdout != stdFiles[1] || os.Stderr != stdFiles[2] || strings.Join(os.Args, " ") != args {
+		t.Fatal("A formula changed the variables of package os:", os.Stdin, os.Stdout, os.Stderr, os.Args)
+	}
+	for index, file := range stdFiles {
+		if info, err := file.Stat(); err != nil || info.Mode() != modes[index] {
+			t.Fatal("A formula changed", file.Name(), err)
+		}
+	}
+	output, err = goKernel.Update(context.Background(), map[string]*Formula{
+		"print": {Code: `fmt.Print("still printing")
+return 1`, Imports: []string{"fmt"}},
+	})
+	if err != nil || output["print"].Output != "still printing" {
+		t.Fatal("Formulas should still print after one closed its output but got", output, err)
+	}
+
+	// The prelude is held to the policy too
+	goKernel.SetPrelude("import (\n\t\"strings\"\n\t\"net\"\n)")
+	_, err = goKernel.Update(context.Background(), map[string]*Formula{"a": {Code: "return 1"}})
+	var preludeError *PreludeError
+	if !errors.As(err, &preludeError) || preludeError.CompileErrors[0].Line != 3 {
+		t.Fatal("Expected a prelude error for net on line 3 but got", err)
+	}
+	if message := preludeError.CompileErrors[0].Message; message != `import "net" is not allowed: `+reasonNetwork {
+		t.Fatal("Unexpected prelude error:", message)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	input := make(map[string]*Formula)
+	input["runaway"] = &Formula{Code: `data := make([][]byte, 0)
+for {
+	data = append(data, make([]byte, 1<<20))
+}`}
+	input["after"] = &Formula{Code: "return runaway"}
+	input["fine"] = &Formula{Code: "return len(make([]byte, 1<<10))"}
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	goKernel.SetLimits(Limits{Timeout: 10 * time.Second, Memory: 64 << 20})
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["runaway"].Status != StatusLimitExceeded {
+		t.Fatal("runaway should have exceeded the memory limit but has", output["runaway"])
+	}
+	if output["after"].Status != StatusSkipped {
+		t.Fatal("after should have been skipped but has", output["after"])
+	}
+	if output["fine"].Text != "1024" {
+		t.Fatal("fine should be 1024 but has", output["fine"])
+	}
+}
+
+func TestGoroutineLimit(t *testing.T) {
+	spawn := func(count int, end string) *Formula {
+		return &Formula{
+			Code: `for n := 0; n < ` + strconv.Itoa(count) + `; n++ {
+	go func() {
+		for {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+}
+` + end,
+			Imports: []string{"time"},
+		}
+	}
+	input := make(map[string]*Formula)
+	input["runaway"] = spawn(100, "for {}")
+	input["leak"] = spawn(100, "return 1")
+	input["few"] = spawn(2, "return 2")
+	before := runtime.NumGoroutine()
+	goKernel := NewLocalKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	goKernel.SetParallelism(1)
+	goKernel.SetLimits(Limits{Timeout: 10 * time.Second, Goroutines: 10})
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	for _, name := range []string{"runaway", "leak"} {
+		if output[name].Status != StatusLimitExceeded {
+			t.Fatal(name, "should have exceeded the goroutine limit but has", output[name])
+		}
+	}
+	if output["few"].Text != "2" {
+		t.Fatal("few should be 2 but has", output["few"])
+	}
+
+	// Only the goroutines of the formula that stayed within the limit are left
+	goKernel.Close()
+	time.Sleep(50 * time.Millisecond)
+	if leaked := runtime.NumGoroutine() - before; leaked > 2 {
+		t.Fatal("Formulas left", leaked, "goroutines running")
+	}
+}
+
+func newTestCompiledKernel(t *testing.T) *CompiledKernel {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("The compiled kernel needs the go command:", err)
+	}
+	goKernel := NewCompiledKernel()
+	t.Cleanup(func() { goKernel.Close() })
+	return goKernel
+}
+
+func TestCompiledKernel(t *testing.T) {
+	goKernel := newTestCompiledKernel(t)
+	goKernel.SetPrelude(`type Point struct{ X, Y float64 }
+
+func mean(values ...float64) float64 {
+	total := 0.0
+	for _, value := range values {
+		total += value
+	}
+	return total / float64(len(values))
+}`)
+	goKernel.SetDotImportMath(true)
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return 1"}
+	input["b"] = &Formula{Code: "return a + 2"}
+	input["root"] = &Formula{Code: "return Sqrt(float64(b) * 3)"}
+	input["typed"] = &Formula{Code: "return 2.5", Type: "float64"}
+	input["doubled"] = &Formula{Code: "return typed * 2"}
+	input["words"] = &Formula{Code: `return strings.Repeat("x", b)`, Imports: []string{"strings", "time"}}
+	input["points"] = &Formula{Code: "return []Point{{1, 2}, {mean(1, 5), 4}}"}
+	input["total"] = &Formula{Code: "return points[1].X + points[1].Y"}
+	input["broken"] = &Formula{Code: "x := 1\nreturn a + missing"}
+	input["afterBroken"] = &Formula{Code: "return broken"}
+	input["panics"] = &Formula{Code: "var values []int\nreturn values[a]"}
+	input["afterPanic"] = &Formula{Code: "return panics"}
+	input["files"] = &Formula{Code: `return os.Getpid()`, Imports: []string{"os"}}
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	for name, expected := range map[string]string{"b": "3", "root": "3", "doubled": "5", "words": "xxx", "total": "7"} {
+		if output[name].Status != StatusOK || output[name].Text != expected {
+			t.Fatal(name, "should be", expected, "but is", output[name])
+		}
+	}
+	if output["total"].Value != 7.0 {
+		t.Fatal("total should have the value 7 but has", output["total"].Value)
+	}
+
+	// Each failing formula gets its own result
+	broken := output["broken"]
+	if broken.Status != StatusCompileError || len(broken.CompileErrors) != 2 || broken.CompileErrors[1].Line != 2 {
+		t.Fatal("broken should have compile errors on lines 1 and 2 but has", broken)
+	}
+	expected := map[string]Status{
+		"afterBroken": StatusSkipped,
+		"panics":      StatusPanic,
+		"afterPanic":  StatusSkipped,
+		"files":       StatusDenied,
+	}
+	for name, status := range expected {
+		if output[name].Status != status {
+			t.Fatal(name, "should have status", status, "but has", output[name])
+		}
+	}
+}
+
+func TestCompiledKernelEvaluate(t *testing.T) {
+	goKernel := newTestCompiledKernel(t)
+	input := make(map[string]*Formula)
+	input["a"] = &Formula{Code: "return 1"}
+	input["b"] = &Formula{Code: "return a + 1"}
+	input["broken"] = &Formula{Code: "return missing"}
+	output, err := goKernel.Evaluate(context.Background(), input, "b")
+	if err != nil {
+		t.Fatal("Evaluate returned error:", err)
+	}
+	if len(output) != 2 || output["b"].Text != "2" {
+		t.Fatal("Only a and b should have been built but got", output)
+	}
+}
+
+func TestCompiledKernelRendering(t *testing.T) {
+	goKernel := newTestCompiledKernel(t)
+	goKernel.SetPrelude(`import "strconv"
+
+type Money int
+
+func (m Money) Render() string {
+	return "$" + strconv.Itoa(int(m))
+}`)
+	input := make(map[string]*Formula)
+	input["price"] = &Formula{Code: "return Money(5)"}
+	input["rate"] = &Formula{Code: "return 1234.5", Display: render.Options{Thousands: true}}
+	input["rows"] = &Formula{Code: "return [][]int{{1, 2}, {3, 4}}"}
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	expected := map[string]string{"price": "$5", "rate": "1,234.5", "rows": "1  2\n3  4"}
+	for name, text := range expected {
+		if output[name].Status != StatusOK || output[name].Text != text {
+			t.Fatalf("%s should be shown as %q but is %v", name, text, output[name])
+		}
+	}
+	if !output["price"].Rendering.Custom || output["rows"].Rendering.Table == nil {
+		t.Fatal("Unexpected renderings:", output["price"].Rendering, output["rows"].Rendering)
+	}
+}
+
+func TestCompiledKernelTimeout(t *testing.T) {
+	goKernel := newTestCompiledKernel(t)
+	input := make(map[string]*Formula)
+	input["loop"] = &Formula{Code: "for {}", Limits: Limits{Timeout: 100 * time.Millisecond}}
+	input["after"] = &Formula{Code: "return loop"}
+	input["fast"] = &Formula{Code: "return 1"}
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	expected := map[string]Status{"loop": StatusTimeout, "after": StatusSkipped, "fast": StatusOK}
+	for name, status := range expected {
+		if output[name].Status != status {
+			t.Fatal(name, "should have status", status, "but has", output[name])
+		}
+	}
+
+	// Stopping kills the program
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		goKernel.Stop()
+	}()
+	input["loop"].Limits = Limits{}
+	output, err = goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["loop"].Status != StatusCancelled {
+		t.Fatal("loop should have been cancelled but has", output["loop"])
+	}
+}
+
+func TestProgramStatuses(t *testing.T) {
+	// Only formulas that succeeded have a value
+	for name, status := range programStatuses {
+		message := programMessage{Status: name, Value: json.RawMessage("1")}
+		expected := any(nil)
+		if status == StatusOK {
+			expected = 1.0
+		}
+		if result := message.result(); result.Status != status || result.Value != expected {
+			t.Fatal(name, "should give status", status, "and value", expected, "but gives", result)
+		}
+	}
+
+	// A status or a value from a program that doesn't match the kernel
+	// fails the formula
+	message := programMessage{Status: "cancelled", Value: json.RawMessage("1")}
+	result := message.result()
+	if result.Status != StatusPanic || !strings.Contains(result.Error, `"cancelled"`) {
+		t.Fatal("An unknown status should fail but gives", result)
+	}
+	message = programMessage{Status: "ok", Value: json.RawMessage("{")}
+	result = message.result()
+	if result.Status != StatusPanic || result.Value != nil || !strings.Contains(result.Error, "can't be decoded") {
+		t.Fatal("A value that can't be decoded should fail but gives", result)
+	}
 }
@@ -0,0 +1,159 @@
+// Package kerneltest provides a fake kernel for testing code that runs
+// formulas without running any of them.
+package kerneltest
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/lrdickson/calx/internal/kernel"
+)
+
+// Kernel is a kernel.Kernel that returns canned results and records what it
+// was asked to do. Formulas without a canned result succeed with their code
+// as the value. The recorded fields are guarded by Mutex.
+type Kernel struct {
+	Mutex sync.Mutex
+
+	// Results are returned by Update for the formulas of the same name
+	Results map[string]*kernel.Result
+
+	// Updates are the formulas passed to each call of Update
+	Updates []map[string]*kernel.Formula
+
+	// Evaluations are the names passed to each call of Evaluate. Their
+	// formulas are added to Updates.
+	Evaluations []string
+
+	Prelude       string
+	DotImportMath bool
+	Policy        kernel.Policy
+	Limits        kernel.Limits
+	Parallelism   int
+	Renames       [][2]string
+	Stops         int
+	Closed        bool
+
+	// StoppedFormulas are the names passed to each call of StopFormula
+	StoppedFormulas []string
+
+	listeners []func(kernel.Event)
+}
+
+var _ kernel.Kernel = (*Kernel)(nil)
+
+func New() *Kernel {
+	return &Kernel{Results: make(map[string]*kernel.Result)}
+}
+
+// Update reports every formula as started and then finished, in order of
+// their names
+func (k *Kernel) Update(ctx context.Context, formulas map[string]*kernel.Formula) (map[string]*kernel.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	k.Mutex.Lock()
+	if k.Closed {
+		k.Mutex.Unlock()
+		return nil, kernel.ErrClosed
+	}
+	k.Updates = append(k.Updates, formulas)
+	results := make(map[string]*kernel.Result)
+	for name, formula := range formulas {
+		result := kernel.Result{Value: formula.Code, Text: formula.Code}
+		if canned, exists := k.Results[name]; exists {
+			result = *canned
+		}
+		results[name] = &result
+	}
+	listeners := k.listeners
+	k.Mutex.Unlock()
+
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		eventType := kernel.FinishedEvent
+		if results[name].Status != kernel.StatusOK {
+			eventType = kernel.FailedEvent
+		}
+		for _, listener := range listeners {
+			listener(kernel.Event{Type: kernel.StartedEvent, Name: name})
+			listener(kernel.Event{Type: eventType, Name: name, Result: results[name]})
+		}
+	}
+	return results, nil
+}
+
+// Evaluate records the name and updates the formulas like Update does.
+// Dependencies aren't followed, so every formula is reported.
+func (k *Kernel) Evaluate(ctx context.Context, formulas map[string]*kernel.Formula, name string) (map[string]*kernel.Result, error) {
+	k.Mutex.Lock()
+	k.Evaluations = append(k.Evaluations, name)
+	k.Mutex.Unlock()
+	return k.Update(ctx, formulas)
+}
+
+func (k *Kernel) Stop() {
+	k.Mutex.Lock()
+	defer k.Mutex.Unlock()
+	k.Stops++
+}
+
+func (k *Kernel) StopFormula(name string) {
+	k.Mutex.Lock()
+	defer k.Mutex.Unlock()
+	k.StoppedFormulas = append(k.StoppedFormulas, name)
+}
+
+func (k *Kernel) RenameFormula(oldName, newName string) {
+	k.Mutex.Lock()
+	defer k.Mutex.Unlock()
+	k.Renames = append(k.Renames, [2]string{oldName, newName})
+}
+
+func (k *Kernel) SetPrelude(prelude string) {
+	k.Mutex.Lock()
+	defer k.Mutex.Unlock()
+	k.Prelude = prelude
+}
+
+func (k *Kernel) SetDotImportMath(enabled bool) {
+	k.Mutex.Lock()
+	defer k.Mutex.Unlock()
+	k.DotImportMath = enabled
+}
+
+func (k *Kernel) SetPolicy(policy kernel.Policy) {
+	k.Mutex.Lock()
+	defer k.Mutex.Unlock()
+	k.Policy = policy
+}
+
+func (k *Kernel) SetLimits(limits kernel.Limits) {
+	k.Mutex.Lock()
+	defer k.Mutex.Unlock()
+	k.Limits = limits
+}
+
+func (k *Kernel) SetParallelism(parallelism int) {
+	k.Mutex.Lock()
+	defer k.Mutex.Unlock()
+	k.Parallelism = parallelism
+}
+
+func (k *Kernel) AddListener(listener func(kernel.Event)) {
+	k.Mutex.Lock()
+	defer k.Mutex.Unlock()
+	k.listeners = append(k.listeners, listener)
+}
+
+func (k *Kernel) Close() error {
+	k.Mutex.Lock()
+	defer k.Mutex.Unlock()
+	k.Closed = true
+	return nil
+}
@@ -0,0 +1,167 @@
+package kernel
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// Limits bound the resources that a formula can use. Zero fields are
+// unlimited. Formulas run in the kernel process, so memory and goroutines
+// are measured for the whole process while the formula runs and can be
+// thrown off by other formulas running at the same time. A single huge
+// allocation can't be stopped before it happens.
+type Limits struct {
+	// Timeout is how long the formula can run
+	Timeout time.Duration
+
+	// Memory is how many bytes the heap can grow by while the formula runs
+	Memory uint64
+
+	// Goroutines is how many goroutines the formula can have running,
+	// including ones left running after it returns
+	Goroutines int
+}
+
+// limitInterval is how often the resources of a formula are checked
+const limitInterval = 5 * time.Millisecond
+
+// maxExitChecks is how many times to check that the goroutines of a stopped
+// formula have exited before moving on
+const maxExitChecks = 20
+
+// watchedCalls counts the formula calls being watched in the process. Each
+// one has a goroutine running the formula and one watching it, which are
+// left out of the goroutine count.
+var watchedCalls atomic.Int64
+
+// withDefaults returns the limits with the unset fields taken from defaults
+func (l Limits) withDefaults(defaults Limits) Limits {
+	if l.Timeout == 0 {
+		l.Timeout = defaults.Timeout
+	}
+	if l.Memory == 0 {
+		l.Memory = defaults.Memory
+	}
+	if l.Goroutines == 0 {
+		l.Goroutines = defaults.Goroutines
+	}
+	return l
+}
+
+// watched reports whether a formula's resources have to be checked
+func (l Limits) watched() bool {
+	return l.Memory > 0 || l.Goroutines > 0
+}
+
+// usage is the resources used by the process at one point
+type usage struct {
+	heap       uint64
+	goroutines int
+}
+
+func currentUsage() usage {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return usage{
+		heap:       sample[0].Value.Uint64(),
+		goroutines: runtime.NumGoroutine() - 2*int(watchedCalls.Load()),
+	}
+}
+
+// memoryExceeded describes how the heap grew past the limit since start,
+// or returns an empty string if it didn't
+func (l Limits) memoryExceeded(start, now usage) string {
+	if l.Memory == 0 || now.heap <= start.heap || now.heap-start.heap <= l.Memory {
+		return ""
+	}
+	return fmt.Sprintf("memory limit exceeded: heap grew by %.1f MiB, the limit is %.1f MiB",
+		float64(now.heap-start.heap)/(1<<20), float64(l.Memory)/(1<<20))
+}
+
+// goroutinesExceeded describes how the goroutines went past the limit
+// since start, or returns an empty string if they didn't
+func (l Limits) goroutinesExceeded(start, now usage) string {
+	running := now.goroutines - start.goroutines
+	if l.Goroutines == 0 || running <= l.Goroutines {
+		return ""
+	}
+	return fmt.Sprintf("goroutine limit exceeded: %d goroutines running, the limit is %d", running, l.Goroutines)
+}
+
+// watch starts checking the resources used by a formula. The returned
+// context is cancelled once a limit is exceeded on two checks in a row,
+// so short spikes from other formulas are let through. stop ends the
+// checks and returns why the formula was stopped, or an empty string if it
+// wasn't. The goroutines of a stopped formula are ended with
+// stopGoroutines.
+func (l Limits) watch(ctx context.Context, stopGoroutines func()) (watchCtx context.Context, stop func() string) {
+	watchCtx, cancel := context.WithCancel(ctx)
+	start := currentUsage()
+	watchedCalls.Add(1)
+	done := make(chan struct{})
+	reasons := make(chan string, 1)
+	go func() {
+		ticker := time.NewTicker(limitInterval)
+		defer ticker.Stop()
+		strikes := 0
+		for {
+			select {
+			case <-done:
+				reasons <- ""
+				return
+			case <-ticker.C:
+			}
+			now := currentUsage()
+			reason := l.memoryExceeded(start, now)
+			if reason == "" {
+				reason = l.goroutinesExceeded(start, now)
+			}
+			if reason == "" {
+				strikes = 0
+				continue
+			}
+			strikes++
+			if strikes == 2 {
+				cancel()
+				reasons <- reason
+				return
+			}
+		}
+	}()
+
+	return watchCtx, func() string {
+		close(done)
+		reason := <-reasons
+		watchedCalls.Add(-1)
+		cancel()
+
+		// Look for goroutines left running. The goroutine that ran the
+		// formula may still be exiting so they have to be seen twice. A
+		// formula stopped by the watcher already had its goroutines
+		// cancelled.
+		if reason == "" && l.goroutinesExceeded(start, currentUsage()) != "" {
+			time.Sleep(limitInterval)
+			reason = l.goroutinesExceeded(start, currentUsage())
+			if reason != "" {
+				stopGoroutines()
+			}
+		}
+		if reason == "" {
+			return ""
+		}
+
+		// Give the goroutines a moment to exit so that they aren't counted
+		// against the next formula
+		for check := 0; check < maxExitChecks; check++ {
+			if l.goroutinesExceeded(start, currentUsage()) == "" {
+				break
+			}
+			time.Sleep(limitInterval)
+		}
+		return reason
+	}
+}
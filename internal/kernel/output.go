@@ -0,0 +1,149 @@
+package kernel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxOutput is how much of what a formula prints is kept. A formula that
+// prints in a loop shouldn't be able to fill up the kernel's memory.
+const maxOutput = 64 * 1024
+
+// truncatedNote ends output that went past maxOutput
+const truncatedNote = "\n... output truncated\n"
+
+// outputBuffer collects what formulas print to stdout and stderr. Both go to
+// the same buffer so that they stay in the order they were printed.
+// Goroutines started by a formula can keep printing after it returns, so
+// writes are guarded by a mutex.
+type outputBuffer struct {
+	mutex     sync.Mutex
+	buffer    bytes.Buffer
+	truncated bool
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.truncated {
+		return len(p), nil
+	}
+	if room := maxOutput - b.buffer.Len(); len(p) > room {
+		b.buffer.Write(p[:room])
+		b.buffer.WriteString(truncatedNote)
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buffer.Write(p)
+}
+
+// take returns what was printed since the last call and empties the buffer
+func (b *outputBuffer) take() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	output := b.buffer.String()
+	b.buffer.Reset()
+	b.truncated = false
+	return output
+}
+
+// flushTimeout is how long take waits for what was written to an
+// outputFile to come through the pipe
+const flushTimeout = time.Second
+
+// outputFile is the *os.File formulas see as os.Stdout and os.Stderr, and
+// that fmt and log print to. Formulas can write to an *os.File directly,
+// so it is the write end of a pipe that a goroutine copies into a buffer.
+// The goroutine doesn't hold on to the file, so it ends once the file is
+// closed, at the latest when the interpreter is garbage collected.
+type outputFile struct {
+	file   *os.File
+	copied *pipeCopy
+}
+
+// pipeCopy is what the goroutine copying an outputFile shares with it.
+// marker is written to the pipe to find out when everything written before
+// it has been copied, and flushed gets a value each time it has.
+type pipeCopy struct {
+	buffer  outputBuffer
+	marker  []byte
+	flushed chan struct{}
+}
+
+func newOutputFile() (*outputFile, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	copied := &pipeCopy{
+		marker:  []byte("\x00calx-flush-" + hex.EncodeToString(nonce) + "\x00"),
+		flushed: make(chan struct{}, 1),
+	}
+	go copied.run(reader)
+	return &outputFile{file: writer, copied: copied}, nil
+}
+
+// run moves what is written to the pipe into the buffer, leaving out the
+// markers. The end of a read that could be the start of a marker is kept
+// until the next read.
+func (c *pipeCopy) run(reader *os.File) {
+	defer reader.Close()
+	var pending []byte
+	chunk := make([]byte, 32*1024)
+	for {
+		n, err := reader.Read(chunk)
+		pending = append(pending, chunk[:n]...)
+		for {
+			index := bytes.Index(pending, c.marker)
+			if index < 0 {
+				break
+			}
+			c.buffer.Write(pending[:index])
+			pending = pending[index+len(c.marker):]
+			select {
+			case c.flushed <- struct{}{}:
+			default:
+			}
+		}
+		keep := 0
+		for size := len(c.marker) - 1; size > 0; size-- {
+			if size <= len(pending) && bytes.HasSuffix(pending, c.marker[:size]) {
+				keep = size
+				break
+			}
+		}
+		c.buffer.Write(pending[:len(pending)-keep])
+		pending = append(pending[:0], pending[len(pending)-keep:]...)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Write is how fmt and log print to the file
+func (f *outputFile) Write(p []byte) (int, error) {
+	return f.file.Write(p)
+}
+
+// take returns what was written since the last call and empties the
+// buffer. After a formula closed the file, only what came through before
+// is returned.
+func (f *outputFile) take() string {
+	select {
+	case <-f.copied.flushed:
+	default:
+	}
+	if _, err := f.file.Write(f.copied.marker); err == nil {
+		select {
+		case <-f.copied.flushed:
+		case <-time.After(flushTimeout):
+		}
+	}
+	return f.copied.buffer.take()
+}
@@ -0,0 +1,226 @@
+package kernel
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lrdickson/calx/internal/kernel/render"
+)
+
+// Outputs are the named results of a formula that returns several, such
+// as return Outputs{"mean": m, "stdev": s}. Dependents read each output as
+// a field, such as stats.mean. Formulas can also declare named results in
+// Type, such as (mean, stdev float64), which are returned as Outputs.
+type Outputs map[string]any
+
+// Output is one of the named results of a formula
+type Output struct {
+	Name      string
+	Value     any
+	Text      string
+	Rendering render.Rendering
+}
+
+// renderOutputs renders each output of a value that holds Outputs, in
+// order of their names
+func renderOutputs(value any, options render.Options) []Output {
+	outputs, ok := value.(Outputs)
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(outputs))
+	for name := range outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rendered := make([]Output, 0, len(names))
+	for _, name := range names {
+		rendering := render.Render(outputs[name], options)
+		rendered = append(rendered, Output{name, outputs[name], rendering.Text, rendering})
+	}
+	return rendered
+}
+
+// namedResult is a named result declared by a formula
+type namedResult struct {
+	name       string
+	typeSource string
+}
+
+// formulaResults is what the function holding a Go formula returns
+type formulaResults struct {
+	// valueType is the type of the value. It is empty when the value is
+	// left as any.
+	valueType string
+
+	// returnsError is set for formulas that also return an error
+	returnsError bool
+
+	// outputs are the results declared by name, with declared holding
+	// the declaration. They don't include the error.
+	outputs  []namedResult
+	declared string
+}
+
+// results works out what a Go formula returns from its Type. Type can be
+// written as (T, error) or as a list of named results, the last of which
+// may be an error. Formulas without a Type return (any, error) when one of
+// their return statements returns two values.
+func (f *Formula) results() formulaResults {
+	if f.Type == "" {
+		return formulaResults{returnsError: returnsTwoValues(f.Code)}
+	}
+
+	// Refer to imported packages the way the formula code does
+	declared := strings.TrimPrefix(qualifyImports("var _ func() "+f.Type, f.Imports), "var _ func() ")
+	plain := formulaResults{valueType: declared}
+	expression, err := parser.ParseExpr("func() " + declared)
+	function, ok := expression.(*ast.FuncType)
+	if err != nil || !ok || function.Results == nil {
+		return plain
+	}
+	typeSource := func(node ast.Node) string {
+		offset := len("func() ") + 1
+		return declared[int(node.Pos())-offset : int(node.End())-offset]
+	}
+	fields := function.Results.List
+	last := fields[len(fields)-1]
+	errorIdent, _ := last.Type.(*ast.Ident)
+	endsWithError := errorIdent != nil && errorIdent.Name == "error"
+
+	// Unnamed results can only be a value and an error
+	if len(fields[0].Names) == 0 {
+		if len(fields) != 2 || !endsWithError {
+			return plain
+		}
+		return formulaResults{valueType: typeSource(fields[0].Type), returnsError: true}
+	}
+
+	results := formulaResults{declared: declared}
+	for _, field := range fields {
+		for _, name := range field.Names {
+			results.outputs = append(results.outputs, namedResult{name.Name, typeSource(field.Type)})
+		}
+	}
+	if endsWithError && len(last.Names) == 1 {
+		results.outputs = results.outputs[:len(results.outputs)-1]
+		results.returnsError = true
+	}
+	if len(results.outputs) == 0 {
+		return plain
+	}
+	return results
+}
+
+// resultNames returns the names of the results declared in Type, including
+// a named error. The code of the formula can use them as variables.
+func (f *Formula) resultNames() []string {
+	expression, err := parser.ParseExpr("func() " + f.Type)
+	function, ok := expression.(*ast.FuncType)
+	if f.Type == "" || err != nil || !ok || function.Results == nil {
+		return nil
+	}
+	var names []string
+	for _, field := range function.Results.List {
+		for _, name := range field.Names {
+			names = append(names, name.Name)
+		}
+	}
+	return names
+}
+
+// returnsTwoValues reports whether code has a return of two values outside
+// of function literals
+func returnsTwoValues(code string) bool {
+	file, err := parser.ParseFile(token.NewFileSet(), "", "package p\nfunc f() {\n"+code+"\n}", 0)
+	if err != nil {
+		return false
+	}
+	found := false
+	ast.Inspect(file, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ReturnStmt:
+			if len(node.Results) == 2 {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// source is the result list of the function holding the formula
+func (r formulaResults) source() string {
+	valueType := r.valueType
+	if valueType == "" {
+		valueType = "any"
+	}
+	switch {
+	case r.outputs != nil:
+		return r.declared
+	case r.returnsError:
+		return "(" + valueType + ", error)"
+	}
+	return valueType
+}
+
+// wrapped reports whether the results are turned into a single value by
+// the code that calls the function holding the formula
+func (r formulaResults) wrapped() bool {
+	return r.outputs != nil || r.returnsError
+}
+
+// resultVariables are the variables that the code calling the function
+// holding the formula assigns its results to, ending with err for formulas
+// that return an error, and the value built from them. outputsType is how
+// the Outputs type is written in that code.
+func (r formulaResults) resultVariables(outputsType string) ([]string, string) {
+	var variables []string
+	value := "value"
+	if r.outputs == nil {
+		variables = append(variables, value)
+	} else {
+		fields := make([]string, 0, len(r.outputs))
+		for index, output := range r.outputs {
+			variable := "r" + strconv.Itoa(index)
+			variables = append(variables, variable)
+			fields = append(fields, strconv.Quote(output.name)+": "+variable)
+		}
+		value = outputsType + "{" + strings.Join(fields, ", ") + "}"
+	}
+	if r.returnsError {
+		variables = append(variables, "err")
+	}
+	return variables, value
+}
+
+// outputsParamType is how a dependency with named outputs is unpacked. It
+// becomes a struct with a field for each output that is a Go identifier.
+func outputsParamType(outputs []namedResult, declared bool) paramType {
+	fields := make([]namedResult, 0, len(outputs))
+	for _, output := range outputs {
+		if token.IsIdentifier(output.name) {
+			fields = append(fields, output)
+		}
+	}
+	return paramType{declared: declared, outputs: fields}
+}
+
+// declaredParamType is how the value of a formula is unpacked by its
+// dependents when its Type says what it returns
+func declaredParamType(formula *Formula) paramType {
+	results := formula.results()
+	switch {
+	case results.outputs != nil:
+		return outputsParamType(results.outputs, true)
+	case results.valueType != "":
+		return paramType{expr: results.valueType, declared: true}
+	}
+	return paramType{}
+}
@@ -0,0 +1,326 @@
+package kernel
+
+import (
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/traefik/yaegi/interp"
+	"github.com/traefik/yaegi/stdlib"
+)
+
+// Policy is what the formulas of a project are allowed to do besides
+// computing. The zero Policy only allows computing, which is the safe
+// choice for projects from someone else.
+type Policy struct {
+	// ReadFiles lets formulas read the files under Dir. Relative paths are
+	// relative to Dir. Files are opened read only and without the methods
+	// of *os.File that change them or the process. The template packages
+	// are also allowed, only the ParseFiles and ParseGlob methods of
+	// templates can't be checked and can read files outside of Dir.
+	ReadFiles bool
+	Dir       string
+
+	// Network lets formulas make network connections
+	Network bool
+}
+
+// PolicyError is what a formula fails with when it uses something that the
+// project policy doesn't allow
+type PolicyError struct {
+	Name   string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Name + " is not allowed: " + e.Reason
+}
+
+const (
+	reasonNever     = "formulas can't write files or control the process"
+	reasonReadFiles = "the project policy doesn't allow reading files"
+	reasonOutside   = "the file is outside of the project directory"
+	reasonNetwork   = "the project policy doesn't allow network access"
+	reasonCompiled  = "compiled formulas can't be confined to the project policy"
+	reasonUnknown   = "it isn't a standard library package that formulas can use"
+)
+
+// neverPackages can't be imported under any policy
+var neverPackages = map[string]bool{
+	"debug/buildinfo": true,
+	"debug/elf":       true,
+	"debug/macho":     true,
+	"debug/pe":        true,
+	"debug/plan9obj":  true,
+	"go/build":        true,
+	"go/importer":     true,
+	"os/signal":       true,
+	"os/user":         true,
+	"runtime/debug":   true,
+	"runtime/pprof":   true,
+	"runtime/trace":   true,
+}
+
+// readPackages need the ReadFiles capability
+var readPackages = map[string]bool{
+	"html/template": true,
+	"text/template": true,
+}
+
+// offlinePackages are network packages that don't make connections
+var offlinePackages = map[string]bool{
+	"net/mail":  true,
+	"net/netip": true,
+	"net/url":   true,
+}
+
+// isNetworkPackage reports whether a package needs the Network capability
+func isNetworkPackage(importPath string) bool {
+	switch importPath {
+	case "crypto/tls", "expvar", "log/syslog", "net":
+		return true
+	}
+	return strings.HasPrefix(importPath, "net/") && !offlinePackages[importPath]
+}
+
+// guardedPackages are packages where only the functions listed in
+// safeFunctions and fileFunctions can be called
+var guardedPackages = map[string]bool{
+	"io/ioutil": true,
+	"os":        true,
+}
+
+// safeFunctions can be called under any policy. The environment functions
+// only see the environment of the interpreter.
+var safeFunctions = map[string]bool{
+	"io/ioutil.NopCloser": true,
+	"io/ioutil.ReadAll":   true,
+	"os.Clearenv":         true,
+	"os.Environ":          true,
+	"os.Expand":           true,
+	"os.ExpandEnv":        true,
+	"os.Getenv":           true,
+	"os.Getpagesize":      true,
+	"os.IsExist":          true,
+	"os.IsNotExist":       true,
+	"os.IsPathSeparator":  true,
+	"os.IsPermission":     true,
+	"os.IsTimeout":        true,
+	"os.LookupEnv":        true,
+	"os.NewSyscallError":  true,
+	"os.Setenv":           true,
+	"os.Unsetenv":         true,
+}
+
+// fileFunctions read the files named by their string arguments
+var fileFunctions = map[string]bool{
+	"archive/zip.OpenReader":     true,
+	"go/parser.ParseDir":         true,
+	"go/parser.ParseFile":        true,
+	"html/template.ParseFiles":   true,
+	"html/template.ParseGlob":    true,
+	"io/ioutil.ReadDir":          true,
+	"io/ioutil.ReadFile":         true,
+	"os.DirFS":                   true,
+	"os.Lstat":                   true,
+	"os.Open":                    true,
+	"os.ReadDir":                 true,
+	"os.ReadFile":                true,
+	"os.Stat":                    true,
+	"path/filepath.Abs":          true,
+	"path/filepath.EvalSymlinks": true,
+	"path/filepath.Glob":         true,
+	"path/filepath.Walk":         true,
+	"path/filepath.WalkDir":      true,
+	"text/template.ParseFiles":   true,
+	"text/template.ParseGlob":    true,
+}
+
+// readOnlyFunctions replace the file functions that hand out an *os.File
+var readOnlyFunctions = map[string]reflect.Value{
+	"os.DirFS": reflect.ValueOf(readOnlyDirFS),
+	"os.Open":  reflect.ValueOf(openReadOnly),
+}
+
+// importReason returns why a package can't be imported, or an empty string
+// if it can
+func (p Policy) importReason(importPath string) string {
+	switch {
+	case neverPackages[importPath]:
+		return reasonNever
+	case isNetworkPackage(importPath) && !p.Network:
+		return reasonNetwork
+	case readPackages[importPath] && !p.ReadFiles:
+		return reasonReadFiles
+	}
+	return ""
+}
+
+// checkImports returns a *PolicyError for the first package that can't be
+// imported
+func (p Policy) checkImports(imports []string) error {
+	for _, importPath := range imports {
+		if reason := p.importReason(importPath); reason != "" {
+			return &PolicyError{"import " + strconv.Quote(importPath), reason}
+		}
+	}
+	return nil
+}
+
+// hasGuardedFunctions reports whether a package has functions that are
+// checked while formulas run
+func hasGuardedFunctions(importPath string) bool {
+	if guardedPackages[importPath] {
+		return true
+	}
+	for name := range fileFunctions {
+		if strings.HasPrefix(name, importPath+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCompiledImports is checkImports for formulas that are compiled
+// instead of interpreted. Nothing is checked while compiled formulas run, so
+// they can only import the packages that the interpreter offers without
+// guarding any of their functions.
+func (p Policy) checkCompiledImports(imports []string) error {
+	for _, importPath := range imports {
+		reason := p.importReason(importPath)
+		switch {
+		case reason != "":
+		case hasGuardedFunctions(importPath):
+			reason = reasonCompiled
+		case stdlib.Symbols[importPath+"/"+path.Base(importPath)] == nil:
+			reason = reasonUnknown
+		}
+		if reason != "" {
+			return &PolicyError{"import " + strconv.Quote(importPath), reason}
+		}
+	}
+	return nil
+}
+
+// resolvePath makes a path used by a formula absolute and checks that it is
+// in the project directory. Symbolic links are followed so they can't point
+// out of the directory.
+func (p Policy) resolvePath(name string) (string, error) {
+	if p.Dir == "" {
+		return "", &PolicyError{strconv.Quote(name), reasonOutside}
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(p.Dir, name)
+	}
+	name = filepath.Clean(name)
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		resolved = name
+	}
+	dir, err := filepath.EvalSymlinks(p.Dir)
+	if err != nil {
+		dir = filepath.Clean(p.Dir)
+	}
+	relative, err := filepath.Rel(dir, resolved)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", &PolicyError{strconv.Quote(name), reasonOutside}
+	}
+	return name, nil
+}
+
+// denyFunction replaces a function with one that panics with a
+// *PolicyError
+func denyFunction(function reflect.Value, err *PolicyError) reflect.Value {
+	return reflect.MakeFunc(function.Type(), func([]reflect.Value) []reflect.Value {
+		panic(err)
+	})
+}
+
+// guardFiles wraps a function so that the paths it is called with have to
+// be in the project directory
+func (p Policy) guardFiles(function reflect.Value) reflect.Value {
+	resolve := func(arg reflect.Value) reflect.Value {
+		resolved, err := p.resolvePath(arg.String())
+		if err != nil {
+			panic(err)
+		}
+		return reflect.ValueOf(resolved).Convert(arg.Type())
+	}
+	return reflect.MakeFunc(function.Type(), func(args []reflect.Value) []reflect.Value {
+		for index, arg := range args {
+			switch {
+			case arg.Kind() == reflect.String:
+				args[index] = resolve(arg)
+			case arg.Kind() == reflect.Slice && arg.Type().Elem().Kind() == reflect.String:
+				resolved := reflect.MakeSlice(arg.Type(), arg.Len(), arg.Len())
+				for elemIndex := 0; elemIndex < arg.Len(); elemIndex++ {
+					resolved.Index(elemIndex).Set(resolve(arg.Index(elemIndex)))
+				}
+				args[index] = resolved
+			}
+		}
+		if function.Type().IsVariadic() {
+			return function.CallSlice(args)
+		}
+		return function.Call(args)
+	})
+}
+
+// copyVariable gives formulas their own copy of a package variable so that
+// assigning to it, or to an element of a slice such as os.Args, doesn't
+// change the variable of the kernel
+func copyVariable(value reflect.Value) reflect.Value {
+	copied := reflect.New(value.Type()).Elem()
+	if value.Kind() == reflect.Slice && !value.IsNil() {
+		elems := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+		reflect.Copy(elems, value)
+		value = elems
+	}
+	copied.Set(value)
+	return copied
+}
+
+// symbol returns what formulas get for a standard library symbol. The
+// standard files of package os are replaced by the interpreter.
+func (p Policy) symbol(importPath, name string, value reflect.Value) reflect.Value {
+	// Only functions are wrapped, variables are copied since they can be
+	// assigned to
+	if value.CanAddr() {
+		return copyVariable(value)
+	}
+	if value.Kind() != reflect.Func {
+		return value
+	}
+	key := importPath + "." + name
+	displayName := importName(importPath) + "." + name
+	switch {
+	case readOnlyFunctions[key].IsValid() && p.ReadFiles:
+		return p.guardFiles(readOnlyFunctions[key])
+	case fileFunctions[key] && p.ReadFiles:
+		return p.guardFiles(value)
+	case fileFunctions[key]:
+		return denyFunction(value, &PolicyError{displayName, reasonReadFiles})
+	case guardedPackages[importPath] && !safeFunctions[key]:
+		return denyFunction(value, &PolicyError{displayName, reasonNever})
+	}
+	return value
+}
+
+// symbols returns the standard library symbols that formulas can use
+func (p Policy) symbols() interp.Exports {
+	exports := make(interp.Exports)
+	for key, packageSymbols := range stdlib.Symbols {
+		importPath := path.Dir(key)
+		if p.importReason(importPath) != "" {
+			continue
+		}
+		allowed := make(map[string]reflect.Value, len(packageSymbols))
+		for name, value := range packageSymbols {
+			allowed[name] = p.symbol(importPath, name, value)
+		}
+		exports[key] = allowed
+	}
+	return exports
+}
@@ -0,0 +1,502 @@
+package kernel
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go/build"
+	"log"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lrdickson/calx/internal/kernel/clone"
+	"github.com/lrdickson/calx/internal/kernel/render"
+	"github.com/traefik/yaegi/interp"
+)
+
+// maxCompiled is how many formulas an interpreter holds before it is thrown
+// away. Old formulas can't be removed from an interpreter, so this keeps
+// edited projects from growing the interpreters forever.
+const maxCompiled = 256
+
+// formulaPackage is the package that the prelude and every formula are
+// compiled into so that formulas can use what the prelude declares
+const formulaPackage = "formulas"
+
+// panicTracePattern matches the positions yaegi prints to stderr when a
+// formula panics. They point into generated code so they are left out of
+// the output.
+var panicTracePattern = regexp.MustCompile(`(?:\d+:\d+: panic\n)+$`)
+
+// emptyStdin returns what formulas see as os.Stdin, a pipe that was closed
+// for writing. Each interpreter gets its own standard files so that a
+// formula closing or changing them affects nothing else.
+func emptyStdin() (*os.File, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	writer.Close()
+	return reader, nil
+}
+
+// interpreter is a long lived yaegi interpreter. Each formula is compiled
+// into its own function once and then called again with new parameters
+// until its code changes.
+type interpreter struct {
+	gointerp *interp.Interpreter
+	output   *outputFile
+	params   []any
+	compiled map[string]bool
+	imported map[string]bool
+
+	// failure is the error returned by the last formula, nil if it didn't
+	// return one
+	failure *string
+
+	// renderings are the texts that the values returned by the last
+	// formula rendered themselves as, by output name with "" for the whole
+	// value. Types declared in interpreted code lose their methods once
+	// they leave the interpreter so they are rendered inside it.
+	renderings map[string]string
+
+	// stdFiles are the variables formulas see as os.Stdin, os.Stdout and
+	// os.Stderr, and ownFiles the files the interpreter set them to
+	stdFiles []**os.File
+	ownFiles []*os.File
+
+	// emit and every are set while a continuous formula runs
+	emit  func(value any)
+	every func(interval time.Duration) <-chan time.Time
+}
+
+// newInterpreter starts an interpreter set up for a project. A
+// *PreludeError is returned if the prelude doesn't compile.
+func newInterpreter(p project) (*interpreter, error) {
+	// Start the interpreter with only what the policy allows. The
+	// environment of the kernel isn't passed on since it can hold secrets.
+	// What formulas print is captured instead of going to the kernel's
+	// stdout, and they read nothing from stdin, which can be the protocol
+	// stream of a kernel process.
+	output, err := newOutputFile()
+	if err != nil {
+		return nil, fmt.Errorf("failed to capture the output: %w", err)
+	}
+	gointerp := interp.New(interp.Options{
+		GoPath: build.Default.GOPATH,
+		Stdin:  strings.NewReader(""),
+		Stdout: output,
+		Stderr: output,
+	})
+	stdin, err := emptyStdin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up stdin: %w", err)
+	}
+	stdout, stderr := output.file, output.file
+	symbols := p.policy.symbols()
+	if osSymbols, allowed := symbols["os/os"]; allowed {
+		osSymbols["Stdin"] = reflect.ValueOf(&stdin).Elem()
+		osSymbols["Stdout"] = reflect.ValueOf(&stdout).Elem()
+		osSymbols["Stderr"] = reflect.ValueOf(&stderr).Elem()
+	}
+	if err := gointerp.Use(symbols); err != nil {
+		return nil, fmt.Errorf("failed to load the standard library: %w", err)
+	}
+
+	// Give the interpreter access to the function parameters
+	i := &interpreter{
+		gointerp: gointerp,
+		output:   output,
+		compiled: make(map[string]bool),
+		imported: make(map[string]bool),
+		stdFiles: []**os.File{&stdin, &stdout, &stderr},
+		ownFiles: []*os.File{stdin, output.file, output.file},
+	}
+	paramSymbols := interp.Exports{"calx/calx": {
+		"Params": reflect.ValueOf(func() []any { return i.params }),
+		"Fail":   reflect.ValueOf(func(message string) { i.failure = &message }),
+		"Rendered": reflect.ValueOf(func(name, text string) {
+			if i.renderings == nil {
+				i.renderings = make(map[string]string)
+			}
+			i.renderings[name] = text
+		}),
+
+		// Outputs and Output let formulas return several values and read
+		// them from their dependencies
+		"Outputs": reflect.ValueOf((*Outputs)(nil)),
+		"Output": reflect.ValueOf(func(value any, name string) any {
+			outputs, _ := value.(Outputs)
+			return outputs[name]
+		}),
+
+		// Emit and Every are given to continuous formulas
+		"Emit":  reflect.ValueOf(func(value any) { i.emit(value) }),
+		"Every": reflect.ValueOf(func(interval time.Duration) <-chan time.Time { return i.every(interval) }),
+	}}
+	if err := gointerp.Use(paramSymbols); err != nil {
+		return nil, fmt.Errorf("failed to load the parameter symbols: %w", err)
+	}
+	setup := "package " + formulaPackage + "\nimport " + importAlias("calx") + ` "calx"`
+	if p.dotImportMath {
+		setup += "\nimport . \"math\""
+	}
+	setup += "\ntype Outputs = " + importAlias("calx") + ".Outputs"
+	if _, err := gointerp.Eval(setup); err != nil {
+		return nil, fmt.Errorf("failed to set up the formula package: %w", err)
+	}
+
+	// Compile the prelude
+	if err := checkPreludeImports(p.prelude, p.policy.checkImports); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(p.prelude) != "" {
+		log.Println("Prelude code:\n", p.prelude)
+		if _, err := gointerp.Eval("package " + formulaPackage + "\n" + p.prelude); err != nil {
+			return nil, &PreludeError{compileErrors(err, 1)}
+		}
+	}
+	return i, nil
+}
+
+// importPackages imports the packages used by generated code. Each package
+// can only be imported once into the formula package.
+func (i *interpreter) importPackages(paths []string) error {
+	for _, path := range paths {
+		if i.imported[path] {
+			continue
+		}
+		code := "package " + formulaPackage + "\nimport " + importAlias(path) + " " + strconv.Quote(path)
+		if _, err := i.gointerp.Eval(code); err != nil {
+			return err
+		}
+		i.imported[path] = true
+	}
+	return nil
+}
+
+// functionCode builds the source of the function that holds a formula. The
+// function is named after a hash of the source so that a formula that is
+// already compiled can be found again. References to imported packages are
+// rewritten, which can shift the columns of compile errors on those lines.
+//
+// Each formula is put in its own function, and the function that is called
+// reports an error the formula returned to the kernel, gathers named
+// results into Outputs and renders the values that have a Render method.
+// yaegi can't find the methods of interpreted types through interfaces, so
+// only values of the renderers declared in the prelude render themselves,
+// when the formula declares the type or plainly returns it.
+func functionCode(formula Formula, paramTypes []paramType, renderers map[string]bool) (functionName, code string, lineOffset int) {
+	calx := importAlias("calx")
+	results := formula.results()
+	if results.valueType == "" && results.outputs == nil {
+		results.valueType = returnedRenderer(formula.Code, renderers)
+	}
+	code = "() " + results.source() + " {\n"
+	code += "params := " + calx + ".Params()\n"
+
+	// Unpack the function parameters
+	for index, dependency := range formula.Dependencies {
+		param := "params[" + strconv.Itoa(index) + "]"
+		switch {
+		case paramTypes[index].outputs != nil:
+			code += outputsCode(dependency, param, paramTypes[index].outputs)
+		case paramTypes[index].expr == "":
+			code += dependency + " := " + param
+		case paramTypes[index].declared:
+			code += dependency + ", _ := " + param + ".(" + paramTypes[index].expr + ")"
+		default:
+			code += dependency + " := " + param + ".(" + paramTypes[index].expr + ")"
+		}
+		code += "\n"
+	}
+	if formula.isContinuous() {
+		code += emitName + ", " + everyName + " := " + calx + ".Emit, " + calx + ".Every\n"
+		code += "_, _ = " + emitName + ", " + everyName + "\n"
+	}
+	if formula.CatchErrors {
+		code += upstreamErrorsName + ", _ := params[" + strconv.Itoa(len(formula.Dependencies)) + "].(map[string]error)\n"
+		code += "_ = " + upstreamErrorsName + "\n"
+	}
+
+	// Add in the function code
+	body := qualifyImports(formula.Code, formula.Imports)
+	hash := sha256.Sum256([]byte(code + body))
+	functionName = "F" + hex.EncodeToString(hash[:8])
+	bodyName := functionName + "Results"
+	code = "package " + formulaPackage + "\nfunc " + bodyName + code
+	lineOffset = strings.Count(code, "\n")
+	code += body
+	code += "\n}"
+	variables, value := results.resultVariables(calx + ".Outputs")
+	code += "\nfunc " + functionName + "() any {\n" + strings.Join(variables, ", ") + " := " + bodyName + "()\n"
+	if results.returnsError {
+		code += "if err != nil {\n" + calx + ".Fail(err.Error())\nreturn nil\n}\n"
+	}
+	if results.outputs == nil {
+		code += renderCode("", variables[0], results.valueType, renderers)
+	}
+	for index, output := range results.outputs {
+		code += renderCode(output.name, variables[index], output.typeSource, renderers)
+	}
+	code += "return " + value + "\n}"
+	return functionName, code, lineOffset
+}
+
+// renderCode renders a result of a formula with its Render method when its
+// type is one of the renderers
+func renderCode(name, variable, typeSource string, renderers map[string]bool) string {
+	if !renderers[typeSource] {
+		return ""
+	}
+	code := importAlias("calx") + ".Rendered(" + strconv.Quote(name) + ", " + variable + ".Render())\n"
+	if strings.HasPrefix(typeSource, "*") {
+		code = "if " + variable + " != nil {\n" + code + "}\n"
+	}
+	return code
+}
+
+// outputsCode unpacks a dependency that returns Outputs into a struct with
+// a field for each output
+func outputsCode(dependency, param string, outputs []namedResult) string {
+	code := dependency + " := " + paramType{outputs: outputs}.source() + "{}\n"
+	for _, output := range outputs {
+		value := importAlias("calx") + ".Output(" + param + ", " + strconv.Quote(output.name) + ")"
+		if output.typeSource == "" {
+			code += dependency + "." + output.name + " = " + value + "\n"
+		} else {
+			code += dependency + "." + output.name + ", _ = " + value + ".(" + output.typeSource + ")\n"
+		}
+	}
+	return code + "_ = " + dependency
+}
+
+// anyIfEmpty writes an unknown type as any
+func anyIfEmpty(typeSource string) string {
+	if typeSource == "" {
+		return "any"
+	}
+	return typeSource
+}
+
+// compile makes sure the function holding a formula is compiled into the
+// interpreter
+func (i *interpreter) compile(functionName, code string, lineOffset int) *Result {
+	if i.compiled[functionName] {
+		return nil
+	}
+
+	log.Println("Function code:\n", code)
+	if _, err := i.gointerp.Eval(code); err != nil {
+		return &Result{
+			Status:        StatusCompileError,
+			Error:         err.Error(),
+			CompileErrors: compileErrors(err, lineOffset),
+		}
+	}
+	i.compiled[functionName] = true
+	return nil
+}
+
+// call runs a compiled formula until it finishes, times out or the context
+// is done
+func (i *interpreter) call(ctx context.Context, functionName string, params []any, limits Limits, display render.Options) Result {
+	// Apply the limits
+	runCtx := ctx
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+	stopWatching := func() string { return "" }
+	if limits.watched() {
+		runCtx, stopWatching = limits.watch(runCtx, i.stopGoroutines)
+	}
+
+	// The parameters are left in place after the call since an interrupted
+	// formula may still be reading them
+	i.params = params
+	i.failure = nil
+	i.renderings = nil
+	v, err := i.gointerp.EvalWithContext(runCtx, formulaPackage+"."+functionName+"()")
+	if reason := stopWatching(); reason != "" {
+		return Result{Status: StatusLimitExceeded, Error: reason}
+	}
+	if err != nil {
+		var yaegiPanic interp.Panic
+		switch {
+		case ctx.Err() != nil:
+			return Result{Status: StatusCancelled, Error: ctx.Err().Error()}
+		case errors.Is(err, context.DeadlineExceeded):
+			return Result{Status: StatusTimeout, Error: "timed out after " + limits.Timeout.String()}
+		case errors.As(err, &yaegiPanic):
+			if policyError, denied := yaegiPanic.Value.(*PolicyError); denied {
+				return Result{Status: StatusDenied, Error: policyError.Error()}
+			}
+			log.Println("Recoverd from yaegi panic:", yaegiPanic.Value)
+			return Result{Status: StatusPanic, Error: fmt.Sprint(yaegiPanic.Value)}
+		}
+		return Result{Status: StatusCompileError, Error: err.Error()}
+	}
+	if i.failure != nil {
+		return Result{Status: StatusError, Error: *i.failure}
+	}
+	var value any
+	if v.IsValid() {
+		value = v.Interface()
+	}
+	return withRenderings(renderedResult(value, display), i.renderings)
+}
+
+// stopGoroutines stops the goroutines that formulas left running. Cancelling
+// an evaluation stops every goroutine in the interpreter.
+func (i *interpreter) stopGoroutines() {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	i.gointerp.EvalWithContext(ctx, "select {}")
+}
+
+// interpreterPool hands out idle interpreters, preferring ones that already
+// have the requested formula compiled. Every interpreter in the pool is
+// set up for the same project.
+type interpreterPool struct {
+	idle    []*interpreter
+	mutex   sync.Mutex
+	project project
+
+	// renderers are the types of the prelude that render themselves
+	renderers map[string]bool
+}
+
+func (p *interpreterPool) get(functionName string) (*interpreter, error) {
+	p.mutex.Lock()
+	if len(p.idle) == 0 {
+		project := p.project
+		p.mutex.Unlock()
+		return newInterpreter(project)
+	}
+	defer p.mutex.Unlock()
+
+	// Look for an interpreter that already compiled the formula
+	index := len(p.idle) - 1
+	for idleIndex, i := range p.idle {
+		if i.compiled[functionName] {
+			index = idleIndex
+			break
+		}
+	}
+	i := p.idle[index]
+	p.idle = append(p.idle[:index], p.idle[index+1:]...)
+	return i, nil
+}
+
+func (p *interpreterPool) put(i *interpreter) {
+	if len(i.compiled) >= maxCompiled {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.idle = append(p.idle, i)
+}
+
+// currentRenderers returns the types of the current prelude that render
+// themselves
+func (p *interpreterPool) currentRenderers() map[string]bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.renderers
+}
+
+// currentProject returns the project the interpreters are set up for
+func (p *interpreterPool) currentProject() project {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.project
+}
+
+// reset replaces the idle interpreters with one set up for a new project
+func (p *interpreterPool) reset(project project, i *interpreter) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.project = project
+	p.renderers = preludeRenderers(project.prelude)
+	p.idle = []*interpreter{i}
+}
+
+// close drops the idle interpreters
+func (p *interpreterPool) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.idle = nil
+}
+
+// hasOwnFiles reports whether the standard files that formulas see are
+// still the open files the interpreter set up
+func (i *interpreter) hasOwnFiles() bool {
+	for index, file := range i.stdFiles {
+		if *file != i.ownFiles[index] {
+			return false
+		}
+		if _, err := (*file).Stat(); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// run compiles and calls a formula on an interpreter from the pool
+func (p *interpreterPool) run(ctx context.Context, j job) Result {
+	functionName, code, lineOffset := functionCode(j.formula, j.paramTypes, p.currentRenderers())
+	i, err := p.get(functionName)
+	if err != nil {
+		return Result{Status: StatusCompileError, Error: err.Error()}
+	}
+	if err := p.currentProject().policy.checkImports(j.imports); err != nil {
+		return Result{Status: StatusDenied, Error: err.Error()}
+	}
+	if err := i.importPackages(j.imports); err != nil {
+		return Result{Status: StatusCompileError, Error: err.Error()}
+	}
+
+	// A failed compile can leave part of the formula declared so the
+	// interpreter isn't reused
+	if failure := i.compile(functionName, code, lineOffset); failure != nil {
+		return *failure
+	}
+
+	// Drop anything printed before the call, such as by the prelude
+	i.output.take()
+	params := j.params
+	if j.formula.CatchErrors {
+		params = append(params, j.upstreamErrors)
+	}
+	if j.formula.isContinuous() {
+		i.emit = func(value any) {
+			result := renderedResult(clone.Value(value), j.formula.Display)
+			result.Output = i.output.take()
+			j.emit(result)
+		}
+		i.every = j.every
+	}
+	result := i.call(ctx, functionName, params, j.limits, j.formula.Display)
+	result.Output = i.output.take()
+	if result.Status == StatusPanic {
+		result.Output = panicTracePattern.ReplaceAllString(result.Output, "")
+	}
+
+	// An interrupted formula may still be running in the background so its
+	// interpreter can't be trusted anymore. Neither can one that ran a
+	// continuous formula, which may have left goroutines waiting on every,
+	// or one whose standard files were replaced or closed.
+	if !result.Status.interrupted() && !j.formula.isContinuous() && i.hasOwnFiles() {
+		p.put(i)
+	}
+	return result
+}
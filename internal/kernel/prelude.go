@@ -0,0 +1,154 @@
+package kernel
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// PreludeError is returned by Update when the prelude doesn't compile. The
+// compile error lines are relative to the prelude code.
+type PreludeError struct {
+	CompileErrors []CompileError
+}
+
+func (e *PreludeError) Error() string {
+	messages := make([]string, 0, len(e.CompileErrors))
+	for _, compileError := range e.CompileErrors {
+		messages = append(messages, compileError.String())
+	}
+	return "prelude: " + strings.Join(messages, "; ")
+}
+
+// preludeSymbols returns the names declared by the prelude, including the
+// packages it imports. A prelude that doesn't parse declares nothing.
+func preludeSymbols(prelude string) map[string]bool {
+	symbols := make(map[string]bool)
+	file, err := parser.ParseFile(token.NewFileSet(), "", "package "+formulaPackage+"\n"+prelude, 0)
+	if err != nil {
+		return symbols
+	}
+	for _, spec := range file.Imports {
+		switch {
+		case spec.Name == nil:
+			importPath, _ := strconv.Unquote(spec.Path.Value)
+			symbols[path.Base(importPath)] = true
+		case spec.Name.Name != "_" && spec.Name.Name != ".":
+			symbols[spec.Name.Name] = true
+		}
+	}
+	for name := range file.Scope.Objects {
+		symbols[name] = true
+	}
+	return symbols
+}
+
+// preludeRenderers returns the types declared by the prelude that have a
+// Render() string method, written as they are used. Types with a pointer
+// receiver only render themselves through a pointer.
+func preludeRenderers(prelude string) map[string]bool {
+	renderers := make(map[string]bool)
+	file, err := parser.ParseFile(token.NewFileSet(), "", "package "+formulaPackage+"\n"+prelude, 0)
+	if err != nil {
+		return renderers
+	}
+	for _, declaration := range file.Decls {
+		function, isFunction := declaration.(*ast.FuncDecl)
+		if !isFunction || function.Recv == nil || function.Name.Name != "Render" ||
+			function.Type.Params.NumFields() != 0 || function.Type.Results.NumFields() != 1 {
+			continue
+		}
+		if result, isIdent := function.Type.Results.List[0].Type.(*ast.Ident); !isIdent || result.Name != "string" {
+			continue
+		}
+		switch receiver := function.Recv.List[0].Type.(type) {
+		case *ast.Ident:
+			renderers[receiver.Name] = true
+			renderers["*"+receiver.Name] = true
+		case *ast.StarExpr:
+			if name, isIdent := receiver.X.(*ast.Ident); isIdent {
+				renderers["*"+name.Name] = true
+			}
+		}
+	}
+	return renderers
+}
+
+// returnedRenderer returns the renderer that every return statement of a
+// formula plainly returns, such as Money(5), Row{} or &Row{}, or "" if
+// there isn't one
+func returnedRenderer(code string, renderers map[string]bool) string {
+	if len(renderers) == 0 {
+		return ""
+	}
+	_, file, err := parseFormula(code)
+	if err != nil {
+		return ""
+	}
+	returned := ""
+	plain := true
+	ast.Inspect(file.Decls[0].(*ast.FuncDecl).Body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FuncLit:
+			// Returns of nested functions don't return from the formula
+			return false
+		case *ast.ReturnStmt:
+			typeSource := ""
+			if len(node.Results) == 1 {
+				typeSource = literalType(node.Results[0])
+			}
+			if !renderers[typeSource] || (returned != "" && returned != typeSource) {
+				plain = false
+			}
+			returned = typeSource
+		}
+		return plain
+	})
+	if !plain {
+		return ""
+	}
+	return returned
+}
+
+// literalType returns the type of a conversion or composite literal of a
+// named type, or its address, such as "Money" or "*Row"
+func literalType(expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.CallExpr:
+		if name, isIdent := expr.Fun.(*ast.Ident); isIdent && len(expr.Args) == 1 {
+			return name.Name
+		}
+	case *ast.CompositeLit:
+		if name, isIdent := expr.Type.(*ast.Ident); isIdent {
+			return name.Name
+		}
+	case *ast.UnaryExpr:
+		if literal, isLiteral := expr.X.(*ast.CompositeLit); isLiteral && expr.Op == token.AND {
+			if name := literalType(literal); name != "" {
+				return "*" + name
+			}
+		}
+	}
+	return ""
+}
+
+// checkPreludeImports returns a *PreludeError if the prelude imports a
+// package that checkImports doesn't allow
+func checkPreludeImports(prelude string, checkImports func([]string) error) error {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", "package "+formulaPackage+"\n"+prelude, parser.ImportsOnly)
+	if err != nil {
+		return nil
+	}
+	for _, spec := range file.Imports {
+		importPath, _ := strconv.Unquote(spec.Path.Value)
+		if err := checkImports([]string{importPath}); err != nil {
+			position := fset.Position(spec.Path.Pos())
+			return &PreludeError{[]CompileError{{position.Line - 1, position.Column, err.Error()}}}
+		}
+	}
+	return nil
+}
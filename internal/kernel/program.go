@@ -0,0 +1,842 @@
+package kernel
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/importer"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lrdickson/calx/internal/kernel/clone"
+	"github.com/lrdickson/calx/internal/kernel/expr"
+	"github.com/lrdickson/calx/internal/kernel/render"
+)
+
+// programPackage is the package of the program that compiled formulas are
+// built into
+const programPackage = "main"
+
+// programModule is the module of the program. Expressions are evaluated by
+// a copy of the expr package in the module, results are rendered by a copy
+// of the render package and copied between formulas by a copy of the clone
+// package.
+const (
+	programModule       = "calxformulas"
+	programCloneImport  = programModule + "/clone"
+	programExprImport   = programModule + "/expr"
+	programRenderImport = programModule + "/render"
+)
+
+// programFunction is the name of the function holding a formula in the
+// program. The prefix keeps it from clashing with prelude names.
+func programFunction(name string) string {
+	return "_calx_formula_" + name
+}
+
+// programRunner is the name of the function that the runtime calls to run
+// a formula. It unpacks the parameters of the formula and gathers what it
+// returns into a value and an error.
+func programRunner(name string) string {
+	return "_calx_run_" + name
+}
+
+// programFormula is a formula that type checks, ready to be built into the
+// program
+type programFormula struct {
+	name         string
+	dependencies []string
+	timeout      string
+	display      render.Options
+	source       string
+
+	// catchErrors is set for formulas that handle upstream errors, with
+	// failures holding the errors of the dependencies that failed before
+	// the program was built
+	catchErrors bool
+	failures    map[string]error
+}
+
+// programBuilder type checks formulas one at a time so that each one gets
+// its own compile errors, then writes out the program holding the formulas
+// that passed
+type programBuilder struct {
+	fset          *token.FileSet
+	importer      types.Importer
+	prelude       *ast.File
+	dotImportMath bool
+
+	// returnTypes are the types returned by the formulas checked so far,
+	// with outputs holding the outputs of those that return Outputs
+	returnTypes map[string]types.Type
+	outputs     map[string][]programOutput
+	formulas    []programFormula
+	expressions bool
+}
+
+// unusedImportPattern matches the error for an import that isn't used. The
+// alias is missing for the math dot import.
+var unusedImportPattern = regexp.MustCompile(`^"([^"]+)" imported (?:as (\S+) )?and not used`)
+
+func newProgramBuilder(typesImporter types.Importer, p project) (*programBuilder, error) {
+	b := &programBuilder{
+		fset:          token.NewFileSet(),
+		importer:      typesImporter,
+		dotImportMath: p.dotImportMath,
+		returnTypes:   make(map[string]types.Type),
+		outputs:       make(map[string][]programOutput),
+	}
+
+	// Check the prelude on its own so that its errors aren't blamed on a
+	// formula
+	source, lineOffset := b.preludeSource(p.prelude)
+	file, err := parser.ParseFile(b.fset, "prelude.go", source, parser.AllErrors)
+	if err != nil {
+		return nil, &PreludeError{compileErrors(err, lineOffset)}
+	}
+	var preludeErrors []CompileError
+	config := types.Config{
+		Importer: b.importer,
+		Error: func(err error) {
+			preludeErrors = append(preludeErrors, newCompileError(err.Error(), lineOffset))
+		},
+	}
+	config.Check(programPackage, b.fset, []*ast.File{file}, nil)
+	if len(preludeErrors) > 0 {
+		return nil, &PreludeError{preludeErrors}
+	}
+	b.prelude = file
+	return b, nil
+}
+
+// preludeSource puts the prelude in a file of the program along with the
+// Outputs type
+func (b *programBuilder) preludeSource(prelude string) (string, int) {
+	source := "package " + programPackage + "\n"
+	if b.dotImportMath {
+		source += "import . \"math\"\n"
+	}
+	lineOffset := strings.Count(source, "\n")
+	source += prelude + "\n"
+	if b.dotImportMath {
+		// Keep the dot import from being unused
+		source += "var _ = Pi\n"
+	}
+	source += "type Outputs map[string]any\n"
+	return source, lineOffset
+}
+
+// formulaSource puts a formula in a file of the program, returning the
+// number of lines in front of the formula code
+func formulaSource(name string, formula *Formula, imports []string, dotImportMath bool, paramTypes []paramType, returnType string) (string, int) {
+	source := "package " + programPackage + "\n"
+	for _, importPath := range imports {
+		source += "import " + importAlias(importPath) + " " + strconv.Quote(importPath) + "\n"
+	}
+	if dotImportMath {
+		source += "import . \"math\"\n"
+	}
+	params := make([]string, 0, len(formula.Dependencies))
+	for index, dependency := range formula.Dependencies {
+		params = append(params, dependency+" "+paramTypes[index].source())
+	}
+	if formula.CatchErrors {
+		params = append(params, upstreamErrorsName+" map[string]error")
+	}
+	source += "func " + programFunction(name) + "(" + strings.Join(params, ", ") + ") " + returnType + " {\n"
+	lineOffset := strings.Count(source, "\n")
+	source += qualifyImports(formula.Code, formula.Imports) + "\n}\n"
+	return source, lineOffset
+}
+
+// add type checks a formula whose dependencies were all added, apart from
+// the failures of a formula that handles upstream errors. It returns a
+// compile error result if the formula doesn't type check.
+func (b *programBuilder) add(name string, formula *Formula, timeout string, failures map[string]error) *Result {
+	// Write the parameters with the types their formulas return
+	imports := make(map[string]bool)
+	for _, importPath := range formula.Imports {
+		imports[importPath] = true
+	}
+	paramTypes := make([]paramType, 0, len(formula.Dependencies))
+	for _, dependency := range formula.Dependencies {
+		paramTypes = append(paramTypes, b.paramType(dependency, imports))
+	}
+	results := formula.results()
+
+	// Check the formula
+	info := &types.Info{Types: make(map[ast.Expr]types.TypeAndValue)}
+	dotImportMath := b.dotImportMath
+	source, lineOffset := formulaSource(name, formula, sortedKeys(imports), dotImportMath, paramTypes, results.source())
+	file, err := parser.ParseFile(b.fset, name+".go", source, parser.AllErrors)
+	if err != nil {
+		return compileErrorResult(err, lineOffset)
+	}
+	var errs []types.Error
+	config := types.Config{
+		Importer: b.importer,
+		Error: func(err error) {
+			var typeError types.Error
+			if !errors.As(err, &typeError) {
+				return
+			}
+			match := unusedImportPattern.FindStringSubmatch(typeError.Msg)
+			switch {
+			case match == nil:
+				errs = append(errs, typeError)
+			case match[2] == "":
+				dotImportMath = false
+			default:
+				delete(imports, match[1])
+			}
+		},
+	}
+	config.Check(programPackage, b.fset, []*ast.File{b.prelude, file}, info)
+	if len(errs) > 0 {
+		var errorList scanner.ErrorList
+		for _, typeError := range errs {
+			errorList.Add(b.fset.Position(typeError.Pos), typeError.Msg)
+		}
+		errorList.Sort()
+		return compileErrorResult(errorList, lineOffset)
+	}
+
+	// Return what the formula returns so that dependents get the real type
+	var resultType types.Type
+	for _, declaration := range file.Decls {
+		function, ok := declaration.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		switch {
+		case results.outputs != nil:
+			b.outputs[name] = declaredOutputs(function, info, len(results.outputs))
+		case formula.Type != "":
+			resultType = info.Types[function.Type.Results.List[0].Type].Type
+		default:
+			resultType = returnedType(function, info, results.returnsError)
+			if outputsType, outputs := returnedOutputs(function, info); outputs != nil {
+				resultType = outputsType
+				b.outputs[name] = outputs
+			}
+			results.valueType = typeSource(resultType, imports)
+		}
+	}
+	b.returnTypes[name] = resultType
+
+	source, _ = formulaSource(name, formula, sortedKeys(imports), dotImportMath, paramTypes, results.source())
+	b.formulas = append(b.formulas, programFormula{
+		name:         name,
+		dependencies: formula.Dependencies,
+		timeout:      timeout,
+		display:      formula.Display,
+		source:       source + runnerSource(name, formula, paramTypes, results),
+		catchErrors:  formula.CatchErrors,
+		failures:     failures,
+	})
+	return nil
+}
+
+// paramType is how a formula gets the value of a dependency. Dependencies
+// that return Outputs become a struct with a field for each output.
+func (b *programBuilder) paramType(dependency string, imports map[string]bool) paramType {
+	outputs, exists := b.outputs[dependency]
+	if !exists {
+		return paramType{expr: typeSource(b.returnTypes[dependency], imports), declared: true}
+	}
+	named := make([]namedResult, 0, len(outputs))
+	for _, output := range outputs {
+		named = append(named, namedResult{output.name, typeSource(output.t, imports)})
+	}
+	return outputsParamType(named, true)
+}
+
+// variableType is the type of a variable in an expression, which can be
+// an output of a formula such as stats.mean
+func (b *programBuilder) variableType(variable string) types.Type {
+	name, field, found := strings.Cut(variable, ".")
+	if _, exists := b.returnTypes[variable]; exists || !found {
+		return b.returnTypes[variable]
+	}
+	for _, output := range b.outputs[name] {
+		if output.name == field {
+			return output.t
+		}
+	}
+	return nil
+}
+
+// runnerSource writes the function that the runtime calls to run a
+// formula. Outputs declared as named results are gathered into Outputs.
+func runnerSource(name string, formula *Formula, paramTypes []paramType, results formulaResults) string {
+	source := "func " + programRunner(name) + "(params []any, " + upstreamErrorsName + " map[string]error) (any, error) {\n"
+	args := make([]string, 0, len(formula.Dependencies)+1)
+	for index, paramType := range paramTypes {
+		param := "params[" + strconv.Itoa(index) + "]"
+		arg := "_calx_p" + strconv.Itoa(index)
+		if paramType.outputs == nil {
+			source += "\t" + arg + ", _ := " + param + ".(" + paramType.source() + ")\n"
+		} else {
+			fields := make([]string, 0, len(paramType.outputs))
+			for _, output := range paramType.outputs {
+				fields = append(fields, "_calx_output_value["+anyIfEmpty(output.typeSource)+"]("+param+", "+strconv.Quote(output.name)+")")
+			}
+			source += "\t" + arg + " := " + paramType.source() + "{" + strings.Join(fields, ", ") + "}\n"
+		}
+		args = append(args, arg)
+	}
+	if formula.CatchErrors {
+		args = append(args, upstreamErrorsName)
+	}
+	variables, value := results.resultVariables("Outputs")
+	source += "\t" + strings.Join(variables, ", ") + " := " + programFunction(name) + "(" + strings.Join(args, ", ") + ")\n"
+	if results.returnsError {
+		return source + "\treturn " + value + ", err\n}\n"
+	}
+	return source + "\treturn " + value + ", nil\n}\n"
+}
+
+// addExpression adds an expression formula. It returns a compile error
+// result if the expression doesn't parse.
+func (b *programBuilder) addExpression(name string, formula *Formula, timeout string, failures map[string]error) *Result {
+	expression, err := expr.Parse(formula.Code)
+	if err != nil {
+		result := expressionCompileError(err)
+		return &result
+	}
+
+	// Return a Go type when the kind of value is known so that Go formulas
+	// can use it without a type assertion
+	var resultType types.Type
+	switch expression.Kind(func(variable string) expr.Kind { return expressionKind(b.variableType(variable)) }) {
+	case expr.KindNumber:
+		resultType = types.Typ[types.Float64]
+	case expr.KindText:
+		resultType = types.Typ[types.String]
+	case expr.KindBool:
+		resultType = types.Typ[types.Bool]
+	}
+	returnType := typeSource(resultType, nil)
+
+	params := make([]string, 0, len(formula.Dependencies))
+	paramTypes := make([]paramType, 0, len(formula.Dependencies))
+	variables := make([]string, 0, len(formula.Dependencies))
+	for _, dependency := range formula.Dependencies {
+		params = append(params, dependency+" any")
+		paramTypes = append(paramTypes, paramType{})
+		variables = append(variables, strconv.Quote(dependency)+": "+dependency)
+	}
+	if formula.CatchErrors {
+		params = append(params, upstreamErrorsName+" map[string]error")
+	}
+	expressionName := "_calx_expression_" + name
+	source := "package " + programPackage + "\n" +
+		"import _calx_expr " + strconv.Quote(programExprImport) + "\n" +
+		"var " + expressionName + " = _calx_expr.MustParse(" + strconv.Quote(formula.Code) + ")\n" +
+		"func " + programFunction(name) + "(" + strings.Join(params, ", ") + ") (" + returnType + ", error) {\n" +
+		"\tvariables := map[string]any{" + strings.Join(variables, ", ") + "}\n"
+	if formula.CatchErrors {
+		// Failed dependencies are #N/A errors in the expression
+		source += "\tfor name, err := range " + upstreamErrorsName + " {\n" +
+			"\t\tvariables[name] = &_calx_expr.Error{Code: _calx_expr.NotAvailable, Message: err.Error()}\n\t}\n"
+	}
+	source += "\tvalue, err := " + expressionName + ".Evaluate(variables)\n"
+	if resultType == nil {
+		source += "\treturn value, err\n}\n"
+	} else {
+		source += "\tresult, _ := value.(" + returnType + ")\n\treturn result, err\n}\n"
+	}
+
+	b.returnTypes[name] = resultType
+	b.expressions = true
+	source += runnerSource(name, formula, paramTypes, formulaResults{valueType: returnType, returnsError: true})
+	b.formulas = append(b.formulas, programFormula{
+		name:         name,
+		dependencies: formula.Dependencies,
+		timeout:      timeout,
+		display:      formula.Display,
+		source:       source,
+		catchErrors:  formula.CatchErrors,
+		failures:     failures,
+	})
+	return nil
+}
+
+// expressionKind is the kind of value an expression gets from a Go type
+func expressionKind(t types.Type) expr.Kind {
+	if t == nil {
+		return expr.KindUnknown
+	}
+	basic, ok := t.Underlying().(*types.Basic)
+	switch {
+	case !ok:
+		return expr.KindUnknown
+	case basic.Info()&types.IsNumeric != 0:
+		return expr.KindNumber
+	case basic.Info()&types.IsString != 0:
+		return expr.KindText
+	case basic.Info()&types.IsBoolean != 0:
+		return expr.KindBool
+	}
+	return expr.KindUnknown
+}
+
+// compileErrorResult is the result of a formula that doesn't compile, with
+// the lines in the error counted from the start of the formula code
+func compileErrorResult(err error, lineOffset int) *Result {
+	errs := compileErrors(err, lineOffset)
+	messages := make([]string, 0, len(errs))
+	for _, compileError := range errs {
+		messages = append(messages, compileError.String())
+	}
+	return &Result{Status: StatusCompileError, Error: strings.Join(messages, "\n"), CompileErrors: errs}
+}
+
+// returnedType is the type returned by the return statements of a function
+// that returns any, or (any, error) if returnsError is set. It is nil when
+// they don't agree.
+func returnedType(function *ast.FuncDecl, info *types.Info, returnsError bool) types.Type {
+	results := 1
+	if returnsError {
+		results = 2
+	}
+	var returned types.Type
+	agree := true
+	ast.Inspect(function.Body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ReturnStmt:
+			if len(node.Results) != results {
+				agree = false
+				return false
+			}
+			resultType := info.Types[node.Results[0]].Type
+			if resultType == nil || types.Identical(resultType, types.Typ[types.UntypedNil]) {
+				agree = false
+				return false
+			}
+			resultType = types.Default(resultType)
+			if returned != nil && !types.Identical(returned, resultType) {
+				agree = false
+			}
+			returned = resultType
+		}
+		return true
+	})
+	if !agree {
+		return nil
+	}
+	return returned
+}
+
+// programOutput is one of the outputs of a formula in the program. t is
+// nil for outputs left as any.
+type programOutput struct {
+	name string
+	t    types.Type
+}
+
+// declaredOutputs are the first count named results of a function
+func declaredOutputs(function *ast.FuncDecl, info *types.Info, count int) []programOutput {
+	outputs := make([]programOutput, 0, count)
+	for _, field := range function.Type.Results.List {
+		for _, name := range field.Names {
+			if len(outputs) < count {
+				outputs = append(outputs, programOutput{name.Name, info.Types[field.Type].Type})
+			}
+		}
+	}
+	return outputs
+}
+
+// returnedOutputs finds the outputs of a function whose return statements
+// return Outputs literals, such as Outputs{"mean": m}, or nil. Outputs
+// whose values don't agree on a type are left as any. It also returns the
+// Outputs type. The outputs are nil when another value is returned.
+func returnedOutputs(function *ast.FuncDecl, info *types.Info) (types.Type, []programOutput) {
+	var outputsType types.Type
+	outputTypes := make(map[string]types.Type)
+	literals := true
+	ast.Inspect(function.Body, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.ReturnStmt:
+			if len(node.Results) == 0 {
+				literals = false
+				return false
+			}
+			result := node.Results[0]
+			if resultType := info.Types[result].Type; resultType != nil && types.Identical(resultType, types.Typ[types.UntypedNil]) {
+				return true
+			}
+			literal, ok := result.(*ast.CompositeLit)
+			named, _ := info.Types[result].Type.(*types.Named)
+			if !ok || named == nil || named.Obj().Name() != "Outputs" || named.Obj().Pkg().Path() != programPackage {
+				literals = false
+				return false
+			}
+			outputsType = named
+			for _, element := range literal.Elts {
+				keyValue, ok := element.(*ast.KeyValueExpr)
+				if !ok {
+					literals = false
+					return false
+				}
+				key := info.Types[keyValue.Key].Value
+				if key == nil || key.Kind() != constant.String {
+					literals = false
+					return false
+				}
+				name := constant.StringVal(key)
+				valueType := types.Default(info.Types[keyValue.Value].Type)
+				if previous, seen := outputTypes[name]; seen && (previous == nil || !types.Identical(previous, valueType)) {
+					valueType = nil
+				}
+				if valueType != nil && types.Identical(valueType, types.Typ[types.UntypedNil]) {
+					valueType = nil
+				}
+				outputTypes[name] = valueType
+			}
+		}
+		return literals
+	})
+	if !literals || outputsType == nil {
+		return nil, nil
+	}
+	outputs := make([]programOutput, 0, len(outputTypes))
+	for name, outputType := range outputTypes {
+		outputs = append(outputs, programOutput{name, outputType})
+	}
+	sort.Slice(outputs, func(i, j int) bool { return outputs[i].name < outputs[j].name })
+	return outputsType, outputs
+}
+
+// typeSource writes a type out for the program and adds the packages it
+// needs to imports. Types that can't be named outside of their package are
+// written as any.
+func typeSource(t types.Type, imports map[string]bool) string {
+	if t == nil || !nameable(t) {
+		return "any"
+	}
+	return types.TypeString(t, func(p *types.Package) string {
+		if p.Path() == programPackage {
+			return ""
+		}
+		imports[p.Path()] = true
+		return importAlias(p.Path())
+	})
+}
+
+// nameable reports whether a type can be written out in the program
+func nameable(t types.Type) bool {
+	switch t := t.(type) {
+	case *types.Named:
+		object := t.Obj()
+		if object.Pkg() != nil && object.Pkg().Path() != programPackage {
+			path := object.Pkg().Path()
+			if !object.Exported() || strings.Contains("/"+path+"/", "/internal/") {
+				return false
+			}
+		}
+		for index := 0; index < t.TypeArgs().Len(); index++ {
+			if !nameable(t.TypeArgs().At(index)) {
+				return false
+			}
+		}
+		return true
+	case *types.Pointer:
+		return nameable(t.Elem())
+	case *types.Slice:
+		return nameable(t.Elem())
+	case *types.Array:
+		return nameable(t.Elem())
+	case *types.Chan:
+		return nameable(t.Elem())
+	case *types.Map:
+		return nameable(t.Key()) && nameable(t.Elem())
+	case *types.Signature:
+		return nameableTuple(t.Params()) && nameableTuple(t.Results())
+	case *types.Struct:
+		for index := 0; index < t.NumFields(); index++ {
+			field := t.Field(index)
+			if !field.Exported() && field.Pkg() != nil && field.Pkg().Path() != programPackage {
+				return false
+			}
+			if !nameable(field.Type()) {
+				return false
+			}
+		}
+		return true
+	case *types.Basic:
+		return t.Info()&types.IsUntyped == 0
+	case *types.TypeParam:
+		return false
+	}
+	return true
+}
+
+func nameableTuple(tuple *types.Tuple) bool {
+	for index := 0; index < tuple.Len(); index++ {
+		if !nameable(tuple.At(index).Type()) {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// files returns the source files of the program keyed by file name
+func (b *programBuilder) files(prelude string, parallelism int) map[string]string {
+	files := make(map[string]string)
+	files["go.mod"] = "module " + programModule + "\n\ngo 1.19\n"
+	files["prelude.go"], _ = b.preludeSource(prelude)
+	copyPackage := func(directory string, source fs.FS) {
+		entries, _ := fs.ReadDir(source, ".")
+		for _, entry := range entries {
+			code, _ := fs.ReadFile(source, entry.Name())
+			files[directory+"/"+entry.Name()] = string(code)
+		}
+	}
+	copyPackage("clone", clone.Source)
+	copyPackage("render", render.Source)
+	if b.expressions {
+		copyPackage("expr", expr.Source)
+	}
+
+	// List the formulas for the runtime in the order they were added, which
+	// puts dependencies first
+	index := make(map[string]int)
+	table := ""
+	for position, formula := range b.formulas {
+		index[formula.name] = position
+		files["formula"+strconv.Itoa(position)+".go"] = formula.source
+
+		// Dependencies that failed before the program was built are -1
+		dependencies := make([]string, 0, len(formula.dependencies))
+		for _, dependency := range formula.dependencies {
+			if _, failed := formula.failures[dependency]; failed {
+				dependencies = append(dependencies, "-1")
+			} else {
+				dependencies = append(dependencies, strconv.Itoa(index[dependency]))
+			}
+		}
+		failures := make([]string, 0, len(formula.failures))
+		for dependency, err := range formula.failures {
+			failures = append(failures, strconv.Quote(dependency)+": "+strconv.Quote(err.Error()))
+		}
+		sort.Strings(failures)
+		display := fmt.Sprintf("_calx_render.Options{Rounded: %t, Precision: %d, Thousands: %t, Percent: %t}",
+			formula.display.Rounded, formula.display.Precision, formula.display.Thousands, formula.display.Percent)
+		table += "\t\t{" + strconv.Quote(formula.name) + ", []int{" + strings.Join(dependencies, ", ") + "}, " + formula.timeout +
+			", " + display + ", " + strconv.FormatBool(formula.catchErrors) + ", map[string]string{" + strings.Join(failures, ", ") + "}" +
+			", " + programRunner(formula.name) + "},\n"
+	}
+	files["main.go"] = programRuntime + "\nfunc main() {\n" +
+		"\t_calx_os.Stdout = _calx_os.Stderr\n" +
+		"\t_calx_run(" + strconv.Itoa(parallelism) + ", []_calx_formula{\n" + table + "\t})\n}\n"
+	return files
+}
+
+// programRuntime runs the formulas of the program as soon as their
+// dependencies are done, reporting each one to the kernel as a line of JSON
+// on stdout. Formulas see stderr as stdout so that what they print doesn't
+// get mixed in. Values that are Outputs are sent with each output rendered
+// on its own.
+const programRuntime = `package main
+
+import (
+	_calx_errors "errors"
+	_calx_json "encoding/json"
+	_calx_fmt "fmt"
+	_calx_os "os"
+	_calx_sort "sort"
+	_calx_strings "strings"
+	_calx_sync "sync"
+	_calx_time "time"
+
+	_calx_clone "` + programCloneImport + `"
+	_calx_render "` + programRenderImport + `"
+)
+
+type _calx_formula struct {
+	name         string
+	dependencies []int
+	timeout      _calx_time.Duration
+	display      _calx_render.Options
+	catchErrors  bool
+	failures     map[string]string
+	run          func(params []any, upstreamErrors map[string]error) (any, error)
+}
+
+var (
+	_calx_output = _calx_json.NewEncoder(_calx_os.Stdout)
+	_calx_mutex  _calx_sync.Mutex
+)
+
+func _calx_send(message map[string]any) {
+	_calx_mutex.Lock()
+	defer _calx_mutex.Unlock()
+	_calx_output.Encode(message)
+}
+
+func _calx_call(formula _calx_formula, params []any, upstreamErrors map[string]error) (any, string, string) {
+	type outcome struct {
+		value   any
+		status  string
+		message string
+	}
+	finished := make(chan outcome, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				finished <- outcome{nil, "panic", _calx_fmt.Sprint(r)}
+			}
+		}()
+		value, err := formula.run(params, upstreamErrors)
+		if err != nil {
+			finished <- outcome{nil, "error", err.Error()}
+			return
+		}
+		finished <- outcome{value, "ok", ""}
+	}()
+
+	var timeout <-chan _calx_time.Time
+	if formula.timeout > 0 {
+		timer := _calx_time.NewTimer(formula.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case o := <-finished:
+		return o.value, o.status, o.message
+	case <-timeout:
+		return nil, "timeout", "timed out after " + formula.timeout.String()
+	}
+}
+
+// _calx_output_value is an output of a formula that returns Outputs, or the
+// zero value when it is missing or has another type
+func _calx_output_value[T any](value any, name string) T {
+	outputs, _ := value.(Outputs)
+	output, _ := outputs[name].(T)
+	return output
+}
+
+// _calx_outputs renders each output in order of their names
+func _calx_outputs(outputs Outputs, display _calx_render.Options) []map[string]any {
+	names := make([]string, 0, len(outputs))
+	for name := range outputs {
+		names = append(names, name)
+	}
+	_calx_sort.Strings(names)
+	rendered := make([]map[string]any, 0, len(names))
+	for _, name := range names {
+		output := map[string]any{"name": name, "rendering": _calx_render.Render(outputs[name], display)}
+		if encoded, err := _calx_json.Marshal(outputs[name]); err == nil {
+			output["value"] = _calx_json.RawMessage(encoded)
+		}
+		rendered = append(rendered, output)
+	}
+	return rendered
+}
+
+// _calx_upstream_error is the error a formula handling upstream errors gets
+// for a dependency that failed
+func _calx_upstream_error(dependency, status, message string) error {
+	if message == "" {
+		message = status
+	}
+	if !_calx_strings.HasPrefix(message, "upstream failed: ") {
+		message = dependency + " failed: " + message
+	}
+	return _calx_errors.New(message)
+}
+
+func _calx_run(parallelism int, formulas []_calx_formula) {
+	values := make([]any, len(formulas))
+	failed := make([]bool, len(formulas))
+	failures := make([]error, len(formulas))
+	done := make([]chan struct{}, len(formulas))
+	for index := range done {
+		done[index] = make(chan struct{})
+	}
+	slots := make(chan struct{}, parallelism)
+	for index := range formulas {
+		go func(index int) {
+			defer close(done[index])
+			formula := formulas[index]
+			params := make([]any, len(formula.dependencies))
+			upstreamErrors := make(map[string]error)
+			for name, message := range formula.failures {
+				upstreamErrors[name] = _calx_errors.New(message)
+			}
+			for position, dependency := range formula.dependencies {
+				if dependency < 0 {
+					continue
+				}
+				<-done[dependency]
+				if failed[dependency] && formula.catchErrors {
+					upstreamErrors[formulas[dependency].name] = failures[dependency]
+					continue
+				}
+				if failed[dependency] {
+					failed[index] = true
+					failures[index] = _calx_errors.New("upstream failed: " + formulas[dependency].name)
+					_calx_send(map[string]any{"name": formula.name, "status": "skipped", "error": "upstream failed: " + formulas[dependency].name})
+					return
+				}
+				params[position] = _calx_clone.Value(values[dependency])
+			}
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			_calx_send(map[string]any{"name": formula.name, "status": "started"})
+			start := _calx_time.Now()
+			value, status, message := _calx_call(formula, params, upstreamErrors)
+			result := map[string]any{"name": formula.name, "status": status, "error": message, "duration": _calx_time.Since(start)}
+			values[index] = value
+			failed[index] = status != "ok"
+			if failed[index] {
+				failures[index] = _calx_upstream_error(formula.name, status, message)
+			}
+			if status == "ok" {
+				result["rendering"] = _calx_render.Render(value, formula.display)
+				if encoded, err := _calx_json.Marshal(value); err == nil {
+					result["value"] = _calx_json.RawMessage(encoded)
+				}
+				if outputs, ok := value.(Outputs); ok {
+					result["outputs"] = _calx_outputs(outputs, formula.display)
+				}
+			}
+			_calx_send(result)
+		}(index)
+	}
+	for index := range done {
+		<-done[index]
+	}
+}
+`
+
+// defaultImporter loads the export data of the standard library for type
+// checking
+func defaultImporter() types.Importer {
+	return importer.Default()
+}
@@ -0,0 +1,62 @@
+package kernel
+
+// project holds the settings that every formula is compiled with
+type project struct {
+	prelude       string
+	dotImportMath bool
+	policy        Policy
+}
+
+// knownSymbols returns the names that formulas can use because of the
+// project settings, along with Outputs which every formula can use
+func (p project) knownSymbols() map[string]bool {
+	symbols := preludeSymbols(p.prelude)
+	symbols["Outputs"] = true
+	if p.dotImportMath {
+		for name := range mathSymbols {
+			symbols[name] = true
+		}
+	}
+	return symbols
+}
+
+// SetPrelude sets code that is compiled once and shared by every formula.
+// It can declare types, functions, constants, variables and imports. The
+// prelude takes effect on the next update, which runs every formula again.
+func (k *LocalKernel) SetPrelude(prelude string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.project.prelude = prelude
+}
+
+// SetDotImportMath sets whether the math package is dot imported for every
+// formula so that Pi or Sqrt can be used without the package name. It
+// takes effect on the next update, which runs every formula again.
+func (k *LocalKernel) SetDotImportMath(enabled bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.project.dotImportMath = enabled
+}
+
+// SetPolicy sets what formulas are allowed to do. It takes effect on the
+// next update, which runs every formula again.
+func (k *LocalKernel) SetPolicy(policy Policy) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.project.policy = policy
+}
+
+// loadProject switches the interpreters over to new project settings and
+// forgets the results that were computed with the old ones
+func (k *LocalKernel) loadProject(p project) error {
+	if p == k.pool.currentProject() {
+		return nil
+	}
+	i, err := newInterpreter(p)
+	if err != nil {
+		return err
+	}
+	k.pool.reset(p, i)
+	k.cache = make(map[string]*cacheEntry)
+	return nil
+}
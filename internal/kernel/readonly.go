@@ -0,0 +1,75 @@
+package kernel
+
+import (
+	"io/fs"
+	"os"
+)
+
+// readOnlyFile is what os.Open gives formulas instead of an *os.File, whose
+// methods can change permissions, owners or the working directory of the
+// kernel
+type readOnlyFile struct {
+	file *os.File
+}
+
+func openReadOnly(name string) (*readOnlyFile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyFile{file}, nil
+}
+
+func (f *readOnlyFile) Close() error {
+	return f.file.Close()
+}
+
+func (f *readOnlyFile) Name() string {
+	return f.file.Name()
+}
+
+func (f *readOnlyFile) Read(b []byte) (int, error) {
+	return f.file.Read(b)
+}
+
+func (f *readOnlyFile) ReadAt(b []byte, offset int64) (int, error) {
+	return f.file.ReadAt(b, offset)
+}
+
+func (f *readOnlyFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	return f.file.ReadDir(n)
+}
+
+func (f *readOnlyFile) Readdir(n int) ([]fs.FileInfo, error) {
+	return f.file.Readdir(n)
+}
+
+func (f *readOnlyFile) Readdirnames(n int) ([]string, error) {
+	return f.file.Readdirnames(n)
+}
+
+func (f *readOnlyFile) Seek(offset int64, whence int) (int64, error) {
+	return f.file.Seek(offset, whence)
+}
+
+func (f *readOnlyFile) Stat() (fs.FileInfo, error) {
+	return f.file.Stat()
+}
+
+// readOnlyFS is what os.DirFS gives formulas. Its files are readOnlyFile so
+// that the *os.File can't be had with a type assertion.
+type readOnlyFS struct {
+	dir string
+}
+
+func readOnlyDirFS(dir string) fs.FS {
+	return readOnlyFS{dir}
+}
+
+func (f readOnlyFS) Open(name string) (fs.File, error) {
+	file, err := os.DirFS(f.dir).Open(name)
+	if osFile, isOSFile := file.(*os.File); isOSFile && err == nil {
+		return &readOnlyFile{osFile}, nil
+	}
+	return file, err
+}
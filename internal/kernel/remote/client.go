@@ -0,0 +1,518 @@
+package remote
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/lrdickson/calx/internal/kernel"
+)
+
+// ErrExited is returned for requests that were still waiting for an answer
+// when the kernel process exited
+var ErrExited = errors.New("kernel process exited")
+
+// restartDelay is how long to wait before starting a kernel process that
+// exited, so that a process that keeps crashing doesn't use up the CPU
+const restartDelay = 500 * time.Millisecond
+
+// closeTimeout is how long a kernel process gets to exit after Close before
+// it is killed
+const closeTimeout = 5 * time.Second
+
+// connection is one running kernel process
+type connection struct {
+	encoder *json.Encoder
+	stdin   io.Closer
+	wait    func() error
+	kill    func() error
+
+	mutex   sync.Mutex
+	nextID  int
+	pending map[int]chan message
+	exited  chan struct{}
+	err     error
+}
+
+func newConnection(stdout io.Reader, stdin io.WriteCloser, onEvent func(wireEvent)) *connection {
+	c := &connection{
+		encoder: json.NewEncoder(stdin),
+		stdin:   stdin,
+		pending: make(map[int]chan message),
+		exited:  make(chan struct{}),
+	}
+	go c.read(stdout, onEvent)
+	return c
+}
+
+// read hands each response to the request waiting for it until the
+// process stops writing
+func (c *connection) read(stdout io.Reader, onEvent func(wireEvent)) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+	for scanner.Scan() {
+		var m message
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			log.Println("Bad message from the kernel process:", err)
+			continue
+		}
+		if m.ID == nil {
+			var event wireEvent
+			if m.Method == eventMethod && json.Unmarshal(m.Params, &event) == nil {
+				onEvent(event)
+			}
+			continue
+		}
+		c.mutex.Lock()
+		response, exists := c.pending[*m.ID]
+		delete(c.pending, *m.ID)
+		c.mutex.Unlock()
+		if exists {
+			response <- m
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.err = ErrExited
+	if err := scanner.Err(); err != nil {
+		c.err = fmt.Errorf("%w: %v", ErrExited, err)
+	}
+	close(c.exited)
+}
+
+// call sends a request and waits for the answer
+func (c *connection) call(ctx context.Context, method string, params any, result any) error {
+	encodedParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	// Send the request
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return c.err
+	}
+	c.nextID++
+	id := c.nextID
+	response := make(chan message, 1)
+	c.pending[id] = response
+	err = c.encoder.Encode(message{JSONRPC: jsonrpcVersion, ID: &id, Method: method, Params: encodedParams})
+	c.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrExited, err)
+	}
+
+	// Wait for the answer
+	var m message
+	select {
+	case m = <-response:
+	case <-c.exited:
+		return c.err
+	case <-ctx.Done():
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		return ctx.Err()
+	}
+	if m.Error != nil {
+		return m.Error.toError()
+	}
+	if result != nil {
+		return json.Unmarshal(m.Result, result)
+	}
+	return nil
+}
+
+// alive reports whether the process is still answering
+func (c *connection) alive() bool {
+	select {
+	case <-c.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// settings are sent again to a kernel process that was restarted
+type settings struct {
+	prelude       string
+	dotImportMath bool
+	policy        kernel.Policy
+	limits        kernel.Limits
+	parallelism   int
+}
+
+// Kernel runs formulas in a child process. The process is started again
+// when it dies, which loses the cached results and fails the update that
+// was running with ErrExited.
+type Kernel struct {
+	start func(onEvent func(wireEvent)) (*connection, error)
+
+	mutex      sync.Mutex
+	closed     bool
+	connection *connection
+	settings   settings
+
+	// starting is closed once the process being started is ready, nil when
+	// no process is being started
+	starting chan struct{}
+
+	listenerMutex sync.Mutex
+	listeners     []func(kernel.Event)
+
+	// events wait here for deliver, which runs while there are any
+	eventMutex sync.Mutex
+	events     []kernel.Event
+	delivering bool
+}
+
+var _ kernel.Kernel = (*Kernel)(nil)
+
+// NewKernel starts a kernel process that serves the protocol on its stdin
+// and stdout, such as cmd/calx-kernel
+func NewKernel(name string, args ...string) (*Kernel, error) {
+	k := &Kernel{start: func(onEvent func(wireEvent)) (*connection, error) {
+		return startProcess(exec.Command(name, args...), onEvent)
+	}}
+	if _, err := k.current(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func startProcess(cmd *exec.Cmd, onEvent func(wireEvent)) (*connection, error) {
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	c := newConnection(stdout, stdin, onEvent)
+	c.wait = cmd.Wait
+	c.kill = cmd.Process.Kill
+	return c, nil
+}
+
+// current returns the connection to the kernel process, starting a new
+// process if the last one exited. The mutex isn't held while the process
+// starts, other callers wait for it to be ready instead.
+func (k *Kernel) current() (*connection, error) {
+	k.mutex.Lock()
+	for {
+		if k.closed {
+			k.mutex.Unlock()
+			return nil, kernel.ErrClosed
+		}
+		if k.connection != nil && k.connection.alive() {
+			defer k.mutex.Unlock()
+			return k.connection, nil
+		}
+		if k.starting == nil {
+			break
+		}
+		starting := k.starting
+		k.mutex.Unlock()
+		<-starting
+		k.mutex.Lock()
+	}
+	starting := make(chan struct{})
+	k.starting = starting
+	s := k.settings
+	k.mutex.Unlock()
+
+	// A new process has none of the settings made so far. Settings changed
+	// while it starts are sent once it is ready.
+	c, err := k.start(k.emit)
+	if err != nil {
+		err = fmt.Errorf("starting the kernel process: %w", err)
+	} else {
+		err = k.replay(context.Background(), c, s)
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.starting = nil
+	close(starting)
+	if c == nil {
+		return nil, err
+	}
+	if k.closed {
+		c.stdin.Close()
+		return nil, kernel.ErrClosed
+	}
+	k.connection = c
+	go k.restartOnExit(c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// live returns the connection to the kernel process without starting one,
+// nil if the process isn't running
+func (k *Kernel) live() *connection {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.closed || k.connection == nil || !k.connection.alive() {
+		return nil
+	}
+	return k.connection
+}
+
+func (k *Kernel) replay(ctx context.Context, c *connection, s settings) error {
+	if err := c.call(ctx, setPreludeMethod, preludeParams{Prelude: s.prelude}, nil); err != nil {
+		return err
+	}
+	if err := c.call(ctx, setDotImportMathMethod, dotImportMathParams{Enabled: s.dotImportMath}, nil); err != nil {
+		return err
+	}
+	if err := c.call(ctx, setPolicyMethod, s.policy, nil); err != nil {
+		return err
+	}
+	if err := c.call(ctx, setLimitsMethod, s.limits, nil); err != nil {
+		return err
+	}
+	if s.parallelism > 0 {
+		return c.call(ctx, setParallelismMethod, parallelismParams{Parallelism: s.parallelism}, nil)
+	}
+	return nil
+}
+
+// restartOnExit starts the kernel process again once it exits
+func (k *Kernel) restartOnExit(c *connection) {
+	<-c.exited
+	if c.wait != nil {
+		err := c.wait()
+		log.Println("Kernel process exited:", err)
+	}
+
+	time.Sleep(restartDelay)
+	k.mutex.Lock()
+	stale := k.closed || k.connection != c
+	k.mutex.Unlock()
+	if stale {
+		return
+	}
+	if _, err := k.current(); err != nil && !errors.Is(err, kernel.ErrClosed) {
+		log.Println("Failed to restart the kernel process:", err)
+	}
+}
+
+func (k *Kernel) call(ctx context.Context, method string, params any, result any) error {
+	c, err := k.current()
+	if err != nil {
+		return err
+	}
+	return c.call(ctx, method, params, result)
+}
+
+// notify sends a request whose failure only matters to the log, as the
+// setting will be sent again if the process is restarted
+func (k *Kernel) notify(method string, params any) {
+	err := k.call(context.Background(), method, params, nil)
+	if err != nil && !errors.Is(err, kernel.ErrClosed) && !errors.Is(err, ErrExited) {
+		log.Printf("Kernel %s failed: %v", method, err)
+	}
+}
+
+// Update runs the formulas in the kernel process. Cancelling ctx stops the
+// run there.
+func (k *Kernel) Update(ctx context.Context, formulas map[string]*kernel.Formula) (map[string]*kernel.Result, error) {
+	return k.update(ctx, updateMethod, updateParams{Formulas: formulas})
+}
+
+// Evaluate runs a formula and the formulas it needs in the kernel process
+func (k *Kernel) Evaluate(ctx context.Context, formulas map[string]*kernel.Formula, name string) (map[string]*kernel.Result, error) {
+	return k.update(ctx, evaluateMethod, updateParams{Formulas: formulas, Name: name})
+}
+
+// update sends an update or an evaluation, stopping it when ctx is done
+func (k *Kernel) update(ctx context.Context, method string, params updateParams) (map[string]*kernel.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Stop the run in the kernel process when the context is done
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			k.Stop()
+		case <-finished:
+		}
+	}()
+
+	var wireResults map[string]*wireResult
+	err := k.call(context.Background(), method, params, &wireResults)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]*kernel.Result, len(wireResults))
+	for name, result := range wireResults {
+		results[name] = fromWire(result)
+	}
+	return results, nil
+}
+
+// Stop stops the run in the kernel process. Nothing is running in a process
+// that is being started, so it isn't waited for.
+func (k *Kernel) Stop() {
+	k.notifyLive(stopMethod, nil)
+}
+
+// StopFormula stops a continuous formula in the kernel process
+func (k *Kernel) StopFormula(name string) {
+	k.notifyLive(stopFormulaMethod, stopFormulaParams{Name: name})
+}
+
+// notifyLive is notify for requests that only matter to a running process
+func (k *Kernel) notifyLive(method string, params any) {
+	c := k.live()
+	if c == nil {
+		return
+	}
+	err := c.call(context.Background(), method, params, nil)
+	if err != nil && !errors.Is(err, ErrExited) {
+		log.Printf("Kernel %s failed: %v", method, err)
+	}
+}
+
+// RenameFormula keeps the cached result of a renamed formula
+func (k *Kernel) RenameFormula(oldName, newName string) {
+	k.notify(renameFormulaMethod, renameParams{OldName: oldName, NewName: newName})
+}
+
+// SetPrelude sets the code shared by all formulas
+func (k *Kernel) SetPrelude(prelude string) {
+	k.mutex.Lock()
+	k.settings.prelude = prelude
+	k.mutex.Unlock()
+	k.notify(setPreludeMethod, preludeParams{Prelude: prelude})
+}
+
+// SetDotImportMath makes the math package usable without its name
+func (k *Kernel) SetDotImportMath(enabled bool) {
+	k.mutex.Lock()
+	k.settings.dotImportMath = enabled
+	k.mutex.Unlock()
+	k.notify(setDotImportMathMethod, dotImportMathParams{Enabled: enabled})
+}
+
+// SetPolicy sets what formulas are allowed to do
+func (k *Kernel) SetPolicy(policy kernel.Policy) {
+	k.mutex.Lock()
+	k.settings.policy = policy
+	k.mutex.Unlock()
+	k.notify(setPolicyMethod, policy)
+}
+
+// SetLimits sets the default limits of formulas
+func (k *Kernel) SetLimits(limits kernel.Limits) {
+	k.mutex.Lock()
+	k.settings.limits = limits
+	k.mutex.Unlock()
+	k.notify(setLimitsMethod, limits)
+}
+
+// SetParallelism sets how many formulas run at once
+func (k *Kernel) SetParallelism(parallelism int) {
+	k.mutex.Lock()
+	k.settings.parallelism = parallelism
+	k.mutex.Unlock()
+	k.notify(setParallelismMethod, parallelismParams{Parallelism: parallelism})
+}
+
+// AddListener adds a function called with the events of the kernel
+// process. Events are delivered one at a time in the order they happen, on
+// a goroutine of their own so that listeners can call the kernel. They can
+// arrive after the update that caused them returned.
+func (k *Kernel) AddListener(listener func(kernel.Event)) {
+	k.listenerMutex.Lock()
+	defer k.listenerMutex.Unlock()
+	k.listeners = append(k.listeners, listener)
+}
+
+// emit queues an event for the listeners. It is called by the goroutine
+// reading the answers of the process, which can't wait for the listeners.
+func (k *Kernel) emit(e wireEvent) {
+	event := kernel.Event{Type: e.Type, Name: e.Name, Result: fromWire(e.Result), Cached: e.Cached}
+	k.eventMutex.Lock()
+	defer k.eventMutex.Unlock()
+	k.events = append(k.events, event)
+	if !k.delivering {
+		k.delivering = true
+		go k.deliver()
+	}
+}
+
+// deliver calls the listeners with the queued events until there are none
+// left
+func (k *Kernel) deliver() {
+	for {
+		k.eventMutex.Lock()
+		if len(k.events) == 0 {
+			k.delivering = false
+			k.eventMutex.Unlock()
+			return
+		}
+		event := k.events[0]
+		k.events[0] = kernel.Event{}
+		k.events = k.events[1:]
+		k.eventMutex.Unlock()
+
+		k.listenerMutex.Lock()
+		listeners := k.listeners
+		k.listenerMutex.Unlock()
+		for _, listener := range listeners {
+			listener(event)
+		}
+	}
+}
+
+// Close stops the kernel process
+func (k *Kernel) Close() error {
+	k.mutex.Lock()
+	if k.closed {
+		k.mutex.Unlock()
+		return nil
+	}
+	k.closed = true
+	c := k.connection
+	k.mutex.Unlock()
+	if c == nil || !c.alive() {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	err := c.call(ctx, closeMethod, nil, nil)
+	c.stdin.Close()
+	select {
+	case <-c.exited:
+	case <-ctx.Done():
+		if c.kill != nil {
+			c.kill()
+		}
+	}
+	if errors.Is(err, ErrExited) {
+		return nil
+	}
+	return err
+}
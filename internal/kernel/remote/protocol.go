@@ -0,0 +1,249 @@
+// Package remote runs a kernel in a child process. The child is driven
+// with JSON-RPC 2.0 messages, one per line, over its stdin and stdout.
+package remote
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lrdickson/calx/internal/kernel"
+	"github.com/lrdickson/calx/internal/kernel/render"
+)
+
+const jsonrpcVersion = "2.0"
+
+// maxMessageSize is the longest line that can be read. Formulas and
+// results are sent whole, so this bounds how big a project can get.
+const maxMessageSize = 64 << 20
+
+// Methods of the protocol. Every method is a request from the parent
+// except eventMethod, which the child sends as a notification.
+const (
+	updateMethod           = "update"
+	evaluateMethod         = "evaluate"
+	stopMethod             = "stop"
+	stopFormulaMethod      = "stopFormula"
+	renameFormulaMethod    = "renameFormula"
+	setPreludeMethod       = "setPrelude"
+	setDotImportMathMethod = "setDotImportMath"
+	setPolicyMethod        = "setPolicy"
+	setLimitsMethod        = "setLimits"
+	setParallelismMethod   = "setParallelism"
+	closeMethod            = "close"
+	eventMethod            = "event"
+)
+
+// Error codes. The negative ones come from the JSON-RPC spec.
+const (
+	parseErrorCode     = -32700
+	methodNotFoundCode = -32601
+	invalidParamsCode  = -32602
+	internalErrorCode  = -32603
+	preludeErrorCode   = 1
+	closedErrorCode    = 2
+	cycleErrorCode     = 3
+	missingErrorCode   = 4
+	unknownErrorCode   = 5
+)
+
+// message is any message sent either way. Requests have a method and an
+// id, notifications have a method and no id and responses have an id and
+// a result or an error.
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      *int            `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// updateParams are the params of updateMethod and evaluateMethod. Name is
+// the formula to evaluate and is left out of updates.
+type updateParams struct {
+	Formulas map[string]*kernel.Formula `json:"formulas"`
+	Name     string                     `json:"name,omitempty"`
+}
+
+type stopFormulaParams struct {
+	Name string `json:"name"`
+}
+
+type renameParams struct {
+	OldName string `json:"oldName"`
+	NewName string `json:"newName"`
+}
+
+type preludeParams struct {
+	Prelude string `json:"prelude"`
+}
+
+type dotImportMathParams struct {
+	Enabled bool `json:"enabled"`
+}
+
+type parallelismParams struct {
+	Parallelism int `json:"parallelism"`
+}
+
+// wireResult is a kernel.Result on the wire. Value is the JSON encoding of
+// the value, which is left out when the value can't be encoded.
+type wireResult struct {
+	Value         json.RawMessage       `json:"value,omitempty"`
+	Text          string                `json:"text"`
+	Rendering     render.Rendering      `json:"rendering"`
+	Status        kernel.Status         `json:"status"`
+	Error         string                `json:"error,omitempty"`
+	CompileErrors []kernel.CompileError `json:"compileErrors,omitempty"`
+	Duration      time.Duration         `json:"duration"`
+	Warnings      []string              `json:"warnings,omitempty"`
+	Output        string                `json:"output,omitempty"`
+	Outputs       []wireOutput          `json:"outputs,omitempty"`
+}
+
+// wireOutput is a kernel.Output on the wire, with its value encoded the
+// way wireResult encodes values
+type wireOutput struct {
+	Name      string           `json:"name"`
+	Value     json.RawMessage  `json:"value,omitempty"`
+	Rendering render.Rendering `json:"rendering"`
+}
+
+func toWire(result *kernel.Result) *wireResult {
+	if result == nil {
+		return nil
+	}
+	value, err := json.Marshal(result.Value)
+	if err != nil {
+		value = nil
+	}
+	var outputs []wireOutput
+	for _, output := range result.Outputs {
+		outputValue, err := json.Marshal(output.Value)
+		if err != nil {
+			outputValue = nil
+		}
+		outputs = append(outputs, wireOutput{output.Name, outputValue, output.Rendering})
+	}
+	return &wireResult{
+		Value:         value,
+		Text:          result.Text,
+		Rendering:     result.Rendering,
+		Status:        result.Status,
+		Error:         result.Error,
+		CompileErrors: result.CompileErrors,
+		Duration:      result.Duration,
+		Warnings:      result.Warnings,
+		Output:        result.Output,
+		Outputs:       outputs,
+	}
+}
+
+// fromWire turns a result back into a kernel.Result. The value is decoded
+// the way encoding/json decodes into any, so numbers become float64. The
+// value of a result with outputs is decoded as kernel.Outputs.
+func fromWire(result *wireResult) *kernel.Result {
+	if result == nil {
+		return nil
+	}
+	var value any
+	if len(result.Value) > 0 {
+		json.Unmarshal(result.Value, &value)
+	}
+	var outputs []kernel.Output
+	if result.Outputs != nil {
+		values := make(kernel.Outputs, len(result.Outputs))
+		for _, output := range result.Outputs {
+			var outputValue any
+			if len(output.Value) > 0 {
+				json.Unmarshal(output.Value, &outputValue)
+			}
+			values[output.Name] = outputValue
+			outputs = append(outputs, kernel.Output{
+				Name:      output.Name,
+				Value:     outputValue,
+				Text:      output.Rendering.Text,
+				Rendering: output.Rendering,
+			})
+		}
+		value = values
+	}
+	return &kernel.Result{
+		Value:         value,
+		Text:          result.Text,
+		Rendering:     result.Rendering,
+		Status:        result.Status,
+		Error:         result.Error,
+		CompileErrors: result.CompileErrors,
+		Duration:      result.Duration,
+		Warnings:      result.Warnings,
+		Output:        result.Output,
+		Outputs:       outputs,
+	}
+}
+
+type wireEvent struct {
+	Type   kernel.EventType `json:"type"`
+	Name   string           `json:"name"`
+	Result *wireResult      `json:"result,omitempty"`
+	Cached bool             `json:"cached,omitempty"`
+}
+
+// toRPCError encodes an error so that the kernel errors callers check for
+// can be told apart on the other side
+func toRPCError(err error) *rpcError {
+	var (
+		preludeError *kernel.PreludeError
+		cycleError   *kernel.CycleError
+		missingError *kernel.MissingDependencyError
+		unknownError *kernel.UnknownFormulaError
+	)
+	withData := func(code int, data any) *rpcError {
+		encoded, _ := json.Marshal(data)
+		return &rpcError{Code: code, Message: err.Error(), Data: encoded}
+	}
+	switch {
+	case errors.As(err, &preludeError):
+		return withData(preludeErrorCode, preludeError.CompileErrors)
+	case errors.As(err, &cycleError):
+		return withData(cycleErrorCode, cycleError)
+	case errors.As(err, &missingError):
+		return withData(missingErrorCode, missingError)
+	case errors.As(err, &unknownError):
+		return withData(unknownErrorCode, unknownError)
+	case errors.Is(err, kernel.ErrClosed):
+		return &rpcError{Code: closedErrorCode, Message: err.Error()}
+	}
+	return &rpcError{Code: internalErrorCode, Message: err.Error()}
+}
+
+func (e *rpcError) toError() error {
+	switch e.Code {
+	case preludeErrorCode:
+		preludeError := &kernel.PreludeError{}
+		json.Unmarshal(e.Data, &preludeError.CompileErrors)
+		return preludeError
+	case cycleErrorCode:
+		cycleError := &kernel.CycleError{}
+		json.Unmarshal(e.Data, cycleError)
+		return cycleError
+	case missingErrorCode:
+		missingError := &kernel.MissingDependencyError{}
+		json.Unmarshal(e.Data, missingError)
+		return missingError
+	case unknownErrorCode:
+		unknownError := &kernel.UnknownFormulaError{}
+		json.Unmarshal(e.Data, unknownError)
+		return unknownError
+	case closedErrorCode:
+		return kernel.ErrClosed
+	}
+	return errors.New(e.Message)
+}
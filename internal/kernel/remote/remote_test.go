@@ -0,0 +1,389 @@
+package remote
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lrdickson/calx/internal/kernel"
+	"github.com/lrdickson/calx/internal/kernel/kerneltest"
+)
+
+// processEnv makes the test binary act as a kernel process
+const processEnv = "CALX_REMOTE_TEST_KERNEL"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(processEnv) == "1" {
+		protocol := os.Stdout
+		os.Stdout = os.Stderr
+		if err := Serve(kernel.NewLocalKernel(), os.Stdin, protocol); err != nil {
+			log.Fatalln("Kernel failed:", err)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func newTestKernel(t *testing.T) *Kernel {
+	t.Setenv(processEnv, "1")
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	goKernel, err := NewKernel(executable)
+	if err != nil {
+		t.Fatal("NewKernel returned error:", err)
+	}
+	t.Cleanup(func() { goKernel.Close() })
+	return goKernel
+}
+
+func TestUpdate(t *testing.T) {
+	goKernel := newTestKernel(t)
+	finished := make(chan kernel.Event, 10)
+	goKernel.AddListener(func(event kernel.Event) {
+		if event.Type == kernel.FinishedEvent {
+			finished <- event
+		}
+	})
+
+	input := map[string]*kernel.Formula{
+		"a": {Code: "return 1"},
+		"b": {Code: "return a + 2", Dependencies: []string{"a"}},
+		"c": {Code: `return "c"`},
+	}
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["b"].Text != "3" || output["b"].Value != 3.0 {
+		t.Fatal("b should be 3 but is", output["b"])
+	}
+	if output["c"].Value != "c" {
+		t.Fatal("c should be \"c\" but is", output["c"])
+	}
+
+	// Every formula sends a finished event
+	names := make(map[string]bool)
+	for len(names) < len(input) {
+		select {
+		case event := <-finished:
+			if event.Result.Status != kernel.StatusOK {
+				t.Fatal("Expected a finished event for", event.Name, "but got", event.Result)
+			}
+			names[event.Name] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected finished events for every formula but got", names)
+		}
+	}
+}
+
+func TestListenerCallsKernel(t *testing.T) {
+	goKernel := newTestKernel(t)
+	input := map[string]*kernel.Formula{
+		"a": {Code: "return 1"},
+		"b": {Code: "return a + 2"},
+	}
+
+	// A listener can run formulas again without waiting for its own event
+	evaluated := make(chan string, 1)
+	var once sync.Once
+	goKernel.AddListener(func(event kernel.Event) {
+		if event.Type != kernel.FinishedEvent || event.Name != "a" {
+			return
+		}
+		once.Do(func() {
+			output, err := goKernel.Update(context.Background(), input)
+			if err != nil {
+				evaluated <- err.Error()
+				return
+			}
+			evaluated <- output["b"].Text
+		})
+	})
+	if _, err := goKernel.Update(context.Background(), input); err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	select {
+	case text := <-evaluated:
+		if text != "3" {
+			t.Fatal("b should be 3 but is", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The listener deadlocked calling the kernel")
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	goKernel := newTestKernel(t)
+	input := map[string]*kernel.Formula{
+		"a": {Code: "return 1"},
+		"b": {Code: "return a + 2"},
+		"c": {Code: `return "c"`},
+	}
+	output, err := goKernel.Evaluate(context.Background(), input, "b")
+	if err != nil {
+		t.Fatal("Evaluate returned error:", err)
+	}
+	if len(output) != 2 || output["b"].Value != 3.0 {
+		t.Fatal("Only a and b should have been run but got", output)
+	}
+	if _, err := goKernel.Evaluate(context.Background(), input, "missing"); err == nil {
+		t.Fatal("Evaluating a missing formula should fail")
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	goKernel := newTestKernel(t)
+	input := map[string]*kernel.Formula{
+		"stats": {Code: "return 2.5, 4", Type: "(mean float64, count int)"},
+		"total": {Code: "return stats.mean * float64(stats.count)"},
+	}
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["total"].Text != "10" {
+		t.Fatal("total should be 10 but is", output["total"])
+	}
+	outputs := output["stats"].Outputs
+	if len(outputs) != 2 || outputs[1].Name != "mean" || outputs[1].Text != "2.5" || outputs[1].Value != 2.5 {
+		t.Fatal("stats should have the outputs count and mean but has", outputs)
+	}
+	if value, ok := output["stats"].Value.(kernel.Outputs); !ok || value["count"] != 4.0 {
+		t.Fatal("The value of stats should be Outputs but is", output["stats"].Value)
+	}
+}
+
+func TestPreludeError(t *testing.T) {
+	goKernel := newTestKernel(t)
+	goKernel.SetPrelude("const scale = 2\nfunc broken() int { return missing }")
+	_, err := goKernel.Update(context.Background(), map[string]*kernel.Formula{"a": {Code: "return 1"}})
+	var preludeError *kernel.PreludeError
+	if !errors.As(err, &preludeError) {
+		t.Fatal("Expected a prelude error but got", err)
+	}
+	if len(preludeError.CompileErrors) != 1 || preludeError.CompileErrors[0].Line != 2 {
+		t.Fatal("Expected an error on line 2 but got", preludeError.CompileErrors)
+	}
+}
+
+func TestGraphErrors(t *testing.T) {
+	goKernel := newTestKernel(t)
+	ctx := context.Background()
+	_, err := goKernel.Update(ctx, map[string]*kernel.Formula{
+		"a": {Code: "return b", Dependencies: []string{"b"}},
+		"b": {Code: "return a", Dependencies: []string{"a"}},
+	})
+	var cycleError *kernel.CycleError
+	if !errors.As(err, &cycleError) || len(cycleError.Chain) != 3 {
+		t.Fatal("Expected a cycle error but got", err)
+	}
+
+	_, err = goKernel.Update(ctx, map[string]*kernel.Formula{"a": {Code: "return b", Dependencies: []string{"b"}}})
+	var missingError *kernel.MissingDependencyError
+	if !errors.As(err, &missingError) || missingError.Name != "a" || missingError.Dependency != "b" {
+		t.Fatal("Expected a missing dependency error but got", err)
+	}
+
+	_, err = goKernel.Evaluate(ctx, map[string]*kernel.Formula{"a": {Code: "return 1"}}, "b")
+	var unknownError *kernel.UnknownFormulaError
+	if !errors.As(err, &unknownError) || unknownError.Name != "b" {
+		t.Fatal("Expected an unknown formula error but got", err)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	goKernel := newTestKernel(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	output, err := goKernel.Update(ctx, map[string]*kernel.Formula{"loop": {Code: "for {}"}})
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["loop"].Status != kernel.StatusCancelled {
+		t.Fatal("loop should have been cancelled but has", output["loop"])
+	}
+}
+
+func TestReadStdin(t *testing.T) {
+	goKernel := newTestKernel(t)
+	input := map[string]*kernel.Formula{
+		"line": {Code: "var line string\n_, err := fmt.Scanln(&line)\nreturn err.Error()", Imports: []string{"fmt"}},
+		"all":  {Code: "data, _ := io.ReadAll(os.Stdin)\nreturn len(data)", Imports: []string{"io", "os"}},
+	}
+
+	// Formulas see an empty stdin instead of the protocol stream
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	output, err := goKernel.Update(ctx, input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["line"].Text != "EOF" || output["all"].Text != "0" {
+		t.Fatal("Formulas should read nothing from stdin but got", output["line"], output["all"])
+	}
+	output, err = goKernel.Update(ctx, map[string]*kernel.Formula{"a": {Code: "return 1"}})
+	if err != nil || output["a"].Text != "1" {
+		t.Fatal("The kernel should still work but got", output, err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	goKernel := newTestKernel(t)
+	goKernel.SetPrelude("const scale = 2")
+	input := map[string]*kernel.Formula{"a": {Code: "return scale * 3"}}
+
+	// Kill the process in the middle of an update
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		goKernel.mutex.Lock()
+		defer goKernel.mutex.Unlock()
+		goKernel.connection.kill()
+	}()
+	_, err := goKernel.Update(context.Background(), map[string]*kernel.Formula{"loop": {Code: "for {}"}})
+	if !errors.Is(err, ErrExited) {
+		t.Fatal("Expected ErrExited but got", err)
+	}
+
+	// The new process gets the prelude again
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	if output["a"].Text != "6" {
+		t.Fatal("a should be 6 but is", output["a"])
+	}
+}
+
+func TestStopWhileStarting(t *testing.T) {
+	goKernel := newPipeKernel(t, kerneltest.New())
+	started := make(chan struct{})
+	release := make(chan struct{})
+	restarted := newPipeKernel(t, kerneltest.New())
+	goKernel.start = func(onEvent func(wireEvent)) (*connection, error) {
+		close(started)
+		<-release
+		return restarted.start(onEvent)
+	}
+	goKernel.mutex.Lock()
+	goKernel.connection.stdin.Close()
+	exited := goKernel.connection.exited
+	goKernel.mutex.Unlock()
+	<-exited
+
+	// Stop doesn't wait for the process that is being started
+	updated := make(chan error)
+	go func() {
+		_, err := goKernel.Update(context.Background(), map[string]*kernel.Formula{"a": {Code: "return 1"}})
+		updated <- err
+	}()
+	<-started
+	stopped := make(chan struct{})
+	go func() {
+		goKernel.Stop()
+		goKernel.StopFormula("a")
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited for the process to start")
+	}
+	close(release)
+	if err := <-updated; err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	goKernel := newTestKernel(t)
+	if err := goKernel.Close(); err != nil {
+		t.Fatal("Close returned error:", err)
+	}
+	_, err := goKernel.Update(context.Background(), map[string]*kernel.Formula{"a": {Code: "return 1"}})
+	if !errors.Is(err, kernel.ErrClosed) {
+		t.Fatal("Expected ErrClosed but got", err)
+	}
+}
+
+// newPipeKernel connects a Kernel to Serve through pipes instead of a
+// process
+func newPipeKernel(t *testing.T, served kernel.Kernel) *Kernel {
+	goKernel := &Kernel{start: func(onEvent func(wireEvent)) (*connection, error) {
+		requests, requestWriter := io.Pipe()
+		responseReader, responses := io.Pipe()
+		go func() {
+			Serve(served, requests, responses)
+			responses.Close()
+		}()
+		return newConnection(responseReader, requestWriter, onEvent), nil
+	}}
+	if _, err := goKernel.current(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { goKernel.Close() })
+	return goKernel
+}
+
+func TestServe(t *testing.T) {
+	fake := kerneltest.New()
+	fake.Results["failed"] = &kernel.Result{Status: kernel.StatusPanic, Error: "boom", Output: "printed\n"}
+	goKernel := newPipeKernel(t, fake)
+	events := make(chan kernel.Event, 10)
+	goKernel.AddListener(func(event kernel.Event) {
+		events <- event
+	})
+
+	// Settings are passed on as they are
+	policy := kernel.Policy{ReadFiles: true, Dir: "/data"}
+	limits := kernel.Limits{Timeout: time.Second, Memory: 1 << 20}
+	goKernel.SetPrelude("const scale = 2")
+	goKernel.SetDotImportMath(true)
+	goKernel.SetPolicy(policy)
+	goKernel.SetLimits(limits)
+	goKernel.SetParallelism(3)
+	goKernel.RenameFormula("old", "new")
+	input := map[string]*kernel.Formula{
+		"a":      {Code: "return 1", Imports: []string{"math"}, Type: "int"},
+		"failed": {Code: "panic(1)"},
+	}
+	output, err := goKernel.Update(context.Background(), input)
+	if err != nil {
+		t.Fatal("Update returned error:", err)
+	}
+	fake.Mutex.Lock()
+	defer fake.Mutex.Unlock()
+	if fake.Prelude != "const scale = 2" || !fake.DotImportMath || fake.Policy != policy || fake.Limits != limits || fake.Parallelism != 3 {
+		t.Fatal("Settings were not passed on:", fake)
+	}
+	if len(fake.Renames) != 1 || fake.Renames[0] != [2]string{"old", "new"} {
+		t.Fatal("Rename was not passed on:", fake.Renames)
+	}
+	if a := fake.Updates[0]["a"]; a.Type != "int" || len(a.Imports) != 1 {
+		t.Fatal("Formula was not passed on:", a)
+	}
+
+	// Results and events come back
+	if output["a"].Text != "return 1" || output["failed"].Status != kernel.StatusPanic || output["failed"].Error != "boom" ||
+		output["failed"].Output != "printed\n" {
+		t.Fatal("Unexpected output:", output)
+	}
+	var received []kernel.Event
+	for len(received) < 4 {
+		select {
+		case event := <-events:
+			received = append(received, event)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected 4 events but got", received)
+		}
+	}
+	if received[3].Type != kernel.FailedEvent || received[3].Name != "failed" {
+		t.Fatal("Unexpected events:", received)
+	}
+}
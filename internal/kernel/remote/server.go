@@ -0,0 +1,163 @@
+package remote
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/lrdickson/calx/internal/kernel"
+)
+
+// server answers the requests sent to a kernel process
+type server struct {
+	kernel  kernel.Kernel
+	encoder *json.Encoder
+	mutex   sync.Mutex
+	updates sync.WaitGroup
+}
+
+// send writes one message. Messages come from several goroutines so they
+// are written one at a time.
+func (s *server) send(m message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m.JSONRPC = jsonrpcVersion
+	s.encoder.Encode(m)
+}
+
+func (s *server) respond(id *int, result any, err error) {
+	if id == nil {
+		return
+	}
+	if err != nil {
+		s.send(message{ID: id, Error: toRPCError(err)})
+		return
+	}
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		s.send(message{ID: id, Error: &rpcError{Code: internalErrorCode, Message: err.Error()}})
+		return
+	}
+	s.send(message{ID: id, Result: encoded})
+}
+
+// handle runs one request. Updates and evaluations run in the background so
+// that they can be stopped, everything else is done in the order it was
+// sent.
+func (s *server) handle(request message) {
+	decode := func(params any) bool {
+		if err := json.Unmarshal(request.Params, params); err != nil {
+			s.send(message{ID: request.ID, Error: &rpcError{Code: invalidParamsCode, Message: err.Error()}})
+			return false
+		}
+		return true
+	}
+
+	switch request.Method {
+	case updateMethod, evaluateMethod:
+		var params updateParams
+		if !decode(&params) {
+			return
+		}
+		s.updates.Add(1)
+		go func() {
+			defer s.updates.Done()
+			var results map[string]*kernel.Result
+			var err error
+			if request.Method == evaluateMethod {
+				results, err = s.kernel.Evaluate(context.Background(), params.Formulas, params.Name)
+			} else {
+				results, err = s.kernel.Update(context.Background(), params.Formulas)
+			}
+			wireResults := make(map[string]*wireResult)
+			for name, result := range results {
+				wireResults[name] = toWire(result)
+			}
+			s.respond(request.ID, wireResults, err)
+		}()
+		return
+	case stopMethod:
+		s.kernel.Stop()
+	case stopFormulaMethod:
+		var params stopFormulaParams
+		if !decode(&params) {
+			return
+		}
+		s.kernel.StopFormula(params.Name)
+	case renameFormulaMethod:
+		var params renameParams
+		if !decode(&params) {
+			return
+		}
+		s.kernel.RenameFormula(params.OldName, params.NewName)
+	case setPreludeMethod:
+		var params preludeParams
+		if !decode(&params) {
+			return
+		}
+		s.kernel.SetPrelude(params.Prelude)
+	case setDotImportMathMethod:
+		var params dotImportMathParams
+		if !decode(&params) {
+			return
+		}
+		s.kernel.SetDotImportMath(params.Enabled)
+	case setPolicyMethod:
+		var policy kernel.Policy
+		if !decode(&policy) {
+			return
+		}
+		s.kernel.SetPolicy(policy)
+	case setLimitsMethod:
+		var limits kernel.Limits
+		if !decode(&limits) {
+			return
+		}
+		s.kernel.SetLimits(limits)
+	case setParallelismMethod:
+		var params parallelismParams
+		if !decode(&params) {
+			return
+		}
+		s.kernel.SetParallelism(params.Parallelism)
+	case closeMethod:
+		s.respond(request.ID, nil, s.kernel.Close())
+		return
+	default:
+		s.send(message{ID: request.ID, Error: &rpcError{Code: methodNotFoundCode, Message: "unknown method " + request.Method}})
+		return
+	}
+	s.respond(request.ID, nil, nil)
+}
+
+// Serve answers requests for a kernel until r is closed, then closes the
+// kernel. Events from the kernel are sent as notifications.
+func Serve(k kernel.Kernel, r io.Reader, w io.Writer) error {
+	s := &server{kernel: k, encoder: json.NewEncoder(w)}
+	k.AddListener(func(event kernel.Event) {
+		params, err := json.Marshal(wireEvent{event.Type, event.Name, toWire(event.Result), event.Cached})
+		if err == nil {
+			s.send(message{Method: eventMethod, Params: params})
+		}
+	})
+
+	// Read one message per line
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+	for scanner.Scan() {
+		var request message
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			s.send(message{Error: &rpcError{Code: parseErrorCode, Message: err.Error()}})
+			continue
+		}
+		s.handle(request)
+	}
+
+	// Let the running update finish before closing
+	k.Stop()
+	s.updates.Wait()
+	k.Close()
+	return scanner.Err()
+}
@@ -0,0 +1,124 @@
+package kernel
+
+import (
+	"errors"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"go/types"
+)
+
+// reservedNames are used by the code the kernel wraps around each formula
+// or declared by the kernel for every formula
+var reservedNames = map[string]bool{
+	"params":           true,
+	"Outputs":          true,
+	upstreamErrorsName: true,
+	emitName:           true,
+	everyName:          true,
+}
+
+// ValidateName checks that a name can be used as a variable name in formula
+// code
+func ValidateName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("name is empty")
+	case token.IsKeyword(name):
+		return fmt.Errorf("%s is a Go keyword", name)
+	case !token.IsIdentifier(name) || name == "_":
+		return fmt.Errorf("%q is not a valid Go identifier", name)
+	case types.Universe.Lookup(name) != nil:
+		return fmt.Errorf("%s is a predeclared Go identifier", name)
+	case mathSymbols[name]:
+		return fmt.Errorf("%s is already defined by the math package", name)
+	case reservedNames[name]:
+		return fmt.Errorf("%s is reserved", name)
+	}
+	return nil
+}
+
+// countFree counts the references to a variable in formula code
+func countFree(code, name string) (int, error) {
+	identifiers, err := freeIdentifiers(code)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, identifier := range identifiers {
+		if identifier.Name == name {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// replaceFree replaces the references to variables in formula code and
+// returns how many were replaced
+func replaceFree(code string, replacements map[string]string) (string, int, error) {
+	fset, file, err := parseFormula(code)
+	if err != nil {
+		return code, 0, err
+	}
+
+	// Replace each reference from the end so the offsets stay valid
+	replaced := code
+	count := 0
+	for index := len(file.Unresolved) - 1; index >= 0; index-- {
+		identifier := file.Unresolved[index]
+		replacement, exists := replacements[identifier.Name]
+		if !exists {
+			continue
+		}
+		offset := fset.Position(identifier.Pos()).Offset - len(formulaHeader)
+		replaced = replaced[:offset] + replacement + replaced[offset+len(identifier.Name):]
+		count++
+	}
+	return replaced, count, nil
+}
+
+// mentionsName reports whether code that may not parse uses name as an
+// identifier anywhere
+func mentionsName(code, name string) bool {
+	fset := token.NewFileSet()
+	var s scanner.Scanner
+	s.Init(fset.AddFile("", -1, len(code)), []byte(code), nil, 0)
+	for {
+		_, tok, literal := s.Scan()
+		switch {
+		case tok == token.EOF:
+			return false
+		case tok == token.IDENT && literal == name:
+			return true
+		}
+	}
+}
+
+// RenameReferences rewrites formula code so that references to the
+// variable oldName use newName instead. Declarations in the code that
+// shadow oldName, strings and comments are left alone. Code that doesn't
+// parse is left alone when it doesn't mention oldName. An error is returned
+// if it does, or if newName is already declared where the references are.
+func RenameReferences(code, oldName, newName string) (string, error) {
+	renamed, renamedCount, err := replaceFree(code, map[string]string{oldName: newName})
+	if err != nil && !mentionsName(code, oldName) {
+		return code, nil
+	}
+	if err != nil || renamedCount == 0 {
+		return code, err
+	}
+
+	// Make sure none of the references were captured by a local declaration
+	before, err := countFree(code, newName)
+	if err != nil {
+		return code, err
+	}
+	after, err := countFree(renamed, newName)
+	if err != nil {
+		return code, err
+	}
+	if after != before+renamedCount {
+		return code, fmt.Errorf("%s is already declared in the formula", newName)
+	}
+	return renamed, nil
+}
@@ -0,0 +1,85 @@
+package render
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// formatScalar formats booleans, numbers and text. It returns false for
+// values of other kinds.
+func formatScalar(v reflect.Value, options Options) (string, bool) {
+	switch v.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if options.Rounded || options.Percent {
+			return formatFloat(float64(v.Int()), 64, options), true
+		}
+		return groupThousands(strconv.FormatInt(v.Int(), 10), options), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if options.Rounded || options.Percent {
+			return formatFloat(float64(v.Uint()), 64, options), true
+		}
+		return groupThousands(strconv.FormatUint(v.Uint(), 10), options), true
+	case reflect.Float32:
+		return formatFloat(v.Float(), 32, options), true
+	case reflect.Float64:
+		return formatFloat(v.Float(), 64, options), true
+	case reflect.Complex64, reflect.Complex128:
+		return strconv.FormatComplex(v.Complex(), 'g', -1, v.Type().Bits()), true
+	case reflect.String:
+		return v.String(), true
+	}
+	return "", false
+}
+
+// formatFloat formats a number with the options. Numbers that are too big
+// or small to write out in full use an exponent.
+func formatFloat(number float64, bitSize int, options Options) string {
+	if options.Percent {
+		number *= 100
+	}
+	precision := -1
+	if options.Rounded {
+		precision = options.Precision
+	}
+	format := byte('f')
+	if abs := math.Abs(number); abs >= 1e21 || (abs != 0 && abs < 1e-7 && !options.Rounded) {
+		format = 'g'
+	}
+	text := groupThousands(strconv.FormatFloat(number, format, precision, bitSize), options)
+	if options.Percent {
+		text += "%"
+	}
+	return text
+}
+
+// groupThousands separates groups of three digits in the whole part of a
+// formatted number with commas when the options ask for it
+func groupThousands(number string, options Options) string {
+	if !options.Thousands {
+		return number
+	}
+	sign := ""
+	if strings.HasPrefix(number, "-") {
+		sign, number = "-", number[1:]
+	}
+	end := strings.IndexAny(number, ".eE")
+	if end < 0 {
+		end = len(number)
+	}
+	whole, rest := number[:end], number[end:]
+	if len(whole) <= 3 || strings.ContainsAny(whole, "InfNa") {
+		return sign + number
+	}
+	var grouped strings.Builder
+	for index, digit := range whole {
+		if index > 0 && (len(whole)-index)%3 == 0 {
+			grouped.WriteByte(',')
+		}
+		grouped.WriteRune(digit)
+	}
+	return sign + grouped.String() + rest
+}
@@ -0,0 +1,487 @@
+// Package render turns formula results into text, tables, trees and images
+// for showing them to users. Renderers can be registered for Go types and
+// user types can render themselves with a Render method.
+//
+// The package only uses the standard library since compiled formula
+// programs carry a copy of it.
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRows is how many rows of a table or elements of a list are rendered
+const maxRows = 1000
+
+// maxDepth is how deeply nested values are rendered, which also stops
+// pointer cycles
+const maxDepth = 8
+
+// Options are the display settings of a variable. The zero value shows
+// numbers with as many digits as they need.
+type Options struct {
+	// Rounded numbers get exactly Precision digits after the decimal point
+	Rounded   bool
+	Precision int
+
+	// Thousands separates groups of three digits with commas
+	Thousands bool
+
+	// Percent shows numbers multiplied by 100 with a % sign
+	Percent bool
+}
+
+// Table is a rendering of a list of records, a list of lists or a map.
+// Columns is nil when the columns have no names.
+type Table struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// Tree is a rendering of a nested value such as a struct
+type Tree struct {
+	Label    string
+	Children []*Tree
+}
+
+// Rendering is a value made ready to show. Text is always set so that
+// anything can show it, the richer forms are set for the values that have
+// them.
+type Rendering struct {
+	Text  string
+	Table *Table
+	Tree  *Tree
+
+	// Image is PNG encoded
+	Image []byte
+
+	// Custom is true when the value rendered itself with a Render method,
+	// which doesn't take Options into account
+	Custom bool
+}
+
+// Renderer renders values of a single type
+type Renderer func(value any, options Options) Rendering
+
+// TextRenderer is implemented by types that know how they should be shown
+type TextRenderer interface {
+	Render() string
+}
+
+// Registry holds the renderers for specific types. Values of other types
+// are rendered according to their kind.
+type Registry struct {
+	mutex     sync.RWMutex
+	renderers map[reflect.Type]Renderer
+}
+
+// Default is the registry used by Register and Render
+var Default = NewRegistry()
+
+// NewRegistry returns a registry with the built in renderers
+func NewRegistry() *Registry {
+	r := &Registry{renderers: make(map[reflect.Type]Renderer)}
+	r.Register(reflect.TypeOf(time.Time{}), renderTime)
+	return r
+}
+
+// Register sets the renderer used for values of type t, replacing any
+// renderer that was registered for it before
+func (r *Registry) Register(t reflect.Type, renderer Renderer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.renderers[t] = renderer
+}
+
+// Register sets the renderer used by Render for values of type t
+func Register(t reflect.Type, renderer Renderer) {
+	Default.Register(t, renderer)
+}
+
+// Render renders a value with the default registry
+func Render(value any, options Options) Rendering {
+	return Default.Render(value, options)
+}
+
+// Render renders a value. Registered renderers come first, then the
+// TextRenderer, image.Image, error and fmt.Stringer interfaces. Other
+// values are rendered by kind: numbers and text as text, lists of records
+// and maps as tables, and structs as trees.
+func (r *Registry) Render(value any, options Options) Rendering {
+	if rendering, ok := r.custom(value, options); ok {
+		return rendering
+	}
+	v := reflect.ValueOf(value)
+	for v.Kind() == reflect.Pointer && !v.IsNil() {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		if table := r.listTable(v, options); table != nil {
+			return Rendering{Text: table.text(v.Len()), Table: table}
+		}
+	case reflect.Map:
+		table := r.mapTable(v, options)
+		return Rendering{Text: table.text(v.Len()), Table: table}
+	case reflect.Struct:
+		if tree := r.tree(typeName(v.Type()), v, options, 0); len(tree.Children) > 0 {
+			return Rendering{Text: tree.text(), Tree: tree}
+		}
+	}
+	return Rendering{Text: r.inline(v, options, 0)}
+}
+
+// custom renders values that have a renderer or implement one of the
+// interfaces
+func (r *Registry) custom(value any, options Options) (Rendering, bool) {
+	if value == nil {
+		return Rendering{Text: "nil"}, true
+	}
+	r.mutex.RLock()
+	renderer, exists := r.renderers[reflect.TypeOf(value)]
+	r.mutex.RUnlock()
+	if exists {
+		return renderer(value, options), true
+	}
+
+	switch value := value.(type) {
+	case TextRenderer:
+		return Rendering{Text: value.Render(), Custom: true}, true
+	case image.Image:
+		return renderImage(value), true
+	case error:
+		return Rendering{Text: value.Error()}, true
+	case fmt.Stringer:
+		return Rendering{Text: value.String()}, true
+	}
+	return Rendering{}, false
+}
+
+// inline renders a value on a single line
+func (r *Registry) inline(v reflect.Value, options Options, depth int) string {
+	if !v.IsValid() {
+		return "nil"
+	}
+	if v.CanInterface() {
+		if rendering, ok := r.custom(v.Interface(), options); ok {
+			return strings.ReplaceAll(rendering.Text, "\n", " ")
+		}
+	}
+	if text, ok := formatScalar(v, options); ok {
+		return text
+	}
+	if depth >= maxDepth {
+		return "..."
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return "nil"
+		}
+		return r.inline(v.Elem(), options, depth+1)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return "[]"
+		}
+		elements := make([]string, 0, v.Len())
+		for index := 0; index < v.Len() && index < maxRows; index++ {
+			elements = append(elements, r.inline(v.Index(index), options, depth+1))
+		}
+		if v.Len() > maxRows {
+			elements = append(elements, "... "+strconv.Itoa(v.Len()-maxRows)+" more")
+		}
+		return "[" + strings.Join(elements, ", ") + "]"
+	case reflect.Map:
+		entries := make([]string, 0, v.Len())
+		for _, entry := range r.mapEntries(v, options, depth+1) {
+			entries = append(entries, entry[0]+": "+entry[1])
+		}
+		return "{" + strings.Join(entries, ", ") + "}"
+	case reflect.Struct:
+		fields := make([]string, 0, v.NumField())
+		for _, field := range exportedFields(v.Type()) {
+			fields = append(fields, v.Type().Field(field).Name+": "+r.inline(v.Field(field), options, depth+1))
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	case reflect.Func, reflect.Chan:
+		return v.Type().String()
+	}
+	return fmt.Sprint(v)
+}
+
+// listTable makes a table of a list of records or of lists. It returns nil
+// for other lists.
+func (r *Registry) listTable(v reflect.Value, options Options) *Table {
+	elementType := v.Type().Elem()
+	if r.hasRenderer(elementType) {
+		return nil
+	}
+	switch underlying(elementType).Kind() {
+	case reflect.Struct:
+		fields := exportedFields(underlying(elementType))
+		if len(fields) == 0 {
+			return nil
+		}
+		table := &Table{Columns: make([]string, 0, len(fields))}
+		for _, field := range fields {
+			table.Columns = append(table.Columns, underlying(elementType).Field(field).Name)
+		}
+		for index := 0; index < v.Len() && index < maxRows; index++ {
+			element := v.Index(index)
+			for element.Kind() == reflect.Pointer && !element.IsNil() {
+				element = element.Elem()
+			}
+			row := make([]string, len(fields))
+			if element.Kind() == reflect.Struct {
+				for column, field := range fields {
+					row[column] = r.inline(element.Field(field), options, 1)
+				}
+			}
+			table.Rows = append(table.Rows, row)
+		}
+		return table
+	case reflect.Slice, reflect.Array:
+		table := &Table{}
+		for index := 0; index < v.Len() && index < maxRows; index++ {
+			element := v.Index(index)
+			for element.Kind() == reflect.Pointer && !element.IsNil() {
+				element = element.Elem()
+			}
+			row := make([]string, 0)
+			if element.Kind() == reflect.Slice || element.Kind() == reflect.Array {
+				for column := 0; column < element.Len(); column++ {
+					row = append(row, r.inline(element.Index(column), options, 1))
+				}
+			}
+			table.Rows = append(table.Rows, row)
+		}
+		return table
+	}
+	return nil
+}
+
+// mapTable makes a table of the keys and values of a map
+func (r *Registry) mapTable(v reflect.Value, options Options) *Table {
+	table := &Table{Columns: []string{"Key", "Value"}}
+	for _, entry := range r.mapEntries(v, options, 1) {
+		table.Rows = append(table.Rows, []string{entry[0], entry[1]})
+	}
+	return table
+}
+
+// mapEntries renders the keys and values of a map, sorted by key
+func (r *Registry) mapEntries(v reflect.Value, options Options, depth int) [][2]string {
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return lessKey(keys[i], keys[j]) })
+	entries := make([][2]string, 0, len(keys))
+	for index, key := range keys {
+		if index == maxRows {
+			break
+		}
+		entries = append(entries, [2]string{r.inline(key, options, depth), r.inline(v.MapIndex(key), options, depth)})
+	}
+	return entries
+}
+
+// tree makes a tree of a nested value
+func (r *Registry) tree(label string, v reflect.Value, options Options, depth int) *Tree {
+	for (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && !v.IsNil() {
+		v = v.Elem()
+	}
+	leaf := func() *Tree {
+		return &Tree{Label: joinLabel(label, r.inline(v, options, depth))}
+	}
+	if !v.IsValid() || depth >= maxDepth || (v.CanInterface() && r.hasCustom(v.Interface())) {
+		return leaf()
+	}
+
+	node := &Tree{Label: label}
+	switch v.Kind() {
+	case reflect.Struct:
+		for _, field := range exportedFields(v.Type()) {
+			node.Children = append(node.Children, r.tree(v.Type().Field(field).Name, v.Field(field), options, depth+1))
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return lessKey(keys[i], keys[j]) })
+		for index, key := range keys {
+			if index == maxRows {
+				break
+			}
+			node.Children = append(node.Children, r.tree(r.inline(key, options, depth+1), v.MapIndex(key), options, depth+1))
+		}
+	case reflect.Slice, reflect.Array:
+		for index := 0; index < v.Len() && index < maxRows; index++ {
+			node.Children = append(node.Children, r.tree("["+strconv.Itoa(index)+"]", v.Index(index), options, depth+1))
+		}
+	default:
+		return leaf()
+	}
+	if len(node.Children) == 0 {
+		return leaf()
+	}
+	return node
+}
+
+// hasRenderer reports whether values of a type render themselves or have a
+// registered renderer, so they shouldn't be taken apart
+func (r *Registry) hasRenderer(t reflect.Type) bool {
+	r.mutex.RLock()
+	_, exists := r.renderers[t]
+	r.mutex.RUnlock()
+	if exists {
+		return true
+	}
+	for _, i := range []reflect.Type{
+		reflect.TypeOf((*TextRenderer)(nil)).Elem(),
+		reflect.TypeOf((*image.Image)(nil)).Elem(),
+		reflect.TypeOf((*error)(nil)).Elem(),
+		reflect.TypeOf((*fmt.Stringer)(nil)).Elem(),
+	} {
+		if t.Implements(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Registry) hasCustom(value any) bool {
+	return value != nil && r.hasRenderer(reflect.TypeOf(value))
+}
+
+// text lays out the table in aligned columns. length is the number of rows
+// before the table was cut short.
+func (t *Table) text(length int) string {
+	rows := t.Rows
+	if t.Columns != nil {
+		separators := make([]string, len(t.Columns))
+		for index, column := range t.Columns {
+			separators[index] = strings.Repeat("-", len([]rune(column)))
+		}
+		rows = append([][]string{t.Columns, separators}, rows...)
+	}
+	widths := make([]int, 0)
+	for _, row := range rows {
+		for index, cell := range row {
+			if index == len(widths) {
+				widths = append(widths, 0)
+			}
+			if width := len([]rune(cell)); width > widths[index] {
+				widths[index] = width
+			}
+		}
+	}
+
+	var text strings.Builder
+	for rowIndex, row := range rows {
+		if rowIndex > 0 {
+			text.WriteString("\n")
+		}
+		line := ""
+		for index, cell := range row {
+			if index < len(row)-1 {
+				cell += strings.Repeat(" ", widths[index]-len([]rune(cell))+2)
+			}
+			line += cell
+		}
+		text.WriteString(line)
+	}
+	if length > len(t.Rows) {
+		text.WriteString("\n... " + strconv.Itoa(length-len(t.Rows)) + " more rows")
+	}
+	return text.String()
+}
+
+// text lays out the tree with each level indented by two spaces. A root
+// without a label is left out.
+func (t *Tree) text() string {
+	lines := make([]string, 0)
+	var write func(node *Tree, indent string)
+	write = func(node *Tree, indent string) {
+		lines = append(lines, indent+node.Label)
+		for _, child := range node.Children {
+			write(child, indent+"  ")
+		}
+	}
+	if t.Label != "" {
+		write(t, "")
+	} else {
+		for _, child := range t.Children {
+			write(child, "")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func joinLabel(label, text string) string {
+	if label == "" {
+		return text
+	}
+	return label + ": " + text
+}
+
+func renderTime(value any, options Options) Rendering {
+	t := value.(time.Time)
+	if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+		return Rendering{Text: t.Format("2006-01-02")}
+	}
+	return Rendering{Text: t.Format("2006-01-02 15:04:05 MST")}
+}
+
+func renderImage(value image.Image) Rendering {
+	bounds := value.Bounds()
+	rendering := Rendering{Text: strconv.Itoa(bounds.Dx()) + "x" + strconv.Itoa(bounds.Dy()) + " image"}
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, value); err == nil {
+		rendering.Image = encoded.Bytes()
+	}
+	return rendering
+}
+
+// underlying is the type a pointer type points to
+func underlying(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+// exportedFields returns the indexes of the fields that can be read
+func exportedFields(t reflect.Type) []int {
+	fields := make([]int, 0, t.NumField())
+	for index := 0; index < t.NumField(); index++ {
+		if t.Field(index).IsExported() {
+			fields = append(fields, index)
+		}
+	}
+	return fields
+}
+
+// typeName is the name of a type without its package, or an empty string
+// for types without a name
+func typeName(t reflect.Type) string {
+	return t.Name()
+}
+
+// lessKey orders map keys, numbers by value and everything else by text
+func lessKey(a, b reflect.Value) bool {
+	switch {
+	case a.CanInt() && b.CanInt():
+		return a.Int() < b.Int()
+	case a.CanUint() && b.CanUint():
+		return a.Uint() < b.Uint()
+	case a.CanFloat() && b.CanFloat():
+		return a.Float() < b.Float()
+	}
+	return fmt.Sprint(a) < fmt.Sprint(b)
+}
@@ -0,0 +1,125 @@
+package render
+
+import (
+	"errors"
+	"image"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type point struct {
+	X, Y   int
+	hidden bool
+}
+
+type shape struct {
+	Name   string
+	Points []point
+	Tags   map[string]int
+}
+
+type money int64
+
+func (m money) Render() string {
+	return "$" + strings.Repeat("!", int(m))
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		value    any
+		options  Options
+		expected string
+	}{
+		{nil, Options{}, "nil"},
+		{true, Options{}, "true"},
+		{int64(-1234567), Options{}, "-1234567"},
+		{int64(-1234567), Options{Thousands: true}, "-1,234,567"},
+		{uint8(7), Options{Rounded: true, Precision: 2}, "7.00"},
+		{1.0 / 3, Options{}, "0.3333333333333333"},
+		{float32(0.1), Options{}, "0.1"},
+		{1234.5678, Options{Rounded: true, Precision: 1, Thousands: true}, "1,234.6"},
+		{0.256, Options{Percent: true}, "25.6%"},
+		{0.256, Options{Percent: true, Rounded: true}, "26%"},
+		{1e300, Options{Thousands: true}, "1e+300"},
+		{"text", Options{Thousands: true}, "text"},
+		{complex(1, -2), Options{}, "(1-2i)"},
+		{[]int{1000, 2000}, Options{Thousands: true}, "[1,000, 2,000]"},
+		{[]any{1.5, "a", nil, []string{"b"}}, Options{}, "[1.5, a, nil, [b]]"},
+		{[3]bool{}, Options{}, "[false, false, false]"},
+		{errors.New("boom"), Options{}, "boom"},
+		{2 * time.Second, Options{}, "2s"},
+		{time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), Options{}, "2024-02-29"},
+		{time.Date(2024, 2, 29, 13, 4, 5, 0, time.UTC), Options{}, "2024-02-29 13:04:05 UTC"},
+		{money(3), Options{}, "$!!!"},
+		{[]money{1, 2}, Options{}, "[$!, $!!]"},
+		{&point{1, 2, true}, Options{}, "point\n  X: 1\n  Y: 2"},
+		{struct{ A []int }{[]int{1, 2}}, Options{}, "A\n  [0]: 1\n  [1]: 2"},
+		{[]point{{1, 2, false}, {30, 4, false}}, Options{}, "X   Y\n-   -\n1   2\n30  4"},
+		{[][]float64{{1, 2.5}, {3}}, Options{Percent: true}, "100%  250%\n300%"},
+		{map[int]string{10: "ten", 9: "nine"}, Options{}, "Key  Value\n---  -----\n9    nine\n10   ten"},
+	}
+	for _, test := range tests {
+		if text := Render(test.value, test.options).Text; text != test.expected {
+			t.Errorf("Render(%#v, %+v) = %q, expected %q", test.value, test.options, text, test.expected)
+		}
+	}
+}
+
+func TestRichRenderings(t *testing.T) {
+	value := shape{"square", []point{{0, 0, false}, {1, 1, false}}, map[string]int{"b": 2, "a": 1}}
+	tree := Render(value, Options{}).Tree
+	expected := &Tree{Label: "shape", Children: []*Tree{
+		{Label: "Name: square"},
+		{Label: "Points", Children: []*Tree{
+			{Label: "[0]", Children: []*Tree{{Label: "X: 0"}, {Label: "Y: 0"}}},
+			{Label: "[1]", Children: []*Tree{{Label: "X: 1"}, {Label: "Y: 1"}}},
+		}},
+		{Label: "Tags", Children: []*Tree{{Label: "a: 1"}, {Label: "b: 2"}}},
+	}}
+	if !reflect.DeepEqual(tree, expected) {
+		t.Errorf("Unexpected tree: %+v", tree)
+	}
+
+	table := Render([]shape{value}, Options{}).Table
+	if table == nil || !reflect.DeepEqual(table.Rows, [][]string{{"square", "[{X: 0, Y: 0}, {X: 1, Y: 1}]", "{a: 1, b: 2}"}}) {
+		t.Errorf("Unexpected table: %+v", table)
+	}
+
+	rendering := Render(image.NewGray(image.Rect(0, 0, 3, 2)), Options{})
+	if rendering.Text != "3x2 image" || !strings.HasPrefix(string(rendering.Image), "\x89PNG") {
+		t.Errorf("Unexpected image rendering: %q", rendering.Text)
+	}
+
+	if rendering := Render(make([]int, maxRows+5), Options{}); !strings.HasSuffix(rendering.Text, ", 0, ... 5 more]") {
+		t.Error("Long lists should be cut short")
+	}
+	if rendering := Render(make([][]int, maxRows+5), Options{}); len(rendering.Table.Rows) != maxRows ||
+		!strings.HasSuffix(rendering.Text, "\n... 5 more rows") {
+		t.Error("Long tables should be cut short")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register(reflect.TypeOf(point{}), func(value any, options Options) Rendering {
+		p := value.(point)
+		return Rendering{Text: formatFloat(float64(p.X), 64, options) + "/" + formatFloat(float64(p.Y), 64, options)}
+	})
+	tests := map[string]any{
+		"100%/200%":                            point{1, 2, false},
+		"[100%/200%]":                          []point{{1, 2, false}},
+		"Key  Value\n---  -----\na    100%/0%": map[string]point{"a": {1, 0, false}},
+	}
+	for expected, value := range tests {
+		if text := registry.Render(value, Options{Percent: true}).Text; text != expected {
+			t.Errorf("Render(%#v) = %q, expected %q", value, text, expected)
+		}
+	}
+
+	// Other registries are left alone
+	if text := Render(point{1, 2, false}, Options{}).Text; text != "point\n  X: 1\n  Y: 2" {
+		t.Error("The default registry shouldn't use the renderer but returned", text)
+	}
+}
@@ -0,0 +1,9 @@
+package render
+
+import "embed"
+
+// Source holds the code of this package other than this file, so that
+// compiled formula programs render their results the same way
+//
+//go:embed format.go render.go
+var Source embed.FS
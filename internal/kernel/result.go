@@ -0,0 +1,119 @@
+package kernel
+
+import (
+	"errors"
+	"go/scanner"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/lrdickson/calx/internal/kernel/render"
+)
+
+type Status int
+
+const (
+	StatusOK Status = iota
+	StatusCompileError
+	StatusPanic
+	StatusSkipped
+	StatusCancelled
+	StatusTimeout
+	StatusDenied
+	StatusLimitExceeded
+	StatusError
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusCompileError:
+		return "compile error"
+	case StatusPanic:
+		return "runtime panic"
+	case StatusSkipped:
+		return "skipped"
+	case StatusCancelled:
+		return "cancelled"
+	case StatusTimeout:
+		return "timed out"
+	case StatusDenied:
+		return "denied"
+	case StatusLimitExceeded:
+		return "limit exceeded"
+	case StatusError:
+		return "error"
+	}
+	return "unknown status " + strconv.Itoa(int(s))
+}
+
+// interrupted reports whether the formula was stopped before it could finish
+func (s Status) interrupted() bool {
+	return s == StatusCancelled || s == StatusTimeout || s == StatusLimitExceeded
+}
+
+// CompileError is a single compiler message. Line and Column point into the
+// formula code written by the user. A Line of 0 means the error is in code
+// generated by the kernel.
+type CompileError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e CompileError) String() string {
+	return strconv.Itoa(e.Line) + ":" + strconv.Itoa(e.Column) + ": " + e.Message
+}
+
+// Result is the outcome of running a single formula. Text is the text of
+// Rendering, which is only set when the formula succeeded.
+type Result struct {
+	Value         any
+	Text          string
+	Rendering     render.Rendering
+	Status        Status
+	Error         string
+	CompileErrors []CompileError
+	Duration      time.Duration
+	Warnings      []string
+
+	// Output is what the formula printed to stdout and stderr
+	Output string
+
+	// Outputs are the named results of a formula that returned Outputs,
+	// each rendered on its own
+	Outputs []Output
+}
+
+var positionPattern = regexp.MustCompile(`^(?:[^:]*:)?(\d+):(\d+): (.*)$`)
+
+// newCompileError parses a yaegi error message and moves its position back
+// by the number of lines the kernel added in front of the formula code
+func newCompileError(message string, lineOffset int) CompileError {
+	match := positionPattern.FindStringSubmatch(message)
+	if match == nil {
+		return CompileError{Message: message}
+	}
+	line, _ := strconv.Atoi(match[1])
+	column, _ := strconv.Atoi(match[2])
+	line -= lineOffset
+	if line < 1 {
+		return CompileError{Message: match[3]}
+	}
+	return CompileError{line, column, match[3]}
+}
+
+// compileErrors splits an error returned by the interpreter into compiler
+// messages
+func compileErrors(err error, lineOffset int) []CompileError {
+	var errorList scanner.ErrorList
+	if errors.As(err, &errorList) {
+		compileErrors := make([]CompileError, 0, len(errorList))
+		for _, e := range errorList {
+			compileErrors = append(compileErrors, newCompileError(e.Error(), lineOffset))
+		}
+		return compileErrors
+	}
+	return []CompileError{newCompileError(err.Error(), lineOffset)}
+}
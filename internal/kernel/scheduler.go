@@ -0,0 +1,218 @@
+package kernel
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/lrdickson/calx/internal/kernel/clone"
+)
+
+// job is a formula that is ready to be run by a worker
+type job struct {
+	name       string
+	formula    Formula
+	params     []any
+	paramTypes []paramType
+	imports    []string
+	limits     Limits
+
+	// upstreamErrors are the errors of the failed dependencies of a
+	// formula that catches them
+	upstreamErrors map[string]error
+
+	// emit and every are set for continuous formulas
+	emit  func(Result)
+	every func(interval time.Duration) <-chan time.Time
+}
+
+// jobResult is sent back to the scheduler when a worker finishes a job
+type jobResult struct {
+	name   string
+	result Result
+}
+
+// startWorkers starts a fixed number of workers that run jobs until the
+// jobs channel is closed
+func (k *LocalKernel) startWorkers(ctx context.Context, count int, jobs <-chan job, finished chan<- jobResult) {
+	for i := 0; i < count; i++ {
+		go func() {
+			for j := range jobs {
+				log.Println(j.name, "running function")
+				k.emit(Event{Type: StartedEvent, Name: j.name})
+				start := time.Now()
+				result := k.run(ctx, j)
+				result.Duration = time.Since(start)
+				log.Println(j.name, "function returned result", result.Value)
+				finished <- jobResult{j.name, result}
+			}
+		}()
+	}
+}
+
+// run runs a job with an interpreter, or without one for expressions
+func (k *LocalKernel) run(ctx context.Context, j job) Result {
+	if j.formula.Language == LanguageExpression {
+		return evaluateExpression(j.formula, j.params, j.upstreamErrors)
+	}
+	if j.formula.isContinuous() {
+		return k.startContinuous(ctx, j)
+	}
+	return k.pool.run(ctx, j)
+}
+
+// resolve stores the result of a formula and reports it
+func (k *LocalKernel) resolve(name string, formula *Formula, result Result) {
+	k.store(name, formula, result)
+	k.emitResult(name, k.cache[name].result, false)
+}
+
+// prepare decides what to do with a formula whose dependencies are done.
+// It returns a job if the formula has to be run, otherwise the result is
+// resolved right away.
+func (k *LocalKernel) prepare(ctx context.Context, name string, formulas map[string]*Formula) (job, bool) {
+	formula := formulas[name]
+	dirty := k.isDirty(name, formula)
+
+	// A continuous formula that is still running gives its latest value
+	// instead of being started again
+	if formula.isContinuous() {
+		run := k.runningFormula(name)
+		if run == nil || dirty {
+			k.StopFormula(name)
+			dirty = true
+		} else if result, fresh := run.take(); fresh {
+			k.resolve(name, formula, result)
+			return job{}, false
+		}
+	}
+	if !dirty {
+		log.Println("Reusing cached result for:", name)
+		if entry := k.cache[name]; entry.display != formula.Display {
+			entry.result = rerender(entry.result, formula.Display)
+			entry.display = formula.Display
+		}
+		k.emitResult(name, k.cache[name].result, true)
+		return job{}, false
+	}
+
+	// Don't start anything new once the run is stopped
+	if ctx.Err() != nil {
+		k.resolve(name, formula, Result{Status: StatusCancelled, Error: ctx.Err().Error()})
+		return job{}, false
+	}
+
+	// Get the function parameters
+	params := make([]any, 0, len(formula.Dependencies))
+	paramTypes := make([]paramType, 0, len(formula.Dependencies))
+	writer := typeWriter{imports: make(map[string]bool)}
+	for _, importPath := range formula.Imports {
+		writer.imports[importPath] = true
+	}
+	upstreamErrors := make(map[string]error)
+	for _, dependency := range formula.Dependencies {
+		dependencyResult := k.cache[dependency].result
+		declared := declaredParamType(formulas[dependency])
+
+		// Formulas that catch errors get the zero value of a failed dependency
+		if dependencyResult.Status != StatusOK && formula.CatchErrors {
+			upstreamErrors[dependency] = upstreamError(dependency, dependencyResult)
+			params = append(params, nil)
+			paramTypes = append(paramTypes, declared)
+			continue
+		}
+		if dependencyResult.Status != StatusOK {
+			log.Println(name, "skipped because", dependency, "failed")
+			k.resolve(name, formula, Result{
+				Status: StatusSkipped,
+				Error:  "upstream failed: " + dependency,
+			})
+			return job{}, false
+		}
+
+		// Each formula gets its own copy so that changing an input can't
+		// change what other formulas see
+		params = append(params, clone.Value(dependencyResult.Value))
+
+		// Use the declared type if there is one
+		if declared.declared {
+			paramTypes = append(paramTypes, declared)
+		} else {
+			paramTypes = append(paramTypes, writer.valueType(dependencyResult.Value))
+		}
+	}
+	return job{
+		name:       name,
+		formula:    *formula,
+		params:     params,
+		paramTypes: paramTypes,
+		imports:    writer.sortedImports(),
+		limits:     k.formulaLimits(*formula),
+
+		upstreamErrors: upstreamErrors,
+	}, true
+}
+
+// schedule runs each formula as soon as all of its dependencies are done,
+// with at most parallelism formulas running at once. order must list the
+// formulas so that dependencies come first.
+func (k *LocalKernel) schedule(ctx context.Context, formulas map[string]*Formula, order []string, parallelism int) {
+	// Count how many dependencies each formula is waiting on
+	waiting := make(map[string]int)
+	dependents := make(map[string][]string)
+	ready := make([]string, 0)
+	for _, name := range order {
+		seen := make(map[string]bool)
+		for _, dependency := range formulas[name].Dependencies {
+			if !seen[dependency] {
+				seen[dependency] = true
+				waiting[name]++
+				dependents[dependency] = append(dependents[dependency], name)
+			}
+		}
+		if waiting[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+
+	// Start the workers
+	if parallelism > len(formulas) {
+		parallelism = len(formulas)
+	}
+	jobs := make(chan job, len(formulas))
+	finished := make(chan jobResult, len(formulas))
+	defer close(jobs)
+	k.startWorkers(ctx, parallelism, jobs, finished)
+
+	// complete queues up the dependents that are no longer waiting
+	complete := func(name string) {
+		for _, dependent := range dependents[name] {
+			waiting[dependent]--
+			if waiting[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	running := 0
+	for len(ready) > 0 || running > 0 {
+		// Hand out everything that is ready
+		if len(ready) > 0 {
+			name := ready[0]
+			ready = ready[1:]
+			if j, needed := k.prepare(ctx, name, formulas); needed {
+				jobs <- j
+				running++
+			} else {
+				complete(name)
+			}
+			continue
+		}
+
+		// Wait for a worker to finish
+		done := <-finished
+		running--
+		k.resolve(done.name, formulas[done.name], done.result)
+		complete(done.name)
+	}
+}
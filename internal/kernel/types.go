@@ -0,0 +1,166 @@
+package kernel
+
+import (
+	"go/token"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// paramType is how a dependency is unpacked in the generated code
+type paramType struct {
+	// expr is the Go type of the parameter. It is empty when the type can't
+	// be written out and the parameter is left as any.
+	expr string
+
+	// declared is true when expr was declared by the dependency. Declared
+	// types may hold nil so they are asserted without panicking.
+	declared bool
+
+	// outputs are set for dependencies that return Outputs, which are
+	// unpacked as a struct with a field for each output. Fields with an
+	// empty type are left as any.
+	outputs []namedResult
+}
+
+// source writes the type out, with outputs as a struct
+func (t paramType) source() string {
+	if t.outputs == nil {
+		return anyIfEmpty(t.expr)
+	}
+	fields := make([]string, 0, len(t.outputs))
+	for _, output := range t.outputs {
+		fields = append(fields, output.name+" "+anyIfEmpty(output.typeSource))
+	}
+	return "struct{" + strings.Join(fields, "; ") + "}"
+}
+
+// importAlias is the name a package is imported as in generated code. The
+// alias keeps the package from clashing with variable names.
+func importAlias(path string) string {
+	return "_" + strings.NewReplacer("/", "_", ".", "_", "-", "_").Replace(path)
+}
+
+// typeWriter writes reflect types out as Go source and keeps track of the
+// packages the source needs
+type typeWriter struct {
+	imports map[string]bool
+}
+
+func (w *typeWriter) write(t reflect.Type) (string, bool) {
+	// Named types can be used by name if they are exported
+	if t.Name() != "" {
+		if t.PkgPath() == "" {
+			return t.Name(), true
+		}
+		if !token.IsExported(t.Name()) || strings.Contains(t.Name(), "[") {
+			return "", false
+		}
+		w.imports[t.PkgPath()] = true
+		return importAlias(t.PkgPath()) + "." + t.Name(), true
+	}
+
+	// Otherwise build the type up from its parts
+	switch t.Kind() {
+	case reflect.Pointer:
+		elem, ok := w.write(t.Elem())
+		return "*" + elem, ok
+	case reflect.Slice:
+		elem, ok := w.write(t.Elem())
+		return "[]" + elem, ok
+	case reflect.Array:
+		elem, ok := w.write(t.Elem())
+		return "[" + strconv.Itoa(t.Len()) + "]" + elem, ok
+	case reflect.Map:
+		key, keyOk := w.write(t.Key())
+		elem, elemOk := w.write(t.Elem())
+		return "map[" + key + "]" + elem, keyOk && elemOk
+	case reflect.Chan:
+		elem, ok := w.write(t.Elem())
+		switch t.ChanDir() {
+		case reflect.RecvDir:
+			return "<-chan " + elem, ok
+		case reflect.SendDir:
+			return "chan<- " + elem, ok
+		}
+		return "chan " + elem, ok
+	case reflect.Struct:
+		fields := make([]string, 0, t.NumField())
+		for index := 0; index < t.NumField(); index++ {
+			field := t.Field(index)
+			if !field.IsExported() || field.Anonymous {
+				return "", false
+			}
+			fieldType, ok := w.write(field.Type)
+			if !ok {
+				return "", false
+			}
+			fields = append(fields, field.Name+" "+fieldType)
+		}
+		return "struct{" + strings.Join(fields, "; ") + "}", true
+	case reflect.Func:
+		params := make([]string, 0, t.NumIn())
+		for index := 0; index < t.NumIn(); index++ {
+			param, ok := w.write(t.In(index))
+			if !ok {
+				return "", false
+			}
+			if t.IsVariadic() && index == t.NumIn()-1 {
+				param = "..." + strings.TrimPrefix(param, "[]")
+			}
+			params = append(params, param)
+		}
+		results := make([]string, 0, t.NumOut())
+		for index := 0; index < t.NumOut(); index++ {
+			result, ok := w.write(t.Out(index))
+			if !ok {
+				return "", false
+			}
+			results = append(results, result)
+		}
+		return "func(" + strings.Join(params, ", ") + ") (" + strings.Join(results, ", ") + ")", true
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			return "any", true
+		}
+	}
+	return "", false
+}
+
+// valueType returns the Go type that a dependency's value is unpacked as.
+// Values whose type can't be written out are passed as an error if they are
+// one and as any otherwise.
+func (w *typeWriter) valueType(value any) paramType {
+	if value == nil {
+		return paramType{}
+	}
+	if outputs, ok := value.(Outputs); ok {
+		named := make([]namedResult, 0, len(outputs))
+		for name, output := range outputs {
+			named = append(named, namedResult{name, w.valueType(output).expr})
+		}
+		sort.Slice(named, func(i, j int) bool { return named[i].name < named[j].name })
+		return outputsParamType(named, false)
+	}
+	valueType := reflect.TypeOf(value)
+	if expr, ok := w.write(valueType); ok {
+		return paramType{expr: expr}
+	}
+	if valueType.Implements(errorType) {
+		return paramType{expr: "error"}
+	}
+	return paramType{}
+}
+
+// sortedImports lists the packages that the generated code imports
+func (w *typeWriter) sortedImports() []string {
+	imports := make([]string, 0, len(w.imports))
+	for path := range w.imports {
+		imports = append(imports, path)
+	}
+	sort.Strings(imports)
+	return imports
+}
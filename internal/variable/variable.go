@@ -20,3 +20,8 @@ type Formula struct {
 func (f Formula) Code() string {
 	return f.code
 }
+
+func (f Formula) WithCode(code string) Formula {
+	f.code = code
+	return f
+}
@@ -2,14 +2,19 @@ package view
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"strconv"
 	"strings"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/data/binding"
 	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
 	"fyne.io/fyne/v2/widget"
+	"github.com/lrdickson/calx/internal/kernel"
+	"github.com/lrdickson/calx/internal/kernel/render"
 	"golang.org/x/exp/slices"
 )
 
@@ -18,7 +23,7 @@ type editView struct {
 	updateEditorView  func(*formulaInfo)
 }
 
-func updateRenameFunction(editorVariable string, variables map[string]*formulaInfo, parentWindow fyne.Window) func() {
+func updateRenameFunction(editorVariable string, variables map[string]*formulaInfo, goKernel kernel.Kernel, parentWindow fyne.Window) func() {
 	return func() {
 
 		// Create the name editor form item
@@ -32,22 +37,9 @@ func updateRenameFunction(editorVariable string, variables map[string]*formulaIn
 				return errors.New(input + " is already taken")
 			}
 
-			// Check for valid characters
-			letters := `ABCDEFGHIJKLMNOPQRSTUVWXYZ`
-			letters += `abcdefghijklmnopqrstuvwxyz`
-			validCharacters := letters
-			validCharacters += `0123456789`
-			validCharacters += `_`
-			for index, character := range input {
-				characterString := string(character)
-				if index == 1 && !strings.Contains(letters, characterString) {
-					log.Println("Invalid variable name")
-					return errors.New(`"` + characterString + "\" is not a valid 1st character")
-				}
-				if !strings.Contains(validCharacters, characterString) {
-					log.Println("Invalid variable name")
-					return errors.New(`"` + characterString + "\" is not a valid character")
-				}
+			// Check that the name can be used in formula code
+			if oldName != input {
+				return kernel.ValidateName(input)
 			}
 			return nil
 		}
@@ -69,7 +61,26 @@ func updateRenameFunction(editorVariable string, variables map[string]*formulaIn
 				return
 			}
 
+			// Rewrite the formulas that refer to the variable
+			renamedCode := make(map[string]string)
+			for name, variable := range variables {
+				code, err := variable.code.Get()
+				checkErrFatal("Failed to get formula code:", err)
+				language, err := variable.language.Get()
+				checkErrFatal("Failed to get formula language:", err)
+				formula := kernel.Formula{Code: code, Language: parseLanguage(language)}
+				renamedCode[name], err = formula.RenameReferences(oldName, newName)
+				if err != nil {
+					dialog.ShowError(fmt.Errorf("failed to update %s: %w", name, err), parentWindow)
+					return
+				}
+			}
+			for name, code := range renamedCode {
+				variables[name].code.Set(code)
+			}
+
 			// Update the variable
+			goKernel.RenameFormula(oldName, newName)
 			variables[oldName].name.Set(newName)
 			variables[newName] = variables[oldName]
 			delete(variables, oldName)
@@ -174,30 +185,145 @@ func updateDeleteFunction() func() {
 	return func() {}
 }
 
-func newEditView(variables map[string]*formulaInfo, parentWindow fyne.Window) *editView {
+func newEditView(variables map[string]*formulaInfo, goKernel kernel.Kernel, parentWindow fyne.Window, runFormula func(name string)) *editView {
 	// Create the editor
 	variableEditor := widget.NewMultiLineEntry()
 	variableEditor.SetPlaceHolder("Formula")
+	returnTypeEditor := widget.NewEntry()
+	returnTypeEditor.SetPlaceHolder("Return type, e.g. (int, error) or (mean, stdev float64) (optional)")
+	importsEditor := widget.NewEntry()
+	importsEditor.SetPlaceHolder("Imports (e.g. strings, math/rand)")
 	editorVariable := ""
 
+	// Show the result and what the formula printed during the last run
+	var previousVariable *formulaInfo
+	resultView := container.NewMax()
+	updateResultView := func() {
+		if previousVariable == nil {
+			return
+		}
+		value, err := previousVariable.rendering.Get()
+		checkErrFatal("Failed to get formula rendering:", err)
+		rendering, _ := value.(render.Rendering)
+		resultView.Objects = []fyne.CanvasObject{newRenderingView(rendering)}
+		resultView.Refresh()
+	}
+	resultListener := binding.NewDataListener(updateResultView)
+	consoleLabel := widget.NewLabel("")
+	consoleLabel.TextStyle = fyne.TextStyle{Monospace: true}
+	outputTabs := container.NewAppTabs(
+		container.NewTabItem("Result", resultView),
+		container.NewTabItem("Console", container.NewScroll(consoleLabel)),
+	)
+	editorSplit := container.NewVSplit(variableEditor, outputTabs)
+	editorSplit.Offset = 0.6
+
+	// Pick how numbers in the result are shown
+	precisions := []string{"0", "1", "2", "3", "4", "5", "6"}
+	updateDisplay := func(update func(display *render.Options)) {
+		if previousVariable != nil {
+			update(previousVariable.display)
+		}
+	}
+	roundedCheck := widget.NewCheck("Round to", func(checked bool) {
+		updateDisplay(func(display *render.Options) { display.Rounded = checked })
+	})
+	precisionSelect := widget.NewSelect(precisions, func(precision string) {
+		updateDisplay(func(display *render.Options) { display.Precision, _ = strconv.Atoi(precision) })
+	})
+	thousandsCheck := widget.NewCheck("1,000 separators", func(checked bool) {
+		updateDisplay(func(display *render.Options) { display.Thousands = checked })
+	})
+	percentCheck := widget.NewCheck("Percent", func(checked bool) {
+		updateDisplay(func(display *render.Options) { display.Percent = checked })
+	})
+	displayView := container.NewHBox(roundedCheck, precisionSelect, widget.NewLabel("digits"), thousandsCheck, percentCheck)
+
+	// Run the formula when its dependencies fail so that it can handle
+	// their errors
+	catchErrorsCheck := widget.NewCheck("Handle upstream errors", nil)
+
+	// Keep the formula running so that it can emit values over time
+	continuousCheck := widget.NewCheck("Keep running (continuous)", nil)
+
+	// Imports, return types and continuous running only apply to Go formulas
+	goSettings := container.NewVBox(returnTypeEditor, importsEditor, continuousCheck)
+	languageSelect := widget.NewSelect(languages, func(language string) {
+		if parseLanguage(language) == kernel.LanguageExpression {
+			variableEditor.SetPlaceHolder("Expression (e.g. =SUM(sales) * 1.2)")
+			goSettings.Hide()
+		} else {
+			variableEditor.SetPlaceHolder("Formula")
+			goSettings.Show()
+		}
+		if previousVariable != nil {
+			previousVariable.language.Set(language)
+		}
+	})
+
+	// Suggest imports for packages the formula uses
+	suggestionsView := container.NewHBox()
+	updateSuggestions := func() {
+		if previousVariable == nil {
+			return
+		}
+		code, err := previousVariable.code.Get()
+		checkErrFatal("Failed to get formula code:", err)
+		imports, err := previousVariable.imports.Get()
+		checkErrFatal("Failed to get formula imports:", err)
+		names := make([]string, 0, len(variables))
+		for name := range variables {
+			names = append(names, name)
+		}
+		language, err := previousVariable.language.Get()
+		checkErrFatal("Failed to get formula language:", err)
+		formula := kernel.Formula{Code: code, Language: parseLanguage(language), Imports: parseImports(imports)}
+		suggestionButtons := make([]fyne.CanvasObject, 0)
+		for _, suggestion := range kernel.SuggestImports(formula, names) {
+			importPath := suggestion
+			importsBinding := previousVariable.imports
+			suggestionButtons = append(suggestionButtons, widget.NewButton("Import "+importPath, func() {
+				imports, err := importsBinding.Get()
+				checkErrFatal("Failed to get formula imports:", err)
+				importsBinding.Set(strings.Join(append(parseImports(imports), importPath), ", "))
+			}))
+		}
+		suggestionsView.Objects = suggestionButtons
+		suggestionsView.Refresh()
+	}
+	suggestionListener := binding.NewDataListener(updateSuggestions)
+
 	// Create the input view
 	inputView, updateInputView := newInputView(editorVariable, variables)
 
 	// Add the delete button
 	deleteButton := widget.NewButton("Delete", nil)
 
+	// Run only this formula and the formulas it needs
+	runFormulaButton := widget.NewButton("Run this formula", func() {
+		if editorVariable != "" {
+			runFormula(editorVariable)
+		}
+	})
+
+	// Stop this formula if it is running continuously
+	stopFormulaButton := widget.NewButton("Stop this formula", func() {
+		if editorVariable != "" {
+			goKernel.StopFormula(editorVariable)
+		}
+	})
+
 	// Add the name label
 	editNameButton := widget.NewButton("Rename", nil)
 	nameLabel := widget.NewLabel(editorVariable)
-	nameView := container.NewBorder(nil, nil, nil, container.NewHBox(editNameButton, deleteButton),
+	nameView := container.NewBorder(nil, nil, languageSelect, container.NewHBox(runFormulaButton, stopFormulaButton, editNameButton, deleteButton),
 		container.New(layout.NewCenterLayout(), nameLabel))
 
 	// Build the view
-	var previousVariable *formulaInfo
 	return &editView{
 		editViewContainer: container.NewBorder(
-			container.NewBorder(nameView, nil, nil, nil, inputView),
-			nil, nil, nil, variableEditor),
+			container.NewBorder(nameView, container.NewVBox(goSettings, suggestionsView, catchErrorsCheck, displayView), nil, nil, inputView),
+			nil, nil, nil, editorSplit),
 		updateEditorView: func(variable *formulaInfo) {
 			// Return if variable doesn't exist
 			if variable == nil {
@@ -210,14 +336,35 @@ func newEditView(variables map[string]*formulaInfo, parentWindow fyne.Window) *e
 
 			if editorVariable != name {
 				editorVariable = name
-				editNameButton.OnTapped = updateRenameFunction(name, variables, parentWindow)
+				editNameButton.OnTapped = updateRenameFunction(name, variables, goKernel, parentWindow)
 				deleteButton.OnTapped = updateDeleteFunction()
 			}
 
 			if previousVariable != variable {
+				if previousVariable != nil {
+					previousVariable.code.RemoveListener(suggestionListener)
+					previousVariable.imports.RemoveListener(suggestionListener)
+					previousVariable.rendering.RemoveListener(resultListener)
+				}
 				previousVariable = variable
 				nameLabel.Bind(variable.name)
 				variableEditor.Bind(variable.code)
+				consoleLabel.Bind(variable.console)
+				returnTypeEditor.Bind(variable.returnType)
+				importsEditor.Bind(variable.imports)
+				catchErrorsCheck.Bind(variable.catchErrors)
+				continuousCheck.Bind(variable.continuous)
+				language, err := variable.language.Get()
+				checkErrFatal("Failed to get formula language:", err)
+				languageSelect.SetSelected(language)
+				display := *variable.display
+				roundedCheck.SetChecked(display.Rounded)
+				precisionSelect.SetSelected(strconv.Itoa(display.Precision))
+				thousandsCheck.SetChecked(display.Thousands)
+				percentCheck.SetChecked(display.Percent)
+				variable.code.AddListener(suggestionListener)
+				variable.imports.AddListener(suggestionListener)
+				variable.rendering.AddListener(resultListener)
 			}
 
 			// This will probably change every time
@@ -1,8 +1,13 @@
 package view
 
 import (
+	"context"
 	"log"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
@@ -12,12 +17,21 @@ import (
 	"fyne.io/fyne/v2/storage"
 	"fyne.io/fyne/v2/widget"
 	"github.com/lrdickson/calx/internal/kernel"
+	"github.com/lrdickson/calx/internal/kernel/render"
 )
 
 type formulaInfo struct {
+	catchErrors  binding.Bool
 	code         binding.String
+	console      binding.String
+	continuous   binding.Bool
+	display      *render.Options
+	imports      binding.String
+	language     binding.String
 	name         binding.String
 	output       binding.String
+	rendering    binding.Untyped
+	returnType   binding.String
 	dependencies map[string]*formulaInfo
 	dependents   map[string]*formulaInfo
 }
@@ -28,13 +42,40 @@ func checkErrFatal(message string, err error) {
 	}
 }
 
+// languages are the languages a formula can be written in, as shown in the
+// editor
+var languages = []string{kernel.LanguageGo.String(), kernel.LanguageExpression.String()}
+
+// parseLanguage returns the language picked in the editor
+func parseLanguage(text string) kernel.Language {
+	if text == kernel.LanguageExpression.String() {
+		return kernel.LanguageExpression
+	}
+	return kernel.LanguageGo
+}
+
+// parseImports splits the import paths typed into the editor
+func parseImports(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// getVariable returns the variable of a row of the display list, which for
+// an output row is the variable it is an output of
 func getVariable(variables binding.UntypedList, id widget.ListItemID) formulaInfo {
 	variablesInterface, err := variables.Get()
 	checkErrFatal("Failed to get variable interface array:", err)
+	if row, ok := variablesInterface[id].(outputRow); ok {
+		return row.formula
+	}
 	return variablesInterface[id].(formulaInfo)
 }
 
-func RunGui() {
+// RunGui shows the main window, running formulas with goKernel.
+// compiledKernel runs them instead while Compile With Go is checked, the
+// menu item is left out when it is nil.
+func RunGui(goKernel, compiledKernel kernel.Kernel) {
 	mainApp := app.New()
 	mainWindow := mainApp.NewWindow("Calx")
 
@@ -56,15 +97,114 @@ func RunGui() {
 		saveAsDialog.Show()
 	})
 
+	// Create the prelude editor shared by all formulas
+	prelude := binding.NewString()
+	preludeItem := fyne.NewMenuItem("Prelude...", func() {
+		preludeEditor := widget.NewEntryWithData(prelude)
+		preludeEditor.MultiLine = true
+		preludeEditor.SetPlaceHolder("Types, functions, constants and imports shared by every formula")
+		preludeDialog := dialog.NewCustom("Prelude", "Close", preludeEditor, mainWindow)
+		preludeDialog.Resize(fyne.NewSize(500, 400))
+		preludeDialog.Show()
+	})
+
+	// Let math be dot imported
+	var mainMenu *fyne.MainMenu
+	dotImportMathItem := fyne.NewMenuItem("Dot Import Math", nil)
+	dotImportMathItem.Action = func() {
+		dotImportMathItem.Checked = !dotImportMathItem.Checked
+		mainMenu.Refresh()
+	}
+
+	// Let heavy formulas be compiled instead of interpreted
+	compileItem := fyne.NewMenuItem("Compile With Go", nil)
+	compileItem.Action = func() {
+		compileItem.Checked = !compileItem.Checked
+		mainMenu.Refresh()
+	}
+
+	// Let the user choose what formulas may do. Nothing but computing is
+	// allowed until they do.
+	var policy kernel.Policy
+	policyItem := fyne.NewMenuItem("Policy...", func() {
+		readFilesCheck := widget.NewCheck("", nil)
+		readFilesCheck.SetChecked(policy.ReadFiles)
+		dirEntry := widget.NewEntry()
+		dirEntry.SetText(policy.Dir)
+		dirEntry.SetPlaceHolder("Project directory")
+		networkCheck := widget.NewCheck("", nil)
+		networkCheck.SetChecked(policy.Network)
+		items := []*widget.FormItem{
+			widget.NewFormItem("Read files", readFilesCheck),
+			widget.NewFormItem("Directory", dirEntry),
+			widget.NewFormItem("Network", networkCheck),
+		}
+		dialog.ShowForm("Formula Policy", "Save", "Cancel", items, func(confirm bool) {
+			if !confirm {
+				return
+			}
+			policy = kernel.Policy{
+				ReadFiles: readFilesCheck.Checked,
+				Dir:       dirEntry.Text,
+				Network:   networkCheck.Checked,
+			}
+		}, mainWindow)
+	})
+
+	// Let the user limit the resources each formula can use
+	var limits kernel.Limits
+	limitsItem := fyne.NewMenuItem("Limits...", func() {
+		timeoutEntry := widget.NewEntry()
+		timeoutEntry.SetText(limits.Timeout.String())
+		timeoutEntry.Validator = func(text string) error {
+			_, err := time.ParseDuration(text)
+			return err
+		}
+		memoryEntry := widget.NewEntry()
+		memoryEntry.SetText(strconv.FormatUint(limits.Memory>>20, 10))
+		memoryEntry.Validator = func(text string) error {
+			_, err := strconv.ParseUint(text, 10, 64)
+			return err
+		}
+		goroutinesEntry := widget.NewEntry()
+		goroutinesEntry.SetText(strconv.Itoa(limits.Goroutines))
+		goroutinesEntry.Validator = func(text string) error {
+			_, err := strconv.Atoi(text)
+			return err
+		}
+		items := []*widget.FormItem{
+			widget.NewFormItem("Timeout", timeoutEntry),
+			widget.NewFormItem("Memory (MiB)", memoryEntry),
+			widget.NewFormItem("Goroutines", goroutinesEntry),
+		}
+		for _, item := range items {
+			item.HintText = "0 means no limit"
+		}
+		dialog.ShowForm("Formula Limits", "Save", "Cancel", items, func(confirm bool) {
+			if !confirm {
+				return
+			}
+			timeout, _ := time.ParseDuration(timeoutEntry.Text)
+			memory, _ := strconv.ParseUint(memoryEntry.Text, 10, 64)
+			goroutines, _ := strconv.Atoi(goroutinesEntry.Text)
+			limits = kernel.Limits{Timeout: timeout, Memory: memory << 20, Goroutines: goroutines}
+		}, mainWindow)
+	})
+
 	// Put the main menu together
 	fileMenu := fyne.NewMenu("File", openItem, saveItem, saveAsItem)
-	mainMenu := fyne.NewMainMenu(fileMenu)
+	projectMenu := fyne.NewMenu("Project", preludeItem, dotImportMathItem, policyItem, limitsItem)
+	if compiledKernel != nil {
+		projectMenu.Items = append(projectMenu.Items, fyne.NewMenuItemSeparator(), compileItem)
+	}
+	mainMenu = fyne.NewMainMenu(fileMenu, projectMenu)
 	mainWindow.SetMainMenu(mainMenu)
 
 	// Create child views
 	variables := make(map[string]*formulaInfo)
-	mainEditView := newEditView(variables, mainWindow)
-	displayVariables, displayVariablesView := newVariableDisplayView(variables)
+	var runFormulas func(target string)
+	mainEditView := newEditView(variables, goKernel, mainWindow, func(name string) { runFormulas(name) })
+	displayVariables, displayVariablesView, showOutputs := newVariableDisplayView(variables)
 
 	// Update the editor view when a variable is selected
 	var selectedVariable *formulaInfo
@@ -91,33 +231,132 @@ func RunGui() {
 		nameDisplay.Set(name)
 
 		// Build the variable
+		catchErrors := binding.NewBool()
 		code := binding.NewString()
+		console := binding.NewString()
+		continuous := binding.NewBool()
+		imports := binding.NewString()
+		language := binding.NewString()
+		language.Set(kernel.LanguageGo.String())
 		output := binding.NewString()
-		newVariable := formulaInfo{code, nameDisplay, output, make(map[string]*formulaInfo), make(map[string]*formulaInfo)}
+		rendering := binding.NewUntyped()
+		returnType := binding.NewString()
+		newVariable := formulaInfo{catchErrors, code, console, continuous, &render.Options{}, imports, language, nameDisplay, output, rendering, returnType, make(map[string]*formulaInfo), make(map[string]*formulaInfo)}
 		displayVariables.Append(newVariable)
 		variables[name] = &newVariable
 		mainEditView.updateEditorView(selectedVariable)
 	})
 
-	// Run variable code button
-	goKernel := kernel.NewKernel()
-	runButton := widget.NewButton("Run", func() {
+	// Show each result as soon as it is ready
+	showEvent := func(event kernel.Event) {
+		variable, exists := variables[event.Name]
+		if !exists {
+			return
+		}
+		switch event.Type {
+		case kernel.StartedEvent:
+			variable.output.Set("Running...")
+			variable.console.Set("")
+			showOutputs(variable, nil)
+		case kernel.FinishedEvent:
+			variable.output.Set(event.Result.Text)
+			variable.rendering.Set(event.Result.Rendering)
+			variable.console.Set(event.Result.Output)
+			showOutputs(variable, event.Result.Outputs)
+		case kernel.FailedEvent:
+			variable.console.Set(event.Result.Output)
+			showOutputs(variable, nil)
+			output := event.Result.Status.String() + ": " + event.Result.Error
+			for _, warning := range event.Result.Warnings {
+				output += "\nwarning: " + warning
+			}
+			variable.output.Set(output)
+			variable.rendering.Set(render.Rendering{Text: output})
+		}
+	}
+	goKernel.AddListener(showEvent)
+	if compiledKernel != nil {
+		compiledKernel.AddListener(showEvent)
+	}
+
+	// Run every formula, or only a target formula and what it needs
+	var running atomic.Bool
+	var runButton *widget.Button
+	runKernel := goKernel
+	runFormulas = func(target string) {
+		// Stop the formulas if they are already running
+		if running.Load() {
+			runKernel.Stop()
+			return
+		}
+		runKernel = goKernel
+		if compileItem.Checked && compiledKernel != nil {
+			runKernel = compiledKernel
+		}
+
 		input := make(map[string]*kernel.Formula)
 		for name := range variables {
 			code, err := variables[name].code.Get()
 			checkErrFatal("Failed to get formula code:", err)
-			dependencies := make([]string, 0, len(variables[name].dependencies))
+			returnType, err := variables[name].returnType.Get()
+			checkErrFatal("Failed to get formula return type:", err)
+			imports, err := variables[name].imports.Get()
+			checkErrFatal("Failed to get formula imports:", err)
+			language, err := variables[name].language.Get()
+			checkErrFatal("Failed to get formula language:", err)
+			catchErrors, err := variables[name].catchErrors.Get()
+			checkErrFatal("Failed to get whether the formula handles upstream errors:", err)
+			continuous, err := variables[name].continuous.Get()
+			checkErrFatal("Failed to get whether the formula is continuous:", err)
+
+			// Let the kernel find the dependencies unless they were picked
+			var dependencies []string
 			for dependencyName := range variables[name].dependencies {
 				dependencies = append(dependencies, dependencyName)
 			}
-			input[name] = &kernel.Formula{Code: code, Dependencies: dependencies}
-		}
-		output := goKernel.Update(input)
-		log.Println("Run output:", output)
-		for name, variable := range variables {
-			variable.output.Set(output[name])
+			input[name] = &kernel.Formula{
+				Code:         code,
+				Language:     parseLanguage(language),
+				Dependencies: dependencies,
+				Imports:      parseImports(imports),
+				Type:         returnType,
+				CatchErrors:  catchErrors,
+				Continuous:   continuous,
+				Display:      *variables[name].display,
+			}
 		}
-	})
+
+		preludeCode, err := prelude.Get()
+		checkErrFatal("Failed to get prelude code:", err)
+		runKernel.SetPrelude(preludeCode)
+		runKernel.SetDotImportMath(dotImportMathItem.Checked)
+		runKernel.SetPolicy(policy)
+		runKernel.SetLimits(limits)
+
+		// Run in the background so that the run can be stopped
+		running.Store(true)
+		runButton.SetText("Stop")
+		updateKernel := runKernel
+		go func() {
+			defer func() {
+				running.Store(false)
+				runButton.SetText("Run")
+			}()
+			var output map[string]*kernel.Result
+			var err error
+			if target == "" {
+				output, err = updateKernel.Update(context.Background(), input)
+			} else {
+				output, err = updateKernel.Evaluate(context.Background(), input, target)
+			}
+			if err != nil {
+				dialog.ShowError(err, mainWindow)
+				return
+			}
+			log.Println("Run output:", output)
+		}()
+	}
+	runButton = widget.NewButton("Run", func() { runFormulas("") })
 
 	// Put everything together
 	content := container.NewHSplit(
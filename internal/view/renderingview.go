@@ -0,0 +1,110 @@
+package view
+
+import (
+	"bytes"
+	"strconv"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+	"github.com/lrdickson/calx/internal/kernel/render"
+)
+
+// newRenderingView shows a result in the richest form it was rendered in
+func newRenderingView(rendering render.Rendering) fyne.CanvasObject {
+	switch {
+	case rendering.Image != nil:
+		image := canvas.NewImageFromReader(bytes.NewReader(rendering.Image), "result.png")
+		image.FillMode = canvas.ImageFillContain
+		return image
+	case rendering.Table != nil:
+		return newTableView(rendering.Table)
+	case rendering.Tree != nil:
+		return newTreeView(rendering.Tree)
+	}
+	label := widget.NewLabel(rendering.Text)
+	label.TextStyle = fyne.TextStyle{Monospace: true}
+	return container.NewScroll(label)
+}
+
+// newTableView shows a table with the column names as its first row
+func newTableView(table *render.Table) fyne.CanvasObject {
+	rows := table.Rows
+	if table.Columns != nil {
+		rows = append([][]string{table.Columns}, rows...)
+	}
+	columnCount := 0
+	for _, row := range rows {
+		if len(row) > columnCount {
+			columnCount = len(row)
+		}
+	}
+
+	tableView := widget.NewTable(
+		func() (int, int) {
+			return len(rows), columnCount
+		},
+		func() fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.TableCellID, obj fyne.CanvasObject) {
+			label := obj.(*widget.Label)
+			label.TextStyle = fyne.TextStyle{Bold: table.Columns != nil && id.Row == 0}
+			label.SetText("")
+			if id.Col < len(rows[id.Row]) {
+				label.SetText(rows[id.Row][id.Col])
+			}
+		})
+
+	// Make each column wide enough for its longest cell
+	for column := 0; column < columnCount; column++ {
+		width := float32(0)
+		for _, row := range rows {
+			if column < len(row) {
+				size := fyne.MeasureText(row[column], theme.TextSize(), fyne.TextStyle{Bold: true})
+				if size.Width > width {
+					width = size.Width
+				}
+			}
+		}
+		tableView.SetColumnWidth(column, width+4*theme.Padding())
+	}
+	return tableView
+}
+
+// newTreeView shows a tree with every branch open. Nodes are identified by
+// the path of child indexes leading to them.
+func newTreeView(tree *render.Tree) fyne.CanvasObject {
+	nodes := map[widget.TreeNodeID]*render.Tree{"": tree}
+	var addChildren func(id widget.TreeNodeID, node *render.Tree)
+	addChildren = func(id widget.TreeNodeID, node *render.Tree) {
+		for index, child := range node.Children {
+			childID := id + "/" + strconv.Itoa(index)
+			nodes[childID] = child
+			addChildren(childID, child)
+		}
+	}
+	addChildren("", tree)
+
+	treeView := widget.NewTree(
+		func(id widget.TreeNodeID) []widget.TreeNodeID {
+			children := make([]widget.TreeNodeID, 0, len(nodes[id].Children))
+			for index := range nodes[id].Children {
+				children = append(children, id+"/"+strconv.Itoa(index))
+			}
+			return children
+		},
+		func(id widget.TreeNodeID) bool {
+			return len(nodes[id].Children) > 0
+		},
+		func(branch bool) fyne.CanvasObject {
+			return widget.NewLabel("")
+		},
+		func(id widget.TreeNodeID, branch bool, obj fyne.CanvasObject) {
+			obj.(*widget.Label).SetText(nodes[id].Label)
+		})
+	treeView.OpenAllBranches()
+	return treeView
+}
@@ -1,13 +1,26 @@
 package view
 
 import (
+	"sync"
+
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/data/binding"
 	"fyne.io/fyne/v2/widget"
+	"github.com/lrdickson/calx/internal/kernel"
 )
 
-func newVariableDisplayView(variables map[string]*formulaInfo) (binding.UntypedList, *widget.List) {
+// outputRow is a row of the variable display list showing one of the
+// outputs of a formula, such as stats.mean, under the formula's own row
+type outputRow struct {
+	formula formulaInfo
+	name    string
+	text    string
+}
+
+// newVariableDisplayView lists the variables along with their outputs. The
+// function it returns replaces the output rows shown under a variable.
+func newVariableDisplayView(variables map[string]*formulaInfo) (binding.UntypedList, *widget.List, func(*formulaInfo, []kernel.Output)) {
 
 	// Display the output
 	displayVariables := binding.NewUntypedList()
@@ -23,16 +36,50 @@ func newVariableDisplayView(variables map[string]*formulaInfo) (binding.UntypedL
 			// Get the variable
 			v, err := item.(binding.Untyped).Get()
 			checkErrFatal("Failed to get variable data:", err)
+			output := obj.(*fyne.Container).Objects[0].(*widget.Label)
+			nameLabel := obj.(*fyne.Container).Objects[1].(*widget.Label)
+
+			// Output rows don't change once shown
+			if row, ok := v.(outputRow); ok {
+				output.Unbind()
+				output.SetText(row.text)
+				nameLabel.Unbind()
+				nameLabel.SetText(row.name)
+				return
+			}
 			variable := v.(formulaInfo)
 
 			// Set the output
-			output := obj.(*fyne.Container).Objects[0].(*widget.Label)
 			output.Bind(variable.output)
 
 			// Set the name
-			nameLabel := obj.(*fyne.Container).Objects[1].(*widget.Label)
 			nameLabel.Bind(variable.name)
 		})
 
-	return displayVariables, displayVariablesView
+	// Formulas can finish at the same time, so the rows are replaced one
+	// formula at a time
+	var mutex sync.Mutex
+	showOutputs := func(variable *formulaInfo, outputs []kernel.Output) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		name, err := variable.name.Get()
+		checkErrFatal("Failed to get variable name:", err)
+		rows, err := displayVariables.Get()
+		checkErrFatal("Failed to get variable interface array:", err)
+		updated := make([]any, 0, len(rows)+len(outputs))
+		for _, row := range rows {
+			if output, ok := row.(outputRow); ok && output.formula.name == variable.name {
+				continue
+			}
+			updated = append(updated, row)
+			if shown, ok := row.(formulaInfo); ok && shown.name == variable.name {
+				for _, output := range outputs {
+					updated = append(updated, outputRow{shown, name + "." + output.Name, output.Text})
+				}
+			}
+		}
+		displayVariables.Set(updated)
+	}
+
+	return displayVariables, displayVariablesView, showOutputs
 }